@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+const usage = `Usage: deadletters [flags] <command> <queue> [event-id]
+
+Commands:
+  list <queue>                 lists the dead letters of a queue
+  inspect <queue> <event-id>   shows a dead letter with its decoded event
+  requeue <queue> <event-id>   publishes a dead letter again
+  discard <queue> <event-id>   drops a dead letter
+
+Flags:
+`
+
+func failOnError(err error, msg string) {
+	if err != nil {
+		log.Fatalf("%s: %s", msg, err)
+		panic(fmt.Sprintf("%s: %s", msg, err))
+	}
+}
+
+func main() {
+	baseURL := flag.String("url", envOr("DRONES_CMDS_URL", "http://localhost:3000"), "base URL of drones-cmds")
+	token := flag.String("token", os.Getenv("DRONES_ADMIN_TOKEN"), "bearer token with the fleet:admin scope")
+	limit := flag.Int("limit", 50, "maximum number of dead letters to list")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 2 || (args[0] != "list" && len(args) < 3) {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	path := "/api/admin/dead-letters/" + url.PathEscape(args[1])
+	method := "GET"
+	switch args[0] {
+	case "list":
+		path += fmt.Sprintf("?limit=%d", *limit)
+	case "inspect":
+		path += "/" + url.PathEscape(args[2])
+	case "requeue":
+		method = "POST"
+		path += "/" + url.PathEscape(args[2]) + "/requeue"
+	case "discard":
+		method = "DELETE"
+		path += "/" + url.PathEscape(args[2])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	request, err := http.NewRequest(method, *baseURL+path, nil)
+	failOnError(err, "Failed to build request")
+	if *token != "" {
+		request.Header.Set("Authorization", "Bearer "+*token)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	failOnError(err, "Failed to reach drones-cmds")
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	failOnError(err, "Failed to read response")
+
+	var indented bytes.Buffer
+	if json.Indent(&indented, body, "", "  ") == nil {
+		body = indented.Bytes()
+	}
+	fmt.Println(string(body))
+	if response.StatusCode >= 300 {
+		os.Exit(1)
+	}
+}
+
+func envOr(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
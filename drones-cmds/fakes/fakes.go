@@ -1,7 +1,15 @@
 package fakes
 
+import (
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
 type FakeQueueDispatcher struct {
 	Messages []interface{}
+	Err      error
 }
 
 func NewFakeQueueDispatcher() (dispatcher *FakeQueueDispatcher) {
@@ -11,6 +19,161 @@ func NewFakeQueueDispatcher() (dispatcher *FakeQueueDispatcher) {
 }
 
 func (q *FakeQueueDispatcher) DispatchMessage(message interface{}) (err error) {
+	if q.Err != nil {
+		return q.Err
+	}
 	q.Messages = append(q.Messages, message)
 	return
 }
+
+// FakeClock always tells the same time.
+type FakeClock struct {
+	Time time.Time
+}
+
+func (c *FakeClock) Now() time.Time {
+	return c.Time
+}
+
+type FakePublishChannel struct {
+	Published  []amqp.Publishing
+	PublishErr error
+	Nack       bool
+	Return     *amqp.Return
+	NoConfirm  bool
+	Declared   []string
+
+	// DeclaredDurable and DeclaredArgs follow the order of Declared.
+	DeclaredDurable []bool
+	DeclaredArgs    []amqp.Table
+
+	// Exchanges and RoutingKeys record where every message was published.
+	Exchanges         []string
+	RoutingKeys       []string
+	DeclaredExchanges []string
+	Bindings          []string
+
+	// Queued holds the messages Get hands out, by queue. Settled records
+	// how they were acknowledged.
+	Queued  map[string][]amqp.Delivery
+	Settled FakeAcknowledger
+	getTag  uint64
+
+	deliveryTag    uint64
+	confirms       chan amqp.Confirmation
+	returns        chan amqp.Return
+	mutex          sync.Mutex
+	closeNotifiers []chan *amqp.Error
+}
+
+func NewFakePublishChannel() (channel *FakePublishChannel) {
+	channel = &FakePublishChannel{}
+	channel.Published = make([]amqp.Publishing, 0)
+	return
+}
+
+func (c *FakePublishChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) (err error) {
+	if c.PublishErr != nil {
+		return c.PublishErr
+	}
+	c.Published = append(c.Published, msg)
+	c.Exchanges = append(c.Exchanges, exchange)
+	c.RoutingKeys = append(c.RoutingKeys, key)
+	c.deliveryTag++
+
+	if c.Return != nil && c.returns != nil {
+		c.returns <- *c.Return
+	}
+	if !c.NoConfirm && c.confirms != nil {
+		c.confirms <- amqp.Confirmation{DeliveryTag: c.deliveryTag, Ack: !c.Nack}
+	}
+	return
+}
+
+func (c *FakePublishChannel) Confirm(noWait bool) (err error) {
+	return
+}
+
+func (c *FakePublishChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	c.confirms = confirm
+	return confirm
+}
+
+func (c *FakePublishChannel) NotifyReturn(returns chan amqp.Return) chan amqp.Return {
+	c.returns = returns
+	return returns
+}
+
+func (c *FakePublishChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	c.Declared = append(c.Declared, name)
+	c.DeclaredDurable = append(c.DeclaredDurable, durable)
+	c.DeclaredArgs = append(c.DeclaredArgs, args)
+	return amqp.Queue{Name: name}, nil
+}
+
+func (c *FakePublishChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	c.DeclaredExchanges = append(c.DeclaredExchanges, name+" "+kind)
+	return nil
+}
+
+// QueueBind records bindings as "<queue> <exchange> <routing key>".
+func (c *FakePublishChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	c.Bindings = append(c.Bindings, name+" "+exchange+" "+key)
+	return nil
+}
+
+func (c *FakePublishChannel) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.Queued[queue]) == 0 {
+		return amqp.Delivery{}, false, nil
+	}
+	delivery := c.Queued[queue][0]
+	c.Queued[queue] = c.Queued[queue][1:]
+	c.getTag++
+	delivery.DeliveryTag = c.getTag
+	delivery.Acknowledger = &c.Settled
+	return delivery, true, nil
+}
+
+// FakeAcknowledger records the delivery tags of acknowledged messages.
+type FakeAcknowledger struct {
+	mutex  sync.Mutex
+	Acked  []uint64
+	Nacked []uint64
+}
+
+func (a *FakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.Acked = append(a.Acked, tag)
+	return nil
+}
+
+func (a *FakeAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.Nacked = append(a.Nacked, tag)
+	return nil
+}
+
+func (a *FakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+func (c *FakePublishChannel) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closeNotifiers = append(c.closeNotifiers, receiver)
+	return receiver
+}
+
+func (c *FakePublishChannel) Close() (err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, receiver := range c.closeNotifiers {
+		close(receiver)
+	}
+	c.closeNotifiers = nil
+	return
+}
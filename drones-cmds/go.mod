@@ -7,4 +7,7 @@ require (
 	github.com/maxsuelmarinho/golang-event-driven-example v0.0.0-20190404022015-7f83710076d3
 	github.com/streadway/amqp v0.0.0-20190402114354-16ed540749f6
 	github.com/unrolled/render v1.0.0
+	gopkg.in/yaml.v2 v2.4.0
 )
+
+replace github.com/maxsuelmarinho/golang-event-driven-example => ../
@@ -230,39 +230,54 @@ func consumeRabbit(t *testing.T) {
 }
 
 func reactTelemetry(telemetryRaw amqp.Delivery) {
-	var event dronescommon.TelemetryUpdatedEvent
-	err := json.Unmarshal(telemetryRaw.Body, &event)
+	decoded, err := dronescommon.DefaultDecoder.DecodeDelivery(telemetryRaw)
 	if err != nil {
 		fmt.Printf("Failed to deserialize raw telemetry from queue, %v\n", err)
 		return
 	}
 
+	event, ok := decoded.(dronescommon.TelemetryUpdatedEvent)
+	if !ok {
+		fmt.Printf("Expected TelemetryUpdatedEvent from queue, got %T\n", decoded)
+		return
+	}
+
 	fmt.Printf("Telemetry received: %+v\n", event)
 	telemetryCount++
 	telemetryRaw.Ack(false)
 }
 
 func reactAlert(alertRaw amqp.Delivery) {
-	var event dronescommon.AlertSignalledEvent
-	err := json.Unmarshal(alertRaw.Body, &event)
+	decoded, err := dronescommon.DefaultDecoder.DecodeDelivery(alertRaw)
 	if err != nil {
 		fmt.Printf("Failed to deserialize raw alert from queue, %v\n", err)
 		return
 	}
 
+	event, ok := decoded.(dronescommon.AlertSignalledEvent)
+	if !ok {
+		fmt.Printf("Expected AlertSignalledEvent from queue, got %T\n", decoded)
+		return
+	}
+
 	fmt.Printf("Alert received: %+v\n", event)
 	alertCount++
 	alertRaw.Ack(false)
 }
 
 func reactPosition(positionRaw amqp.Delivery) {
-	var event dronescommon.PositionChangedEvent
-	err := json.Unmarshal(positionRaw.Body, &event)
+	decoded, err := dronescommon.DefaultDecoder.DecodeDelivery(positionRaw)
 	if err != nil {
 		fmt.Printf("Failed to deserialize raw position from queue, %v\n", err)
 		return
 	}
 
+	event, ok := decoded.(dronescommon.PositionChangedEvent)
+	if !ok {
+		fmt.Printf("Expected PositionChangedEvent from queue, got %T\n", decoded)
+		return
+	}
+
 	fmt.Printf("Position received: %+v\n", event)
 	positionCount++
 	positionRaw.Ack(false)
@@ -39,7 +39,8 @@ func TestAMQPDispatcherSubmitsToQueue(t *testing.T) {
 		nil,
 	)
 	failOnError(t, err, "Failed to declare a queue")
-	dispatcher := NewAMQPDispatcher(ch, q.Name, true)
+	dispatcher, err := NewAMQPDispatcher(ch, q.Name, true)
+	failOnError(t, err, "Failed to create dispatcher")
 	fmt.Println("About to dispatch message to queue...")
 	err = dispatcher.DispatchMessage(fakeMessage{a: "hello", b: "world"})
 	failOnError(t, err, "Failed to dispatch message on channel/queue")
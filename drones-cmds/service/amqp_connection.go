@@ -0,0 +1,372 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	defaultMinReconnectDelay = 500 * time.Millisecond
+	defaultMaxReconnectDelay = 30 * time.Second
+)
+
+type amqpConnection interface {
+	Channel() (amqpChannel, error)
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+type amqpChannel interface {
+	queuePublishableChannel
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	Get(queue string, autoAck bool) (amqp.Delivery, bool, error)
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+type amqpDialer func(url string) (amqpConnection, error)
+
+type streadwayConnection struct {
+	*amqp.Connection
+}
+
+func (c *streadwayConnection) Channel() (amqpChannel, error) {
+	return c.Connection.Channel()
+}
+
+func dialAMQP(url string) (amqpConnection, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	return &streadwayConnection{conn}, nil
+}
+
+// ConnectionStatus describes the state of the broker connection as seen by
+// the rest of the service.
+type ConnectionStatus struct {
+	Connected bool      `json:"connected"`
+	Since     time.Time `json:"since"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// AMQPConnectionManager owns the broker connection. It declares the
+// topology once per connection and the queues of every dispatcher it hands
+// out on their own channel and, when the connection drops, keeps redialling
+// with exponential backoff and swaps fresh channels into those dispatchers.
+//
+// setup serializes the broker I/O of (re)attaching channels; mutex only
+// guards the state, so a slow broker never blocks Status.
+type AMQPConnectionManager struct {
+	url               string
+	dial              amqpDialer
+	topology          *amqpTopology
+	severities        *severityMap
+	minReconnectDelay time.Duration
+	maxReconnectDelay time.Duration
+
+	setup       sync.Mutex
+	mutex       sync.RWMutex
+	connection  amqpConnection
+	status      ConnectionStatus
+	dispatchers []*AmqpDispatcher
+	listeners   []func()
+	done        chan struct{}
+}
+
+func NewAMQPConnectionManager(url string) *AMQPConnectionManager {
+	return newAMQPConnectionManager(url, dialAMQP)
+}
+
+func newAMQPConnectionManager(url string, dial amqpDialer) *AMQPConnectionManager {
+	return &AMQPConnectionManager{
+		url:               url,
+		dial:              dial,
+		minReconnectDelay: defaultMinReconnectDelay,
+		maxReconnectDelay: defaultMaxReconnectDelay,
+		status:            ConnectionStatus{Since: time.Now()},
+		done:              make(chan struct{}),
+	}
+}
+
+// Dispatcher returns a dispatcher publishing to queueName, or through the
+// exchange the topology routes the queue to. The queue is declared on every
+// (re)connection.
+func (m *AMQPConnectionManager) Dispatcher(queueName string) *AmqpDispatcher {
+	dispatcher := newDetachedAMQPDispatcher(queueName, true)
+	dispatcher.route = m.topology.route(queueName)
+	dispatcher.topology = m.topology
+	dispatcher.severities = m.severities
+
+	m.setup.Lock()
+	defer m.setup.Unlock()
+	m.mutex.Lock()
+	m.dispatchers = append(m.dispatchers, dispatcher)
+	connection := m.connection
+	m.mutex.Unlock()
+
+	if connection != nil {
+		err := m.attach(connection, dispatcher)
+		if err != nil {
+			fmt.Printf("Failed to attach dispatcher for queue '%s': %s\n", queueName, err)
+		}
+	}
+	return dispatcher
+}
+
+// Channel opens a channel on the current connection for callers that
+// manage it themselves, like the dead-letter inspector.
+func (m *AMQPConnectionManager) Channel() (amqpChannel, error) {
+	m.mutex.RLock()
+	connection := m.connection
+	m.mutex.RUnlock()
+	if connection == nil {
+		return nil, ErrNotConnected
+	}
+	return connection.Channel()
+}
+
+// OnReconnect registers a callback invoked every time the connection is
+// (re)established.
+func (m *AMQPConnectionManager) OnReconnect(listener func()) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.listeners = append(m.listeners, listener)
+}
+
+// Start makes the first connection attempt. When it fails the manager keeps
+// retrying in the background and the error is only reported.
+func (m *AMQPConnectionManager) Start() error {
+	fmt.Printf("\nUsing URL (%s) for Rabbit.\n", m.url)
+	err := m.connect()
+	if err != nil {
+		fmt.Printf("Failed to connect to RabbitMQ, retrying in background: %s\n", err)
+		go m.reconnect()
+	}
+	return err
+}
+
+func (m *AMQPConnectionManager) Healthy() bool {
+	return m.Status().Connected
+}
+
+func (m *AMQPConnectionManager) Status() ConnectionStatus {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.status
+}
+
+func (m *AMQPConnectionManager) Close() error {
+	m.mutex.Lock()
+	select {
+	case <-m.done:
+		m.mutex.Unlock()
+		return nil
+	default:
+		close(m.done)
+	}
+	connection := m.connection
+	m.mutex.Unlock()
+
+	if connection == nil {
+		return nil
+	}
+	return connection.Close()
+}
+
+func (m *AMQPConnectionManager) connect() error {
+	connection, err := m.dial(m.url)
+	if err != nil {
+		m.setDisconnected(err)
+		return err
+	}
+
+	m.setup.Lock()
+	defer m.setup.Unlock()
+	err = m.declareTopology(connection)
+	if err != nil {
+		connection.Close()
+		m.setDisconnected(err)
+		return err
+	}
+
+	dispatchers := m.snapshotDispatchers()
+	for _, dispatcher := range dispatchers {
+		err = m.attach(connection, dispatcher)
+		if err != nil {
+			for _, attached := range dispatchers {
+				attached.detachChannel()
+			}
+			connection.Close()
+			m.setDisconnected(err)
+			return err
+		}
+	}
+	closed := connection.NotifyClose(make(chan *amqp.Error, 1))
+
+	m.mutex.Lock()
+	m.connection = connection
+	m.status = ConnectionStatus{Connected: true, Since: time.Now()}
+	listeners := append([]func(){}, m.listeners...)
+	m.mutex.Unlock()
+
+	fmt.Printf("Connected to RabbitMQ\n")
+	go m.watch(connection, closed)
+	for _, listener := range listeners {
+		go listener()
+	}
+	return nil
+}
+
+// declareTopology declares the exchanges, queues and bindings of the
+// topology on a channel of its own.
+func (m *AMQPConnectionManager) declareTopology(connection amqpConnection) error {
+	if m.topology == nil {
+		return nil
+	}
+	channel, err := connection.Channel()
+	if err != nil {
+		return err
+	}
+	defer channel.Close()
+	return m.topology.declare(channel)
+}
+
+// attach opens a channel for a dispatcher, declaring its queue unless the
+// topology does or the dispatcher publishes through an exchange.
+func (m *AMQPConnectionManager) attach(connection amqpConnection, dispatcher *AmqpDispatcher) error {
+	channel, err := connection.Channel()
+	if err != nil {
+		return err
+	}
+
+	if dispatcher.route.Exchange == "" && !m.topology.declares(dispatcher.queueName) {
+		err = m.declareQueue(channel, dispatcher.queueName)
+	}
+	if err != nil {
+		channel.Close()
+		return err
+	}
+
+	err = dispatcher.attachChannel(channel)
+	if err != nil {
+		channel.Close()
+		return err
+	}
+
+	go m.watchChannel(connection, channel, dispatcher)
+	return nil
+}
+
+// declareQueue declares a queue the topology does not, after the dead-letter
+// exchange and queues of its own a per-tenant queue may have.
+func (m *AMQPConnectionManager) declareQueue(channel amqpChannel, queueName string) error {
+	err := m.topology.tenantDeadLetters(queueName).declare(channel)
+	if err != nil {
+		return err
+	}
+
+	queue := m.topology.queue(queueName)
+	_, err = channel.QueueDeclare(
+		queueName,
+		queue.Durable,
+		queue.AutoDelete,
+		false,
+		false,
+		queue.arguments(),
+	)
+	if err != nil {
+		return declarationError("queue", queueName, err)
+	}
+	return nil
+}
+
+func (m *AMQPConnectionManager) watch(connection amqpConnection, closed chan *amqp.Error) {
+	closeErr, ok := <-closed
+	select {
+	case <-m.done:
+		return
+	default:
+	}
+
+	m.mutex.Lock()
+	if m.connection == connection {
+		m.connection = nil
+	}
+	m.mutex.Unlock()
+	for _, dispatcher := range m.snapshotDispatchers() {
+		dispatcher.detachChannel()
+	}
+
+	var err error = amqp.ErrClosed
+	if ok && closeErr != nil {
+		err = closeErr
+	}
+	fmt.Printf("Lost connection to RabbitMQ: %s\n", err)
+	m.setDisconnected(err)
+	m.reconnect()
+}
+
+// watchChannel reopens the channel of a dispatcher when the broker closes it
+// while the connection itself stays up, e.g. after a channel exception.
+func (m *AMQPConnectionManager) watchChannel(connection amqpConnection, channel amqpChannel, dispatcher *AmqpDispatcher) {
+	<-channel.NotifyClose(make(chan *amqp.Error, 1))
+
+	m.setup.Lock()
+	defer m.setup.Unlock()
+	m.mutex.RLock()
+	current := m.connection
+	m.mutex.RUnlock()
+	if current != connection || !dispatcher.detachChannelIf(channel) {
+		return
+	}
+
+	fmt.Printf("Channel for queue '%s' closed, reopening\n", dispatcher.queueName)
+	err := m.attach(connection, dispatcher)
+	if err != nil {
+		fmt.Printf("Failed to reopen channel for queue '%s': %s\n", dispatcher.queueName, err)
+	}
+}
+
+func (m *AMQPConnectionManager) reconnect() {
+	delay := m.minReconnectDelay
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-time.After(delay):
+		}
+
+		err := m.connect()
+		if err == nil {
+			return
+		}
+
+		fmt.Printf("Failed to reconnect to RabbitMQ, next attempt in %s: %s\n", delay, err)
+		delay *= 2
+		if delay > m.maxReconnectDelay {
+			delay = m.maxReconnectDelay
+		}
+	}
+}
+
+func (m *AMQPConnectionManager) snapshotDispatchers() []*AmqpDispatcher {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return append([]*AmqpDispatcher{}, m.dispatchers...)
+}
+
+func (m *AMQPConnectionManager) setDisconnected(err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.status.Connected {
+		m.status.Since = time.Now()
+	}
+	m.status.Connected = false
+	m.status.LastError = err.Error()
+}
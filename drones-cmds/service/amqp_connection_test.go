@@ -0,0 +1,174 @@
+package service
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maxsuelmarinho/golang-event-driven-example/drones-cmds/fakes"
+	dronescommon "github.com/maxsuelmarinho/golang-event-driven-example/drones-common"
+	"github.com/streadway/amqp"
+)
+
+type fakeConnection struct {
+	mutex     sync.Mutex
+	channels  []*fakes.FakePublishChannel
+	notifiers []chan *amqp.Error
+
+	// opening, when set, holds Channel until it is closed, like a slow broker.
+	opening chan struct{}
+}
+
+func (c *fakeConnection) Channel() (amqpChannel, error) {
+	if c.opening != nil {
+		<-c.opening
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	channel := fakes.NewFakePublishChannel()
+	c.channels = append(c.channels, channel)
+	return channel, nil
+}
+
+func (c *fakeConnection) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.notifiers = append(c.notifiers, receiver)
+	return receiver
+}
+
+func (c *fakeConnection) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, channel := range c.channels {
+		channel.Close()
+	}
+	for _, receiver := range c.notifiers {
+		receiver <- amqp.ErrClosed
+		close(receiver)
+	}
+	c.notifiers = nil
+	return nil
+}
+
+type fakeDialer struct {
+	mutex       sync.Mutex
+	failures    int
+	opening     chan struct{}
+	connections []*fakeConnection
+}
+
+func (d *fakeDialer) dial(url string) (amqpConnection, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.failures > 0 {
+		d.failures--
+		return nil, errors.New("connection refused")
+	}
+	connection := &fakeConnection{opening: d.opening}
+	d.connections = append(d.connections, connection)
+	return connection, nil
+}
+
+func (d *fakeDialer) dialCount() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return len(d.connections)
+}
+
+func newTestConnectionManager(dialer *fakeDialer) *AMQPConnectionManager {
+	manager := newAMQPConnectionManager("amqp://test", dialer.dial)
+	manager.minReconnectDelay = time.Millisecond
+	manager.maxReconnectDelay = 5 * time.Millisecond
+	return manager
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Condition not met before deadline")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConnectionManagerRetriesInitialConnection(t *testing.T) {
+	dialer := &fakeDialer{failures: 3}
+	manager := newTestConnectionManager(dialer)
+	defer manager.Close()
+	dispatcher := manager.Dispatcher("telemetry")
+
+	if err := manager.Start(); err == nil {
+		t.Errorf("Expected first connection attempt to fail")
+	}
+
+	if manager.Healthy() {
+		t.Errorf("Expected manager to report unhealthy connection")
+	}
+
+	if err := dispatcher.DispatchMessage(dronescommon.TelemetryUpdatedEvent{}); err != ErrNotConnected {
+		t.Errorf("Expected ErrNotConnected while disconnected, got %v", err)
+	}
+
+	waitFor(t, manager.Healthy)
+
+	channel := dialer.connections[0].channels[0]
+	if len(channel.Declared) != 1 || channel.Declared[0] != "telemetry" {
+		t.Errorf("Expected queue 'telemetry' to be declared, got %v", channel.Declared)
+	}
+}
+
+func TestConnectionManagerSwapsChannelsAfterReconnect(t *testing.T) {
+	dialer := &fakeDialer{}
+	manager := newTestConnectionManager(dialer)
+	defer manager.Close()
+	dispatcher := manager.Dispatcher("alerts")
+
+	if err := manager.Start(); err != nil {
+		t.Fatalf("Expected first connection attempt to succeed, got %s", err)
+	}
+
+	dialer.connections[0].Close()
+	waitFor(t, func() bool { return dialer.dialCount() == 2 && manager.Healthy() })
+
+	err := dispatcher.DispatchMessage(dronescommon.AlertSignalledEvent{DroneID: "drone123"})
+	if err != nil {
+		t.Errorf("Expected dispatch on the recovered channel to succeed, got %s", err)
+	}
+
+	if len(dialer.connections[1].channels[0].Published) != 1 {
+		t.Errorf("Expected message to be published on the new channel")
+	}
+}
+
+func TestConnectionManagerStatusDoesNotWaitForBroker(t *testing.T) {
+	dialer := &fakeDialer{opening: make(chan struct{})}
+	manager := newTestConnectionManager(dialer)
+	defer manager.Close()
+	manager.Dispatcher("alerts")
+
+	started := make(chan error, 1)
+	go func() { started <- manager.Start() }()
+	waitFor(t, func() bool { return dialer.dialCount() == 1 })
+
+	status := make(chan ConnectionStatus, 1)
+	go func() { status <- manager.Status() }()
+	select {
+	case current := <-status:
+		if current.Connected {
+			t.Errorf("Expected manager to be disconnected while opening channels")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected status to be reported while the broker is slow")
+	}
+
+	close(dialer.opening)
+	if err := <-started; err != nil {
+		t.Errorf("Expected connection to succeed, got %s", err)
+	}
+	if !manager.Healthy() {
+		t.Errorf("Expected manager to be healthy once channels are open")
+	}
+}
@@ -2,42 +2,161 @@ package service
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
+	"time"
 
+	dronescommon "github.com/maxsuelmarinho/golang-event-driven-example/drones-common"
 	"github.com/streadway/amqp"
 )
 
+const defaultConfirmTimeout = 5 * time.Second
+
+// notificationBuffer is the capacity of the confirm and return channels. The
+// connection reader blocks on a full channel, stalling every channel of the
+// connection, so it must hold the late confirmations of timed out messages
+// until the next dispatch drains them.
+const notificationBuffer = 256
+
+var (
+	ErrConfirmTimeout = errors.New("timed out waiting for broker confirmation")
+	ErrChannelClosed  = errors.New("channel closed before broker confirmation")
+	ErrNotConnected   = errors.New("not connected to the broker")
+)
+
+// PublishNackedError is returned when the broker negatively acknowledges a
+// published message.
+type PublishNackedError struct {
+	Queue       string
+	DeliveryTag uint64
+}
+
+// PublishReturnedError is returned when the broker hands a mandatory message
+// back because it could not be routed to any queue.
+type PublishReturnedError struct {
+	Queue     string
+	ReplyCode uint16
+	ReplyText string
+}
+
 type AmqpDispatcher struct {
-	channel       queuePublishableChannel
-	queueName     string
-	mandatorySend bool
+	channel        queuePublishableChannel
+	queueName      string
+	route          publishRoute
+	topology       *amqpTopology
+	mandatorySend  bool
+	confirmTimeout time.Duration
+
+	// structuredCloudEvents publishes envelopes as CloudEvents in structured
+	// content mode instead of binary mode.
+	structuredCloudEvents bool
+
+	// severities sets the priority alerts are published with.
+	severities *severityMap
+
+	mutex       sync.Mutex
+	confirms    chan amqp.Confirmation
+	returns     chan amqp.Return
+	deliveryTag uint64
 }
 
 type queuePublishableChannel interface {
 	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
+}
+
+func (e *PublishNackedError) Error() string {
+	return fmt.Sprintf("broker nacked message %d published to queue '%s'", e.DeliveryTag, e.Queue)
+}
+
+func (e *PublishReturnedError) Error() string {
+	return fmt.Sprintf("broker returned message published to queue '%s': %d %s", e.Queue, e.ReplyCode, e.ReplyText)
+}
+
+// NewAMQPDispatcher puts the channel into confirm mode, so every dispatched
+// message is only reported as sent once the broker has acknowledged it.
+func NewAMQPDispatcher(publishChannel queuePublishableChannel, name string, mandatory bool) (*AmqpDispatcher, error) {
+	dispatcher := newDetachedAMQPDispatcher(name, mandatory)
+	err := dispatcher.attachChannel(publishChannel)
+	if err != nil {
+		return nil, err
+	}
+	return dispatcher, nil
 }
 
-func NewAMQPDispatcher(publishChannel queuePublishableChannel, name string, mandatory bool) *AmqpDispatcher {
-	return &AmqpDispatcher{channel: publishChannel, queueName: name, mandatorySend: mandatory}
+// newDetachedAMQPDispatcher creates a dispatcher without a channel. Until one
+// is attached every dispatch fails with ErrNotConnected.
+func newDetachedAMQPDispatcher(name string, mandatory bool) *AmqpDispatcher {
+	return &AmqpDispatcher{
+		queueName:      name,
+		mandatorySend:  mandatory,
+		confirmTimeout: defaultConfirmTimeout,
+	}
+}
+
+func (q *AmqpDispatcher) attachChannel(publishChannel queuePublishableChannel) error {
+	err := publishChannel.Confirm(false)
+	if err != nil {
+		return err
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.channel = publishChannel
+	q.confirms = publishChannel.NotifyPublish(make(chan amqp.Confirmation, notificationBuffer))
+	q.returns = publishChannel.NotifyReturn(make(chan amqp.Return, notificationBuffer))
+	q.deliveryTag = 0
+	return nil
+}
+
+func (q *AmqpDispatcher) detachChannel() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.channel = nil
+}
+
+// detachChannelIf detaches the channel only when it is still the one in use,
+// reporting whether it did.
+func (q *AmqpDispatcher) detachChannelIf(publishChannel queuePublishableChannel) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.channel != publishChannel {
+		return false
+	}
+	q.channel = nil
+	return true
 }
 
 func (q *AmqpDispatcher) DispatchMessage(message interface{}) (err error) {
 	fmt.Printf("Dispatching message to queue '%s'\n", q.queueName)
-	body, err := json.Marshal(message)
+	publishing, err := newPublishing(message, q.structuredCloudEvents, q.severities)
 	if err != nil {
 		fmt.Printf("Failed to marshal message %v (%s)\n", message, err)
 		return err
 	}
+	publishing.DeliveryMode = q.topology.deliveryMode(publishing.Type)
+	publishing.Expiration = q.topology.expiration(publishing.Type)
 
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.channel == nil {
+		fmt.Printf("Failed to dispatch message: %s\n", ErrNotConnected)
+		return ErrNotConnected
+	}
+
+	exchange, key := q.destination(message)
+	q.drainConfirms()
+	q.drainReturns()
 	err = q.channel.Publish(
-		"",              // exchange
-		q.queueName,     // routing key
+		exchange,
+		key,
 		q.mandatorySend, // mandatory
 		false,           // immediate
-		amqp.Publishing{
-			ContentType: "text/plain",
-			Body:        []byte(body),
-		},
+		publishing,
 	)
 
 	if err != nil {
@@ -45,5 +164,140 @@ func (q *AmqpDispatcher) DispatchMessage(message interface{}) (err error) {
 		return err
 	}
 
+	q.deliveryTag++
+	err = q.waitForConfirmation(q.deliveryTag)
+	if err != nil {
+		fmt.Printf("Failed to dispatch message: %s\n", err)
+		return err
+	}
+
 	return nil
 }
+
+// destination returns the exchange and routing key of a message: the queue
+// itself through the default exchange, unless the dispatcher is routed
+// through an exchange.
+func (q *AmqpDispatcher) destination(message interface{}) (string, string) {
+	if q.route.Exchange == "" {
+		return "", q.queueName
+	}
+	return q.route.Exchange, routingKey(q.route.RoutingKey, q.queueName, message)
+}
+
+// newPublishing maps the metadata of event envelopes onto the AMQP message
+// properties, so consumers can tell events apart without parsing the body.
+// Envelopes are also encoded as CloudEvents, in binary content mode unless
+// structured is set, and alerts get the priority of their severity.
+func newPublishing(message interface{}, structured bool, severities *severityMap) (amqp.Publishing, error) {
+	envelope, ok := message.(dronescommon.EventEnvelope)
+	if !ok {
+		body, err := json.Marshal(message)
+		if err != nil {
+			return amqp.Publishing{}, err
+		}
+		return amqp.Publishing{ContentType: "application/json", Body: body}, nil
+	}
+
+	headers := amqp.Table{
+		"event_id":       envelope.EventID,
+		"event_type":     envelope.EventType,
+		"schema_version": int32(envelope.SchemaVersion),
+		"source":         envelope.Source,
+		"occurred_at":    envelope.OccurredAt.Format(time.RFC3339Nano),
+		"received_on":    envelope.ReceivedOn,
+	}
+	if envelope.TenantID != "" {
+		headers["tenant_id"] = envelope.TenantID
+	}
+	if envelope.FleetID != "" {
+		headers["fleet_id"] = envelope.FleetID
+	}
+	data := decodeEnvelopeData(envelope)
+	if data.DroneID != "" {
+		headers["drone_id"] = data.DroneID
+	}
+	if data.Severity != "" {
+		headers["severity"] = data.Severity
+	}
+
+	cloudEvent := dronescommon.CloudEventFromEnvelope(envelope)
+	var publishing amqp.Publishing
+	if structured {
+		var err error
+		publishing, err = cloudEvent.ToAMQPStructured()
+		if err != nil {
+			return amqp.Publishing{}, err
+		}
+	} else {
+		publishing = cloudEvent.ToAMQPBinary()
+		for key, value := range publishing.Headers {
+			headers[key] = value
+		}
+	}
+
+	publishing.Headers = headers
+	publishing.MessageId = envelope.EventID
+	publishing.Type = envelope.EventType
+	publishing.Timestamp = envelope.OccurredAt
+	publishing.CorrelationId = envelope.CorrelationID
+	publishing.AppId = envelope.Source
+	publishing.Priority = severities.priority(data.Severity)
+	return publishing, nil
+}
+
+func (q *AmqpDispatcher) waitForConfirmation(deliveryTag uint64) error {
+	timeout := time.NewTimer(q.confirmTimeout)
+	defer timeout.Stop()
+
+	for {
+		select {
+		case confirmation, ok := <-q.confirms:
+			if !ok {
+				return ErrChannelClosed
+			}
+			if confirmation.DeliveryTag < deliveryTag {
+				// late confirmation of a message we already gave up on
+				continue
+			}
+
+			// the broker sends basic.return before the ack of the same message
+			select {
+			case returned := <-q.returns:
+				return &PublishReturnedError{Queue: q.queueName, ReplyCode: returned.ReplyCode, ReplyText: returned.ReplyText}
+			default:
+			}
+
+			if !confirmation.Ack {
+				return &PublishNackedError{Queue: q.queueName, DeliveryTag: confirmation.DeliveryTag}
+			}
+			return nil
+		case <-timeout.C:
+			return ErrConfirmTimeout
+		}
+	}
+}
+
+// drainConfirms drops the late confirmations of messages we already gave up
+// on. A closed channel is left for waitForConfirmation to report.
+func (q *AmqpDispatcher) drainConfirms() {
+	for {
+		select {
+		case _, ok := <-q.confirms:
+			if !ok {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (q *AmqpDispatcher) drainReturns() {
+	for {
+		select {
+		case <-q.returns:
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/maxsuelmarinho/golang-event-driven-example/drones-cmds/fakes"
+	dronescommon "github.com/maxsuelmarinho/golang-event-driven-example/drones-common"
+	"github.com/streadway/amqp"
+)
+
+func TestDispatchWaitsForBrokerAck(t *testing.T) {
+	channel := fakes.NewFakePublishChannel()
+	dispatcher, err := NewAMQPDispatcher(channel, "telemetry", true)
+	if err != nil {
+		t.Fatalf("Failed to create dispatcher: %s", err)
+	}
+
+	err = dispatcher.DispatchMessage(dronescommon.TelemetryUpdatedEvent{DroneID: "drone123"})
+	if err != nil {
+		t.Errorf("Expected acked dispatch to succeed, got %s", err)
+	}
+
+	if len(channel.Published) != 1 {
+		t.Errorf("Expected 1 published message, got %d", len(channel.Published))
+	}
+}
+
+func TestDispatchReturnsTypedErrorOnNack(t *testing.T) {
+	channel := fakes.NewFakePublishChannel()
+	channel.Nack = true
+	dispatcher, _ := NewAMQPDispatcher(channel, "telemetry", true)
+
+	err := dispatcher.DispatchMessage(dronescommon.TelemetryUpdatedEvent{DroneID: "drone123"})
+	var nacked *PublishNackedError
+	if !errors.As(err, &nacked) {
+		t.Errorf("Expected a PublishNackedError, got %v", err)
+	}
+}
+
+func TestDispatchReturnsTypedErrorOnReturn(t *testing.T) {
+	channel := fakes.NewFakePublishChannel()
+	channel.Return = &amqp.Return{ReplyCode: 312, ReplyText: "NO_ROUTE"}
+	dispatcher, _ := NewAMQPDispatcher(channel, "telemetry", true)
+
+	err := dispatcher.DispatchMessage(dronescommon.TelemetryUpdatedEvent{DroneID: "drone123"})
+	var returned *PublishReturnedError
+	if !errors.As(err, &returned) {
+		t.Fatalf("Expected a PublishReturnedError, got %v", err)
+	}
+
+	if returned.ReplyCode != 312 {
+		t.Errorf("Expected reply code 312, got %d", returned.ReplyCode)
+	}
+}
+
+func TestDispatchTimesOutWithoutConfirmation(t *testing.T) {
+	channel := fakes.NewFakePublishChannel()
+	channel.NoConfirm = true
+	dispatcher, _ := NewAMQPDispatcher(channel, "telemetry", true)
+	dispatcher.confirmTimeout = 10 * time.Millisecond
+
+	err := dispatcher.DispatchMessage(dronescommon.TelemetryUpdatedEvent{DroneID: "drone123"})
+	if err != ErrConfirmTimeout {
+		t.Errorf("Expected ErrConfirmTimeout, got %v", err)
+	}
+}
+
+func TestDispatchDrainsLateConfirmations(t *testing.T) {
+	channel := fakes.NewFakePublishChannel()
+	channel.NoConfirm = true
+	dispatcher, _ := NewAMQPDispatcher(channel, "telemetry", true)
+	dispatcher.confirmTimeout = 10 * time.Millisecond
+
+	for tag := uint64(1); tag <= 3; tag++ {
+		dispatcher.DispatchMessage(dronescommon.TelemetryUpdatedEvent{DroneID: "drone123"})
+		select {
+		case dispatcher.confirms <- amqp.Confirmation{DeliveryTag: tag, Ack: true}:
+		default:
+			t.Fatalf("Expected late confirmation %d to be buffered", tag)
+		}
+	}
+
+	channel.NoConfirm = false
+	if err := dispatcher.DispatchMessage(dronescommon.TelemetryUpdatedEvent{DroneID: "drone123"}); err != nil {
+		t.Errorf("Expected dispatch after late confirmations to succeed, got %s", err)
+	}
+	if pending := len(dispatcher.confirms); pending != 0 {
+		t.Errorf("Expected late confirmations to be drained, got %d", pending)
+	}
+}
+
+func TestDispatchMapsEnvelopeOntoMessageProperties(t *testing.T) {
+	channel := fakes.NewFakePublishChannel()
+	dispatcher, _ := NewAMQPDispatcher(channel, "alerts", true)
+
+	envelope, _ := dronescommon.NewEventEnvelope(dronescommon.AlertSignalledEventType, dronescommon.AlertSignalledSchemaVersion,
+		"drones-cmds", dronescommon.AlertSignalledEvent{DroneID: "drone123"})
+	envelope.CorrelationID = "flight-42"
+
+	err := dispatcher.DispatchMessage(envelope)
+	if err != nil {
+		t.Fatalf("Expected dispatch to succeed, got %s", err)
+	}
+
+	publishing := channel.Published[0]
+	if publishing.ContentType != "application/json" {
+		t.Errorf("Expected content type application/json, got %s", publishing.ContentType)
+	}
+
+	if publishing.MessageId != envelope.EventID || publishing.Type != dronescommon.AlertSignalledEventType {
+		t.Errorf("Expected message ID and type from the envelope, got %s/%s", publishing.MessageId, publishing.Type)
+	}
+
+	if publishing.CorrelationId != "flight-42" {
+		t.Errorf("Expected correlation ID 'flight-42', got %s", publishing.CorrelationId)
+	}
+
+	if publishing.Headers["schema_version"] != int32(dronescommon.AlertSignalledSchemaVersion) {
+		t.Errorf("Expected schema version header, got %v", publishing.Headers["schema_version"])
+	}
+
+	if string(publishing.Body) != string(envelope.Data) {
+		t.Errorf("Expected body to be the bare event, got %s", publishing.Body)
+	}
+
+	if publishing.Headers["cloudEvents:id"] != envelope.EventID {
+		t.Errorf("Expected binary mode CloudEvent headers, got %v", publishing.Headers)
+	}
+}
+
+func TestDispatchPublishesStructuredCloudEvents(t *testing.T) {
+	channel := fakes.NewFakePublishChannel()
+	dispatcher, _ := NewAMQPDispatcher(channel, "positions", true)
+	dispatcher.structuredCloudEvents = true
+
+	envelope, _ := dronescommon.NewEventEnvelope(dronescommon.PositionChangedEventType, dronescommon.PositionChangedSchemaVersion,
+		"drones-cmds", dronescommon.PositionChangedEvent{DroneID: "drone123"})
+	dispatcher.DispatchMessage(envelope)
+
+	publishing := channel.Published[0]
+	if publishing.ContentType != dronescommon.CloudEventsContentType {
+		t.Errorf("Expected content type %s, got %s", dronescommon.CloudEventsContentType, publishing.ContentType)
+	}
+
+	cloudEvent, err := dronescommon.CloudEventFromAMQP(amqp.Delivery{ContentType: publishing.ContentType, Body: publishing.Body})
+	if err != nil {
+		t.Fatalf("Failed to decode structured CloudEvent: %s", err)
+	}
+
+	if cloudEvent.ID != envelope.EventID {
+		t.Errorf("Expected CloudEvent ID %s, got %s", envelope.EventID, cloudEvent.ID)
+	}
+}
@@ -0,0 +1,251 @@
+package service
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	droneIDHeader        = "X-Drone-ID"
+	droneTimestampHeader = "X-Drone-Timestamp"
+	droneNonceHeader     = "X-Drone-Nonce"
+	droneSignatureHeader = "X-Drone-Signature"
+
+	signatureScheme = "HMAC-SHA256"
+
+	defaultSignatureWindow = 5 * time.Minute
+)
+
+type contextKey string
+
+const authenticatedDroneKey contextKey = "authenticated-drone"
+
+// droneAuthenticator is a negroni middleware verifying that requests are
+// signed by a known drone, unless an operator was already authenticated.
+// Drones send their ID, the Unix time, a random nonce and an HMAC-SHA256 of
+// the request, computed by signRequest with their secret. Requests outside
+// the time window and reused nonces are rejected.
+type droneAuthenticator struct {
+	secrets map[string][]byte
+	clock   clock
+	window  time.Duration
+
+	mutex  sync.Mutex
+	nonces map[string]bool
+	// expiries holds the used nonces oldest first. Every nonce expires
+	// the same time after its use, so expired ones are all at the front.
+	expiries *list.List
+}
+
+type nonceExpiry struct {
+	key       string
+	expiresAt time.Time
+}
+
+func newDroneAuthenticator(secrets map[string]string, c clock) *droneAuthenticator {
+	authenticator := &droneAuthenticator{
+		secrets:  make(map[string][]byte),
+		clock:    c,
+		window:   defaultSignatureWindow,
+		nonces:   make(map[string]bool),
+		expiries: list.New(),
+	}
+	for droneID, secret := range secrets {
+		authenticator.secrets[droneID] = []byte(secret)
+	}
+	return authenticator
+}
+
+// loadDroneSecrets reads a YAML or JSON map of drone IDs to secrets.
+func loadDroneSecrets(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := make(map[string]string)
+	err = yaml.UnmarshalStrict(data, &secrets)
+	if err != nil {
+		return nil, err
+	}
+	for droneID, secret := range secrets {
+		if secret == "" {
+			return nil, fmt.Errorf("empty secret for drone '%s'", droneID)
+		}
+	}
+	return secrets, nil
+}
+
+// signRequest returns the hex HMAC-SHA256 of the method, path, timestamp,
+// nonce and body hash of a request, one per line.
+func signRequest(secret []byte, method string, path string, timestamp string, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.Join([]string{method, path, timestamp, nonce, hex.EncodeToString(bodyHash[:])}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (a *droneAuthenticator) ServeHTTP(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	if _, ok := authenticatedOperator(req); ok || req.Method == "GET" || req.Method == "HEAD" || req.Method == "OPTIONS" {
+		next(w, req)
+		return
+	}
+
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			writeProblem(w, req, malformedCommandProblem(fmt.Sprintf("Failed to read request: %s", err)))
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	droneID, err := a.authenticate(req, body)
+	if err != nil {
+		fmt.Printf("Rejected request to %s: %s\n", req.URL.Path, err)
+		p := newProblem(problemUnauthorized, http.StatusUnauthorized, "Request is not signed by a known drone.")
+		p.Detail = err.Error()
+		w.Header().Set("WWW-Authenticate", signatureScheme)
+		writeProblem(w, req, p)
+		return
+	}
+
+	next(w, req.WithContext(context.WithValue(req.Context(), authenticatedDroneKey, droneID)))
+}
+
+func (a *droneAuthenticator) authenticate(req *http.Request, body []byte) (string, error) {
+	droneID := req.Header.Get(droneIDHeader)
+	timestamp := req.Header.Get(droneTimestampHeader)
+	nonce := req.Header.Get(droneNonceHeader)
+	signature := req.Header.Get(droneSignatureHeader)
+	if droneID == "" || timestamp == "" || nonce == "" || signature == "" {
+		return "", fmt.Errorf("missing %s, %s, %s or %s header", droneIDHeader, droneTimestampHeader, droneNonceHeader, droneSignatureHeader)
+	}
+
+	secret, ok := a.secrets[droneID]
+	if !ok {
+		return "", fmt.Errorf("unknown drone '%s'", droneID)
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid timestamp '%s'", timestamp)
+	}
+	now := a.clock.Now()
+	signedAt := time.Unix(seconds, 0)
+	if signedAt.Before(now.Add(-a.window)) || signedAt.After(now.Add(a.window)) {
+		return "", fmt.Errorf("timestamp outside of the %s window", a.window)
+	}
+
+	expected, _ := hex.DecodeString(signRequest(secret, req.Method, req.URL.Path, timestamp, nonce, body))
+	actual, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(expected, actual) {
+		return "", fmt.Errorf("invalid signature of drone '%s'", droneID)
+	}
+
+	if !a.useNonce(droneID, nonce, now) {
+		return "", fmt.Errorf("nonce of drone '%s' already used", droneID)
+	}
+	return droneID, nil
+}
+
+// useNonce records a nonce, returning false when it was seen before. Nonces
+// are forgotten once their timestamps could no longer pass the window.
+func (a *droneAuthenticator) useNonce(droneID string, nonce string, now time.Time) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for oldest := a.expiries.Front(); oldest != nil; oldest = a.expiries.Front() {
+		expiry := oldest.Value.(nonceExpiry)
+		if !now.After(expiry.expiresAt) {
+			break
+		}
+		delete(a.nonces, expiry.key)
+		a.expiries.Remove(oldest)
+	}
+
+	key := droneID + "\n" + nonce
+	if a.nonces[key] {
+		return false
+	}
+	a.nonces[key] = true
+	a.expiries.PushBack(nonceExpiry{key: key, expiresAt: now.Add(2 * a.window)})
+	return true
+}
+
+// authenticatedDrone returns the drone that signed the request, if any.
+func authenticatedDrone(req *http.Request) (string, bool) {
+	droneID, ok := req.Context().Value(authenticatedDroneKey).(string)
+	return droneID, ok
+}
+
+// authorizeCommand rejects commands about another drone than the one that
+// signed the request, and commands about another fleet than the one the
+// request was sent for, by route or claim, whether the command names the
+// fleet or the drone is registered with it. Unauthenticated requests pass
+// when authentication is disabled.
+func authorizeCommand(req *http.Request, command eventCommand, fleets droneFleets) *problem {
+	if droneID, ok := authenticatedDrone(req); ok && droneID != command.droneID() {
+		p := newProblem(problemForbidden, http.StatusForbidden, "Command is about another drone.")
+		p.Detail = fmt.Sprintf("Drone '%s' may not send commands for drone '%s'.", droneID, command.droneID())
+		return &p
+	}
+
+	scope := scopeOf(req)
+	fleet := scope.Fleet
+	fleetCommand, hasFleet := command.(interface{ fleetID() string })
+	if fleet != "" && hasFleet && fleetCommand.fleetID() != "" && fleetCommand.fleetID() != fleet {
+		p := newProblem(problemForbidden, http.StatusForbidden, "Command is about another fleet.")
+		p.Detail = fmt.Sprintf("Requests for fleet '%s' may not send commands for fleet '%s'.", fleet, fleetCommand.fleetID())
+		return &p
+	}
+
+	if fleet == "" {
+		return nil
+	}
+	droneFleet, registered := "", false
+	if fleets != nil {
+		droneFleet, registered = fleets.fleetOf(command.droneID())
+	}
+	if registered && droneFleet != "" && droneFleet != fleet {
+		p := newProblem(problemForbidden, http.StatusForbidden, "Command is about a drone of another fleet.")
+		p.Detail = fmt.Sprintf("Requests for fleet '%s' may not send commands for drone '%s' of fleet '%s'.", fleet, command.droneID(), droneFleet)
+		return &p
+	}
+	return nil
+}
+
+func resolveDroneAuthenticator() *droneAuthenticator {
+	path := os.Getenv("DRONE_SECRETS_FILE")
+	if path == "" {
+		fmt.Printf("No drone secrets configured. Accepting unsigned requests.\n")
+		return nil
+	}
+
+	secrets, err := loadDroneSecrets(path)
+	failOnError(err, "Failed to load drone secrets")
+
+	authenticator := newDroneAuthenticator(secrets, systemClock{})
+	if value, err := time.ParseDuration(os.Getenv("SIGNATURE_WINDOW")); err == nil && value > 0 {
+		authenticator.window = value
+	}
+	fmt.Printf("Authenticating %d drone(s) from '%s'\n", len(secrets), path)
+	return authenticator
+}
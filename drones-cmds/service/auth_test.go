@@ -0,0 +1,149 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/codegangsta/negroni"
+	"github.com/maxsuelmarinho/golang-event-driven-example/drones-cmds/fakes"
+)
+
+var signedAt = time.Date(2019, 4, 4, 12, 0, 0, 0, time.UTC)
+
+func makeAuthenticatedServer(dispatcher queueDispatcher) *negroni.Negroni {
+	server := negroni.New()
+	server.Use(newDroneAuthenticator(map[string]string{"drone1": "secret1", "drone2": "secret2"}, &fakes.FakeClock{Time: signedAt}))
+	server.UseHandler(makeTestServer(dispatcher))
+	return server
+}
+
+func signedRequest(droneID string, secret string, path string, body string, nonce string, at time.Time) *http.Request {
+	request, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+	timestamp := fmt.Sprint(at.Unix())
+	request.Header.Set(droneIDHeader, droneID)
+	request.Header.Set(droneTimestampHeader, timestamp)
+	request.Header.Set(droneNonceHeader, nonce)
+	request.Header.Set(droneSignatureHeader, signRequest([]byte(secret), "POST", path, timestamp, nonce, []byte(body)))
+	return request
+}
+
+func TestSignedRequestIsAccepted(t *testing.T) {
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	server := makeAuthenticatedServer(dispatcher)
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, signedRequest("drone1", "secret1", "/api/cmds/telemetry", `{"drone_id": "drone1", "uptime": 10}`, "n1", signedAt))
+	if recorder.Code != http.StatusCreated || len(dispatcher.Messages) != 1 {
+		t.Errorf("Expected signed request to be accepted, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestUnsignedOrForgedRequestsAreRejected(t *testing.T) {
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	server := makeAuthenticatedServer(dispatcher)
+	body := `{"drone_id": "drone1", "uptime": 10}`
+
+	unsigned, _ := http.NewRequest("POST", "/api/cmds/telemetry", bytes.NewBufferString(body))
+	tampered := signedRequest("drone1", "secret1", "/api/cmds/telemetry", body, "n2", signedAt)
+	tampered.Body = ioutil.NopCloser(bytes.NewBufferString(`{"drone_id": "drone1", "uptime": 99}`))
+
+	for name, request := range map[string]*http.Request{
+		"unsigned":      unsigned,
+		"wrong secret":  signedRequest("drone1", "secret2", "/api/cmds/telemetry", body, "n1", signedAt),
+		"unknown drone": signedRequest("drone9", "secret1", "/api/cmds/telemetry", body, "n1", signedAt),
+		"tampered body": tampered,
+		"stale":         signedRequest("drone1", "secret1", "/api/cmds/telemetry", body, "n3", signedAt.Add(-time.Hour)),
+	} {
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusUnauthorized || recorder.Header().Get("WWW-Authenticate") != signatureScheme {
+			t.Errorf("Expected %s request to be rejected, got %d", name, recorder.Code)
+		}
+	}
+	if len(dispatcher.Messages) != 0 {
+		t.Errorf("Expected no events to be dispatched, got %d", len(dispatcher.Messages))
+	}
+}
+
+func TestReplayedRequestIsRejected(t *testing.T) {
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	server := makeAuthenticatedServer(dispatcher)
+	body := `{"drone_id": "drone1", "uptime": 10}`
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, signedRequest("drone1", "secret1", "/api/cmds/telemetry", body, "n1", signedAt))
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, signedRequest("drone1", "secret1", "/api/cmds/telemetry", body, "n1", signedAt))
+
+	if recorder.Code != http.StatusUnauthorized || len(dispatcher.Messages) != 1 {
+		t.Errorf("Expected replayed request to be rejected, got %d", recorder.Code)
+	}
+}
+
+func TestUsedNoncesAreForgottenOnceExpired(t *testing.T) {
+	authenticator := newDroneAuthenticator(nil, systemClock{})
+	now := signedAt
+	if !authenticator.useNonce("drone1", "n1", now) || !authenticator.useNonce("drone1", "n2", now.Add(time.Minute)) {
+		t.Fatalf("Expected fresh nonces to be accepted")
+	}
+	if authenticator.useNonce("drone1", "n1", now.Add(2*authenticator.window)) {
+		t.Errorf("Expected nonce to be remembered while its timestamp could pass the window")
+	}
+
+	later := now.Add(2*authenticator.window + time.Second)
+	if !authenticator.useNonce("drone1", "n3", later) || len(authenticator.nonces) != 2 || authenticator.expiries.Len() != 2 {
+		t.Errorf("Expected only the expired nonce to be forgotten, got %d nonces", len(authenticator.nonces))
+	}
+	if !authenticator.useNonce("drone1", "n1", later) {
+		t.Errorf("Expected an expired nonce to be accepted again")
+	}
+}
+
+func TestDroneCannotSendCommandsForAnotherDrone(t *testing.T) {
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	server := makeAuthenticatedServer(dispatcher)
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, signedRequest("drone2", "secret2", "/api/cmds/alerts", `{"drone_id": "drone1", "description": "fake"}`, "n1", signedAt))
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected command for another drone to be forbidden, got %d", recorder.Code)
+	}
+
+	batch := `[{"type": "telemetry", "drone_id": "drone2", "uptime": 1}, {"type": "telemetry", "drone_id": "drone1", "uptime": 1}]`
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, signedRequest("drone2", "secret2", "/api/cmds/batch", batch, "n2", signedAt))
+
+	var report batchReport
+	json.Unmarshal(recorder.Body.Bytes(), &report)
+	if recorder.Code != http.StatusMultiStatus || report.Items[1].Status != http.StatusForbidden || len(dispatcher.Messages) != 1 {
+		t.Errorf("Expected batch item for another drone to be forbidden, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestReadOnlyRoutesNeedNoSignature(t *testing.T) {
+	server := makeAuthenticatedServer(fakes.NewFakeQueueDispatcher())
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", openAPIRoute, nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected OpenAPI document to be served without signature, got %d", recorder.Code)
+	}
+}
+
+func TestLoadDroneSecrets(t *testing.T) {
+	file, _ := ioutil.TempFile("", "secrets")
+	defer os.Remove(file.Name())
+	file.WriteString("drone1: secret1\ndrone2: ''\n")
+	file.Close()
+
+	if _, err := loadDroneSecrets(file.Name()); err == nil {
+		t.Errorf("Expected empty secrets to be rejected")
+	}
+}
@@ -0,0 +1,230 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/unrolled/render"
+)
+
+const maxBatchItems = 1000
+
+type batchItemStatus struct {
+	Index    int          `json:"index"`
+	Type     string       `json:"type"`
+	Status   int          `json:"status"`
+	EventID  string       `json:"event_id,omitempty"`
+	Replayed bool         `json:"replayed,omitempty"`
+	Error    string       `json:"error,omitempty"`
+	Errors   []fieldError `json:"errors,omitempty"`
+}
+
+type batchReport struct {
+	Accepted int               `json:"accepted"`
+	Rejected int               `json:"rejected"`
+	Items    []batchItemStatus `json:"items"`
+}
+
+// addBatchHandler accepts a JSON array or an NDJSON stream of commands, each
+// tagged with its "type", and reports the outcome of every item. Items are
+// dispatched in order; a failed item does not stop the following ones. Items
+// with a command_id are dispatched once, however often they are sent.
+func addBatchHandler(formatter *render.Render, store IdempotencyStore, rules *rulesEngine, stamper *timestamper, registry *commandRegistry, dispatchers map[string]queueDispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		items, err := readBatchItems(req.Body)
+		if err != nil {
+			writeProblem(w, req, malformedCommandProblem("Failed to parse batch.", parseErrors(err)...))
+			return
+		}
+
+		if len(items) > maxBatchItems {
+			p := newProblem(problemInvalidCommand, http.StatusRequestEntityTooLarge, fmt.Sprintf("Batch exceeds %d items.", maxBatchItems))
+			writeProblem(w, req, p)
+			return
+		}
+
+		report := batchReport{Items: make([]batchItemStatus, 0, len(items))}
+		unavailable := false
+		for index, item := range items {
+			status := dispatchIdempotentBatchItem(req, store, rules, stamper, registry, dispatchers, index, item)
+			if status.Status == http.StatusCreated {
+				report.Accepted++
+			} else {
+				report.Rejected++
+			}
+			unavailable = unavailable || status.Status == http.StatusServiceUnavailable
+			report.Items = append(report.Items, status)
+		}
+
+		fmt.Printf("Dispatched batch of %d item(s), %d rejected\n", len(items), report.Rejected)
+		if report.Rejected == 0 {
+			formatter.JSON(w, http.StatusCreated, report)
+			return
+		}
+		if unavailable {
+			w.Header().Set("Retry-After", fmt.Sprint(dispatchRetryAfterSeconds))
+		}
+		formatter.JSON(w, http.StatusMultiStatus, report)
+	}
+}
+
+// dispatchIdempotentBatchItem replays the stored status of an item whose
+// command_id was already dispatched by the same sender.
+func dispatchIdempotentBatchItem(req *http.Request, store IdempotencyStore, rules *rulesEngine, stamper *timestamper, registry *commandRegistry, dispatchers map[string]queueDispatcher, index int, item json.RawMessage) batchItemStatus {
+	var header struct {
+		Type      string `json:"type"`
+		CommandID string `json:"command_id"`
+	}
+	json.Unmarshal(item, &header)
+	if header.CommandID == "" {
+		return dispatchBatchItem(req, rules, stamper, registry, dispatchers, index, item)
+	}
+
+	key := principalOf(req) + " " + req.URL.Path + " " + header.Type + " " + header.CommandID
+	requestHash := sha256.Sum256(item)
+	if stored, ok := store.Get(key); ok {
+		status := batchItemStatus{Index: index, Type: header.Type, Status: http.StatusUnprocessableEntity, Error: "Command ID was already used for a different command."}
+		if stored.RequestHash == requestHash {
+			json.Unmarshal(stored.Body, &status)
+			status.Index = index
+			status.Replayed = true
+		}
+		return status
+	}
+
+	status := dispatchBatchItem(req, rules, stamper, registry, dispatchers, index, item)
+	if status.Status == http.StatusCreated {
+		body, _ := json.Marshal(status)
+		store.Put(key, StoredResponse{Status: status.Status, Body: body, RequestHash: requestHash})
+	}
+	return status
+}
+
+func dispatchBatchItem(req *http.Request, rules *rulesEngine, stamper *timestamper, registry *commandRegistry, dispatchers map[string]queueDispatcher, index int, item json.RawMessage) batchItemStatus {
+	var header struct {
+		Type string `json:"type"`
+	}
+	json.Unmarshal(item, &header)
+	status := batchItemStatus{Index: index, Type: header.Type}
+
+	definition, ok := registry.lookup(header.Type)
+	if !ok {
+		status.Status = http.StatusBadRequest
+		status.Error = fmt.Sprintf("Unknown command type '%s'.", header.Type)
+		return status
+	}
+
+	if op, ok := authenticatedOperator(req); ok && !op.allowed(definition.Scopes) {
+		status.Status = http.StatusForbidden
+		status.Error = fmt.Sprintf("Missing scope for %s commands.", header.Type)
+		return status
+	}
+
+	command := definition.NewCommand()
+	p := decodeCommand(item, definition, scopeOf(req).Fleet, command, rules)
+	if p == nil {
+		p = authorizeCommand(req, command, rules.fleets)
+	}
+	if p != nil {
+		status.Status = p.Status
+		status.Error = p.Title
+		status.Errors = p.Errors
+		return status
+	}
+
+	timing := stamper.stamp(command)
+	envelope, err := newCommandEnvelope(req, definition.EventType, definition.SchemaVersion, *timing.ReceivedAt, command.toEvent(timing))
+	if err != nil {
+		status.Status = http.StatusInternalServerError
+		status.Error = "Failed to build event envelope."
+		return status
+	}
+
+	err = dispatchers[definition.Queue].DispatchMessage(envelope)
+	if err != nil {
+		fmt.Printf("Failed to dispatch event %s: %s\n", envelope.EventID, err)
+		status.Status = http.StatusServiceUnavailable
+		status.Error = "Failed to dispatch event, please retry later."
+		return status
+	}
+
+	status.Status = http.StatusCreated
+	status.EventID = envelope.EventID
+	return status
+}
+
+// readBatchItems reads either a JSON array or a stream of newline delimited
+// JSON objects.
+func readBatchItems(body io.Reader) ([]json.RawMessage, error) {
+	reader := bufio.NewReader(body)
+	first, err := peekNonSpace(reader)
+	if err == io.EOF {
+		return nil, fmt.Errorf("empty batch")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(reader)
+	if first == '[' {
+		return readBatchArray(decoder)
+	}
+
+	items := make([]json.RawMessage, 0)
+	for {
+		var item json.RawMessage
+		err = decoder.Decode(&item)
+		if err == io.EOF {
+			return items, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+		if len(items) > maxBatchItems {
+			return items, nil
+		}
+	}
+}
+
+// readBatchArray decodes the items of a JSON array one at a time and stops
+// once there are more than maxBatchItems, leaving the rest unread.
+func readBatchArray(decoder *json.Decoder) ([]json.RawMessage, error) {
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+
+	items := make([]json.RawMessage, 0)
+	for decoder.More() {
+		var item json.RawMessage
+		if err := decoder.Decode(&item); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+		if len(items) > maxBatchItems {
+			return items, nil
+		}
+	}
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func peekNonSpace(reader *bufio.Reader) (byte, error) {
+	for {
+		next, err := reader.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		if !bytes.ContainsAny(next, " \t\r\n") {
+			return next[0], nil
+		}
+		reader.ReadByte()
+	}
+}
@@ -0,0 +1,137 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/maxsuelmarinho/golang-event-driven-example/drones-cmds/fakes"
+)
+
+func submitBatch(t *testing.T, dispatcher queueDispatcher, contentType string, body string) (*httptest.ResponseRecorder, batchReport) {
+	server := makeTestServer(dispatcher)
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/api/cmds/batch", bytes.NewReader([]byte(body)))
+	request.Header.Set("Content-Type", contentType)
+	server.ServeHTTP(recorder, request)
+
+	var report batchReport
+	json.Unmarshal(recorder.Body.Bytes(), &report)
+	return recorder, report
+}
+
+func TestBatchOfValidCommandsIsDispatched(t *testing.T) {
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	recorder, report := submitBatch(t, dispatcher, "application/json", `[
+		{"type":"telemetry","drone_id":"drone1","battery":72,"uptime":6941,"core_temp":21},
+		{"type":"alert","drone_id":"drone1","fault_code":12,"description":"overheating"},
+		{"type":"position","drone_id":"drone1","latitude":31.01,"longitude":72.5,"altitude":3500.12}
+	]`)
+
+	if recorder.Code != http.StatusCreated {
+		t.Errorf("Expected batch to return 201, got %d/%s", recorder.Code, recorder.Body.String())
+	}
+
+	if len(dispatcher.Messages) != 3 || report.Accepted != 3 {
+		t.Errorf("Expected 3 dispatched items, got %d (report %+v)", len(dispatcher.Messages), report)
+	}
+}
+
+func TestNDJSONBatchReportsPartialFailures(t *testing.T) {
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	recorder, report := submitBatch(t, dispatcher, "application/x-ndjson",
+		"{\"type\":\"telemetry\",\"drone_id\":\"drone1\",\"battery\":72,\"uptime\":6941}\n"+
+			"{\"type\":\"telemetry\",\"drone_id\":\"\",\"uptime\":0}\n"+
+			"{\"type\":\"landing\",\"drone_id\":\"drone1\"}\n")
+
+	if recorder.Code != http.StatusMultiStatus {
+		t.Errorf("Expected partially failed batch to return 207, got %d", recorder.Code)
+	}
+
+	if report.Accepted != 1 || report.Rejected != 2 || len(report.Items) != 3 {
+		t.Fatalf("Expected 1 accepted and 2 rejected items, got %+v", report)
+	}
+
+	if report.Items[1].Status != http.StatusBadRequest || report.Items[2].Status != http.StatusBadRequest {
+		t.Errorf("Expected invalid and unknown items to be rejected with 400, got %+v", report.Items)
+	}
+
+	if len(dispatcher.Messages) != 1 {
+		t.Errorf("Expected 1 dispatched item, got %d", len(dispatcher.Messages))
+	}
+}
+
+func TestUnparseableBatchReturnsBadRequest(t *testing.T) {
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	recorder, _ := submitBatch(t, dispatcher, "application/json", "[{\"type\":")
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected unparseable batch to return 400, got %d", recorder.Code)
+	}
+}
+
+func TestBatchWithItemsToRetryIsNotRemembered(t *testing.T) {
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	dispatcher.Err = ErrNotConnected
+	server := makeTestServer(dispatcher)
+	body := `[{"type":"telemetry","drone_id":"drone1","battery":72,"uptime":6941,"core_temp":21}]`
+
+	for _, err := range []error{ErrNotConnected, nil} {
+		dispatcher.Err = err
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", "/api/cmds/batch", bytes.NewReader([]byte(body)))
+		request.Header.Set("Idempotency-Key", "batch-1")
+		server.ServeHTTP(recorder, request)
+		if err == nil && recorder.Code != http.StatusCreated {
+			t.Errorf("Expected retried batch to be dispatched, got %d/%s", recorder.Code, recorder.Body.String())
+		}
+	}
+
+	if len(dispatcher.Messages) != 1 {
+		t.Errorf("Expected retried item to be dispatched, got %d message(s)", len(dispatcher.Messages))
+	}
+}
+
+func TestBatchItemsWithCommandIDAreDispatchedOnce(t *testing.T) {
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	server := makeTestServer(dispatcher)
+	item := `{"type":"alert","command_id":"cmd-1","drone_id":"drone1","fault_code":12,"description":"overheating"}`
+
+	var reports []batchReport
+	for _, body := range []string{"[" + item + "," + item + "]", "[" + item + "]"} {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", "/api/cmds/batch", bytes.NewReader([]byte(body)))
+		server.ServeHTTP(recorder, request)
+		var report batchReport
+		json.Unmarshal(recorder.Body.Bytes(), &report)
+		reports = append(reports, report)
+	}
+
+	if len(dispatcher.Messages) != 1 {
+		t.Errorf("Expected repeated item to be dispatched once, got %d", len(dispatcher.Messages))
+	}
+	replayed := reports[0].Items[1]
+	if !replayed.Replayed || replayed.Status != http.StatusCreated || replayed.EventID != reports[0].Items[0].EventID || replayed.Index != 1 {
+		t.Errorf("Expected repeated item to replay the first outcome, got %+v", replayed)
+	}
+	if !reports[1].Items[0].Replayed {
+		t.Errorf("Expected item repeated in another batch to be replayed, got %+v", reports[1].Items[0])
+	}
+}
+
+func TestOversizedBatchArrayIsRefusedBeforeItIsRead(t *testing.T) {
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	item := `{"type":"telemetry","drone_id":"drone1"},`
+	body := "[" + strings.Repeat(item, maxBatchItems+1) + " this is never read"
+	recorder, _ := submitBatch(t, dispatcher, "application/json", body)
+
+	if recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected oversized batch to return 413, got %d", recorder.Code)
+	}
+	if len(dispatcher.Messages) != 0 {
+		t.Errorf("Expected no dispatched item, got %d", len(dispatcher.Messages))
+	}
+}
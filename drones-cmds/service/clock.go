@@ -0,0 +1,96 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	dronescommon "github.com/maxsuelmarinho/golang-event-driven-example/drones-common"
+)
+
+const defaultClockSkewThreshold = 5 * time.Second
+
+// clock tells the time, so that tests can fix it.
+type clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// observation is embedded in commands to carry the time the drone took the
+// reading.
+type observation struct {
+	ObservedAt *observedTime `json:"observed_at,omitempty"`
+}
+
+func (o observation) observedAt() *time.Time {
+	if o.ObservedAt == nil {
+		return nil
+	}
+	return &o.ObservedAt.Time
+}
+
+// observedTime is a time sent by a drone, either in RFC 3339 with up to
+// nanosecond precision or as Unix milliseconds.
+type observedTime struct {
+	time.Time
+}
+
+func (t *observedTime) UnmarshalJSON(data []byte) error {
+	var millis int64
+	if json.Unmarshal(data, &millis) == nil {
+		t.Time = time.Unix(0, millis*int64(time.Millisecond)).UTC()
+		return nil
+	}
+	return t.Time.UnmarshalJSON(data)
+}
+
+// timestamper stamps events with the service time and flags drone clocks
+// that run ahead of it by more than skewThreshold. Readings from the past
+// are not skewed but were buffered or delayed on their way, so only their
+// ingest delay is reported.
+type timestamper struct {
+	clock         clock
+	skewThreshold time.Duration
+}
+
+func newTimestamper(c clock) *timestamper {
+	return &timestamper{clock: c, skewThreshold: defaultClockSkewThreshold}
+}
+
+func (s *timestamper) stamp(command eventCommand) dronescommon.Timing {
+	receivedAt := s.clock.Now().UTC()
+	timing := dronescommon.Timing{ReceivedAt: &receivedAt}
+
+	observedAt := command.observedAt()
+	if observedAt == nil {
+		return timing
+	}
+
+	observed := observedAt.UTC()
+	skew := observed.Sub(receivedAt)
+	timing.ObservedAt = &observed
+	if skew < 0 {
+		timing.IngestDelayMillis = int64(-skew / time.Millisecond)
+		return timing
+	}
+	timing.ClockSkewMillis = int64(skew / time.Millisecond)
+	timing.ClockSkewed = skew > s.skewThreshold
+	if timing.ClockSkewed {
+		fmt.Printf("Clock of drone %s is skewed by %s\n", command.droneID(), skew)
+	}
+	return timing
+}
+
+func resolveTimestamper() *timestamper {
+	stamper := newTimestamper(systemClock{})
+	if value, err := time.ParseDuration(os.Getenv("CLOCK_SKEW_THRESHOLD")); err == nil && value > 0 {
+		stamper.skewThreshold = value
+	}
+	return stamper
+}
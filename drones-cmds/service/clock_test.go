@@ -0,0 +1,93 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/maxsuelmarinho/golang-event-driven-example/drones-cmds/fakes"
+	dronescommon "github.com/maxsuelmarinho/golang-event-driven-example/drones-common"
+)
+
+var receivedAt = time.Date(2019, 4, 4, 12, 0, 0, 0, time.UTC)
+
+func TestTimestamperFlagsSkewedClocks(t *testing.T) {
+	stamper := newTimestamper(&fakes.FakeClock{Time: receivedAt})
+
+	for _, tc := range []struct {
+		observedAt  time.Time
+		skewMillis  int64
+		skewed      bool
+		delayMillis int64
+	}{
+		{receivedAt.Add(1500 * time.Microsecond), 1, false, 0},
+		{receivedAt.Add(time.Minute), 60000, true, 0},
+		{receivedAt.Add(-4 * time.Second), 0, false, 4000},
+		{receivedAt.Add(-23 * time.Hour), 0, false, 82800000},
+	} {
+		observedAt := tc.observedAt
+		timing := stamper.stamp(&telemetryCommand{observation: observation{ObservedAt: &observedTime{observedAt}}})
+		if timing.ClockSkewMillis != tc.skewMillis || timing.ClockSkewed != tc.skewed || timing.IngestDelayMillis != tc.delayMillis {
+			t.Errorf("Expected observation at %s to be skewed by %dms (flagged: %t) and delayed by %dms, got %+v", observedAt, tc.skewMillis, tc.skewed, tc.delayMillis, timing)
+		}
+		if !timing.ReceivedAt.Equal(receivedAt) || !timing.ObservedAt.Equal(observedAt) {
+			t.Errorf("Expected observed and received times to be kept apart, got %+v", timing)
+		}
+	}
+
+	timing := stamper.stamp(&telemetryCommand{})
+	if timing.ObservedAt != nil || timing.ClockSkewed {
+		t.Errorf("Expected commands without observed_at to carry the received time only, got %+v", timing)
+	}
+}
+
+func TestObservedAtIsKeptWithNanosecondPrecision(t *testing.T) {
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	dispatchers := make(map[string]queueDispatcher)
+	for _, queueName := range defaultCommands.queues() {
+		dispatchers[queueName] = dispatcher
+	}
+	mx := mux.NewRouter()
+	stamper := newTimestamper(&fakes.FakeClock{Time: receivedAt.Add(123456789)})
+	initRoutes(mx, formatter, NewLRUIdempotencyStore(100, time.Minute), newDefaultRulesEngine(), stamper, nil, nil, defaultCommands, dispatchers)
+
+	body := `{"drone_id": "drone1", "latitude": 1, "longitude": 2, "observed_at": "2019-04-04T11:59:59.000000001Z"}`
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/api/cmds/positions", bytes.NewBufferString(body))
+	mx.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected position to be accepted, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	envelope := dispatcher.Messages[0].(dronescommon.EventEnvelope)
+	var event dronescommon.PositionChangedEvent
+	json.Unmarshal(envelope.Data, &event)
+
+	if event.ObservedAt.Nanosecond() != 1 || event.ReceivedAt.Nanosecond() != 123456789 {
+		t.Errorf("Expected nanosecond precision, got observed %s, received %s", event.ObservedAt, event.ReceivedAt)
+	}
+	if event.ReceivedOn != receivedAt.Unix() || !envelope.OccurredAt.Equal(*event.ReceivedAt) {
+		t.Errorf("Expected received_on and the envelope to use the service clock, got %d and %s", event.ReceivedOn, envelope.OccurredAt)
+	}
+	if event.IngestDelayMillis != 1123 || event.ClockSkewMillis != 0 || event.ClockSkewed {
+		t.Errorf("Expected a past reading to be reported as delayed, not skewed, got %+v", event.Timing)
+	}
+}
+
+func TestObservedAtAcceptsUnixMilliseconds(t *testing.T) {
+	var command telemetryCommand
+	if err := json.Unmarshal([]byte(`{"drone_id": "drone1", "observed_at": 1554379199123}`), &command); err != nil {
+		t.Fatalf("Expected epoch milliseconds to be accepted, got %s", err)
+	}
+	if observedAt := command.observedAt(); observedAt == nil || !observedAt.Equal(receivedAt.Add(-877*time.Millisecond)) {
+		t.Errorf("Expected observed_at to be read as Unix milliseconds, got %v", observedAt)
+	}
+
+	if err := json.Unmarshal([]byte(`{"drone_id": "drone1", "observed_at": "yesterday"}`), &command); err == nil {
+		t.Errorf("Expected unreadable observed_at to be rejected")
+	}
+}
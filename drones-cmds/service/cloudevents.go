@@ -0,0 +1,79 @@
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+
+	dronescommon "github.com/maxsuelmarinho/golang-event-driven-example/drones-common"
+)
+
+const (
+	telemetryCommandType = "drones.command.telemetry"
+	alertCommandType     = "drones.command.alert"
+	positionCommandType  = "drones.command.position"
+
+	cloudEventsBinaryMode     = "binary"
+	cloudEventsStructuredMode = "structured"
+
+	cloudEventsHTTPPrefix = "Ce-"
+)
+
+// readCommandPayload returns the command JSON of a request. CloudEvents
+// posted in structured or binary HTTP mode are unwrapped, and their ID is
+// used as correlation ID when the client did not send one.
+func readCommandPayload(req *http.Request, commandType string) ([]byte, error) {
+	payload, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var cloudEvent dronescommon.CloudEvent
+	contentType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	switch {
+	case contentType == dronescommon.CloudEventsContentType:
+		cloudEvent, err = dronescommon.UnmarshalStructured(payload)
+	case req.Header.Get(cloudEventsHTTPPrefix+"Specversion") != "":
+		cloudEvent, err = cloudEventFromHTTP(req.Header, payload)
+	default:
+		return payload, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if cloudEvent.Type != commandType {
+		return nil, fmt.Errorf("expected CloudEvent of type '%s', got '%s'", commandType, cloudEvent.Type)
+	}
+
+	dataContentType, _, _ := mime.ParseMediaType(cloudEvent.DataContentType)
+	if dataContentType != "" && dataContentType != "application/json" {
+		return nil, fmt.Errorf("unsupported CloudEvent datacontenttype '%s'", cloudEvent.DataContentType)
+	}
+
+	if req.Header.Get(correlationIDHeader) == "" {
+		req.Header.Set(correlationIDHeader, cloudEvent.ID)
+	}
+	return cloudEvent.Data, nil
+}
+
+func cloudEventFromHTTP(header http.Header, body []byte) (cloudEvent dronescommon.CloudEvent, err error) {
+	cloudEvent = dronescommon.CloudEvent{
+		DataContentType: header.Get("Content-Type"),
+		Data:            body,
+	}
+	for key, values := range header {
+		if !strings.HasPrefix(key, cloudEventsHTTPPrefix) || len(values) == 0 {
+			continue
+		}
+		name := strings.ToLower(strings.TrimPrefix(key, cloudEventsHTTPPrefix))
+		err = cloudEvent.SetAttribute(name, values[0])
+		if err != nil {
+			return
+		}
+	}
+	err = cloudEvent.Validate()
+	return
+}
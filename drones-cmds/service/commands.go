@@ -0,0 +1,123 @@
+package service
+
+import (
+	"fmt"
+
+	dronescommon "github.com/maxsuelmarinho/golang-event-driven-example/drones-common"
+)
+
+// commandDefinition declares everything needed to accept a command type:
+// the route it is posted to, how it is decoded, validated and mapped onto
+// an event, the queue the event is dispatched to and the scopes operators
+// need to send it. Commands are validated by the rules registered under
+// their name and by Validate, which checks what rules cannot express; a
+// command without rules must have one.
+type commandDefinition struct {
+	Name          string
+	Route         string
+	CommandType   string
+	Queue         string
+	EventType     string
+	SchemaVersion int
+	Scopes        []string
+	NewCommand    func() eventCommand
+	Validate      func(command eventCommand) []fieldError
+}
+
+// commandRegistry keeps command definitions in registration order.
+type commandRegistry struct {
+	definitions []commandDefinition
+	byName      map[string]commandDefinition
+}
+
+var defaultCommands = newCommandRegistry()
+
+func init() {
+	defaultCommands.register(commandDefinition{
+		Name:          "telemetry",
+		Route:         "/api/cmds/telemetry",
+		CommandType:   telemetryCommandType,
+		Queue:         "telemetry",
+		EventType:     dronescommon.TelemetryUpdatedEventType,
+		SchemaVersion: dronescommon.TelemetryUpdatedSchemaVersion,
+		Scopes:        []string{scopeDroneWrite},
+		NewCommand:    func() eventCommand { return &telemetryCommand{} },
+	})
+	defaultCommands.register(commandDefinition{
+		Name:          "alert",
+		Route:         "/api/cmds/alerts",
+		CommandType:   alertCommandType,
+		Queue:         "alerts",
+		EventType:     dronescommon.AlertSignalledEventType,
+		SchemaVersion: dronescommon.AlertSignalledSchemaVersion,
+		Scopes:        []string{scopeAlertsWrite},
+		NewCommand:    func() eventCommand { return &alertCommand{} },
+	})
+	defaultCommands.register(commandDefinition{
+		Name:          "position",
+		Route:         "/api/cmds/positions",
+		CommandType:   positionCommandType,
+		Queue:         "positions",
+		EventType:     dronescommon.PositionChangedEventType,
+		SchemaVersion: dronescommon.PositionChangedSchemaVersion,
+		Scopes:        []string{scopeDroneWrite},
+		NewCommand:    func() eventCommand { return &positionCommand{} },
+	})
+}
+
+func newCommandRegistry() *commandRegistry {
+	return &commandRegistry{byName: make(map[string]commandDefinition)}
+}
+
+func (r *commandRegistry) register(definition commandDefinition) {
+	if _, ok := r.byName[definition.Name]; ok {
+		panic(fmt.Sprintf("command '%s' registered twice", definition.Name))
+	}
+	r.definitions = append(r.definitions, definition)
+	r.byName[definition.Name] = definition
+}
+
+// checkValidated panics when a command has neither rules nor a validator,
+// as it would be accepted unchecked.
+func (r *commandRegistry) checkValidated(rules *rulesEngine) {
+	for _, definition := range r.definitions {
+		if definition.Validate == nil && rules.rulesFor(definition.Name, "") == nil {
+			panic(fmt.Sprintf("command '%s' has neither validation rules nor a validator", definition.Name))
+		}
+	}
+}
+
+func (r *commandRegistry) lookup(name string) (commandDefinition, bool) {
+	definition, ok := r.byName[name]
+	return definition, ok
+}
+
+func (r *commandRegistry) all() []commandDefinition {
+	return r.definitions
+}
+
+// scopes lists the scopes of every command once each.
+func (r *commandRegistry) scopes() []string {
+	scopes := make([]string, 0)
+	for _, definition := range r.definitions {
+		for _, scope := range definition.Scopes {
+			if !containsString(scopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	return scopes
+}
+
+// queues lists the destination queues once each, in registration order.
+func (r *commandRegistry) queues() []string {
+	queues := make([]string, 0, len(r.definitions))
+	seen := make(map[string]bool)
+	for _, definition := range r.definitions {
+		if !seen[definition.Queue] {
+			seen[definition.Queue] = true
+			queues = append(queues, definition.Queue)
+		}
+	}
+	return queues
+}
@@ -0,0 +1,111 @@
+package service
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/codegangsta/negroni"
+	"github.com/gorilla/mux"
+	"github.com/maxsuelmarinho/golang-event-driven-example/drones-cmds/fakes"
+	dronescommon "github.com/maxsuelmarinho/golang-event-driven-example/drones-common"
+)
+
+type landingCommand struct {
+	DroneID string `json:"drone_id"`
+	Pad     string `json:"pad"`
+	observation
+}
+
+func (landing landingCommand) droneID() string {
+	return landing.DroneID
+}
+
+func (landing landingCommand) toEvent(timing dronescommon.Timing) interface{} {
+	return map[string]interface{}{"drone_id": landing.DroneID, "pad": landing.Pad, "received_at": timing.ReceivedAt}
+}
+
+func validateLanding(command eventCommand) []fieldError {
+	if command.(*landingCommand).Pad == "" {
+		return []fieldError{requiredField("pad")}
+	}
+	return nil
+}
+
+func TestRegisteredCommandGetsRouteAndBatchSupport(t *testing.T) {
+	registry := newCommandRegistry()
+	registry.register(commandDefinition{
+		Name:          "landing",
+		Route:         "/api/cmds/landings",
+		CommandType:   "drones.command.landing",
+		Queue:         "landings",
+		EventType:     "drones.landing.requested",
+		SchemaVersion: 1,
+		NewCommand:    func() eventCommand { return &landingCommand{} },
+		Validate:      validateLanding,
+	})
+
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	server := negroni.New()
+	mx := mux.NewRouter()
+	initRoutes(mx, formatter, NewLRUIdempotencyStore(100, time.Minute), newDefaultRulesEngine(), newTimestamper(systemClock{}), nil, nil, registry, map[string]queueDispatcher{"landings": dispatcher})
+	server.UseHandler(mx)
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/api/cmds/landings", bytes.NewBufferString(`{"drone_id": "drone1", "pad": "A"}`))
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusCreated {
+		t.Errorf("Expected registered command to be accepted, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/api/cmds/batch", bytes.NewBufferString(`[{"type": "landing", "drone_id": "drone2", "pad": "B"}]`))
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusCreated {
+		t.Errorf("Expected registered command to be accepted in batches, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	if len(dispatcher.Messages) != 2 {
+		t.Errorf("Expected both landings to be dispatched to the registered queue, got %d", len(dispatcher.Messages))
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/api/cmds/landings", bytes.NewBufferString(`{"drone_id": "drone1"}`))
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected landing without pad to be rejected by its validator, got %d", recorder.Code)
+	}
+}
+
+func TestCommandWithoutValidationIsRejected(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected a command without rules nor validator to panic")
+		}
+	}()
+
+	registry := newCommandRegistry()
+	registry.register(commandDefinition{Name: "landing", Route: "/api/cmds/landings"})
+	initRoutes(mux.NewRouter(), formatter, NewLRUIdempotencyStore(100, time.Minute), newDefaultRulesEngine(), newTimestamper(systemClock{}), nil, nil, registry, nil)
+}
+
+func TestCommandRegistryRejectsDuplicates(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected registering a command twice to panic")
+		}
+	}()
+
+	registry := newCommandRegistry()
+	registry.register(commandDefinition{Name: "landing"})
+	registry.register(commandDefinition{Name: "landing"})
+}
+
+func TestCommandRegistryListsQueuesOnce(t *testing.T) {
+	queues := defaultCommands.queues()
+	if len(queues) != 3 || queues[0] != "telemetry" || queues[1] != "alerts" || queues[2] != "positions" {
+		t.Errorf("Expected the three command queues, got %v", queues)
+	}
+}
@@ -0,0 +1,318 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	dronescommon "github.com/maxsuelmarinho/golang-event-driven-example/drones-common"
+	"github.com/streadway/amqp"
+	"github.com/unrolled/render"
+)
+
+const (
+	deadLettersRoute       = "/api/admin/dead-letters/{queue}"
+	deadLetterRoute        = "/api/admin/dead-letters/{queue}/{event}"
+	deadLetterRequeueRoute = "/api/admin/dead-letters/{queue}/{event}/requeue"
+
+	defaultDeadLetterLimit = 50
+	maxDeadLetterScan      = 10000
+
+	problemUnknownQueue      = problemTypePrefix + "unknown-queue"
+	problemDeadLetterMissing = problemTypePrefix + "dead-letter-not-found"
+	problemBrokerUnavailable = problemTypePrefix + "broker-unavailable"
+)
+
+var errDeadLetterNotFound = errors.New("dead letter not found")
+
+// deadLetter describes a dead-lettered message. Event holds the decoded
+// event when inspecting a single message; Body holds the raw body when it
+// could not be decoded.
+type deadLetter struct {
+	EventID     string      `json:"event_id"`
+	EventType   string      `json:"event_type,omitempty"`
+	TenantID    string      `json:"tenant_id,omitempty"`
+	FleetID     string      `json:"fleet_id,omitempty"`
+	Queue       string      `json:"queue"`
+	Reason      string      `json:"reason,omitempty"`
+	Deaths      int64       `json:"deaths"`
+	DeadAt      *time.Time  `json:"dead_at,omitempty"`
+	Event       interface{} `json:"event,omitempty"`
+	Body        string      `json:"body,omitempty"`
+	DecodeError string      `json:"decode_error,omitempty"`
+}
+
+// deadLetterInspector browses the dead-letter queues of the command queues.
+// RabbitMQ cannot peek at queues, so every operation takes messages on a
+// channel of its own and requeues those it leaves alone.
+type deadLetterInspector struct {
+	channels func() (amqpChannel, error)
+	queues   map[string]bool
+	decoder  *dronescommon.Decoder
+}
+
+// knows tells whether a queue has a dead-letter queue to inspect: one of the
+// command queues, or the per-tenant queue of one.
+func (i *deadLetterInspector) knows(queueName string) bool {
+	if i.queues[queueName] {
+		return true
+	}
+	index := strings.Index(queueName, tenantQueueSeparator)
+	return index > 0 && i.queues[queueName[index+1:]]
+}
+
+func newDeadLetterInspector(channels func() (amqpChannel, error), queueNames []string) *deadLetterInspector {
+	inspector := &deadLetterInspector{channels: channels, queues: make(map[string]bool), decoder: dronescommon.DefaultDecoder}
+	for _, queueName := range queueNames {
+		inspector.queues[queueName] = true
+	}
+	return inspector
+}
+
+// list describes up to limit messages of the dead-letter queue of a queue,
+// oldest first.
+func (i *deadLetterInspector) list(queueName string, limit int) ([]deadLetter, error) {
+	channel, err := i.channels()
+	if err != nil {
+		return nil, err
+	}
+	defer channel.Close()
+
+	letters := make([]deadLetter, 0)
+	for len(letters) < limit {
+		delivery, ok, err := channel.Get(deadLetterQueue(queueName), false)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		letters = append(letters, i.describe(queueName, delivery, false))
+		defer delivery.Nack(false, true)
+	}
+	return letters, nil
+}
+
+// inspect describes one message, decoding its event.
+func (i *deadLetterInspector) inspect(queueName string, eventID string) (deadLetter, error) {
+	var letter deadLetter
+	err := i.find(queueName, eventID, func(channel amqpChannel, delivery amqp.Delivery) error {
+		letter = i.describe(queueName, delivery, true)
+		return delivery.Nack(false, true)
+	})
+	return letter, err
+}
+
+// requeue publishes a message again where it was first published, then
+// drops it from the dead-letter queue. It is only dropped once the broker
+// has confirmed routing the new copy; otherwise it stays dead-lettered.
+func (i *deadLetterInspector) requeue(queueName string, eventID string) (deadLetter, error) {
+	var letter deadLetter
+	err := i.find(queueName, eventID, func(channel amqpChannel, delivery amqp.Delivery) error {
+		letter = i.describe(queueName, delivery, false)
+		exchange, key := deadLetterOrigin(queueName, delivery)
+		err := republish(channel, exchange, key, delivery)
+		if err != nil {
+			delivery.Nack(false, true)
+			return err
+		}
+		fmt.Printf("Requeued dead letter %s to exchange '%s' with key '%s'\n", eventID, exchange, key)
+		return delivery.Ack(false)
+	})
+	return letter, err
+}
+
+// discard drops a message from the dead-letter queue.
+func (i *deadLetterInspector) discard(queueName string, eventID string) (deadLetter, error) {
+	var letter deadLetter
+	err := i.find(queueName, eventID, func(channel amqpChannel, delivery amqp.Delivery) error {
+		letter = i.describe(queueName, delivery, false)
+		fmt.Printf("Discarded dead letter %s of queue '%s'\n", eventID, queueName)
+		return delivery.Ack(false)
+	})
+	return letter, err
+}
+
+// find takes messages from the dead-letter queue of a queue until the one
+// with the event ID, hands it to settle, and requeues the others.
+func (i *deadLetterInspector) find(queueName string, eventID string, settle func(amqpChannel, amqp.Delivery) error) error {
+	channel, err := i.channels()
+	if err != nil {
+		return err
+	}
+	defer channel.Close()
+
+	for scanned := 0; scanned < maxDeadLetterScan; scanned++ {
+		delivery, ok, err := channel.Get(deadLetterQueue(queueName), false)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		if delivery.MessageId == eventID {
+			return settle(channel, delivery)
+		}
+		defer delivery.Nack(false, true)
+	}
+	return errDeadLetterNotFound
+}
+
+func (i *deadLetterInspector) describe(queueName string, delivery amqp.Delivery, decode bool) deadLetter {
+	letter := deadLetter{EventID: delivery.MessageId, Queue: queueName}
+	if deaths, ok := delivery.Headers["x-death"].([]interface{}); ok && len(deaths) > 0 {
+		if death, ok := deaths[0].(amqp.Table); ok {
+			letter.Reason, _ = death["reason"].(string)
+			letter.Deaths, _ = death["count"].(int64)
+			if deadAt, ok := death["time"].(time.Time); ok {
+				letter.DeadAt = &deadAt
+			}
+		}
+	}
+
+	envelope, err := dronescommon.EnvelopeFromDelivery(delivery)
+	if err == nil {
+		letter.EventID = envelope.EventID
+		letter.EventType = envelope.EventType
+		letter.TenantID = envelope.TenantID
+		letter.FleetID = envelope.FleetID
+	}
+	if !decode {
+		return letter
+	}
+
+	if err == nil {
+		letter.Event, err = i.decoder.Decode(envelope.EventType, envelope.SchemaVersion, envelope.Data)
+	}
+	if err != nil {
+		letter.DecodeError = err.Error()
+		letter.Body = string(delivery.Body)
+	}
+	return letter
+}
+
+// deadLetterOrigin returns the exchange and routing key a message was
+// published with, as recorded by the broker when dead-lettering it.
+func deadLetterOrigin(queueName string, delivery amqp.Delivery) (string, string) {
+	deaths, _ := delivery.Headers["x-death"].([]interface{})
+	if len(deaths) == 0 {
+		return "", queueName
+	}
+	death, _ := deaths[len(deaths)-1].(amqp.Table)
+	exchange, _ := death["exchange"].(string)
+	keys, _ := death["routing-keys"].([]interface{})
+	if len(keys) == 0 {
+		return "", queueName
+	}
+	key, _ := keys[0].(string)
+	return exchange, key
+}
+
+// republish publishes a message as mandatory on a channel in confirm mode,
+// waiting for the broker to confirm it like a dispatcher does.
+func republish(channel amqpChannel, exchange string, key string, delivery amqp.Delivery) error {
+	confirmed := newDetachedAMQPDispatcher(key, true)
+	err := confirmed.attachChannel(channel)
+	if err != nil {
+		return err
+	}
+	err = channel.Publish(exchange, key, true, false, republishing(delivery))
+	if err != nil {
+		return err
+	}
+	return confirmed.waitForConfirmation(1)
+}
+
+func republishing(delivery amqp.Delivery) amqp.Publishing {
+	return amqp.Publishing{
+		Headers:         delivery.Headers,
+		ContentType:     delivery.ContentType,
+		ContentEncoding: delivery.ContentEncoding,
+		DeliveryMode:    delivery.DeliveryMode,
+		Priority:        delivery.Priority,
+		CorrelationId:   delivery.CorrelationId,
+		MessageId:       delivery.MessageId,
+		Timestamp:       delivery.Timestamp,
+		Type:            delivery.Type,
+		AppId:           delivery.AppId,
+		Body:            delivery.Body,
+	}
+}
+
+// initDeadLetterRoutes registers the admin API of the dead-letter queues.
+// Without an inspector, as with the in-memory fake broker, every route
+// reports the broker as unavailable. Without operator authentication
+// anyone could read the dead-lettered events, so it is not served at all.
+func initDeadLetterRoutes(mx *mux.Router, formatter *render.Render, operators *jwtAuthenticator, inspector *deadLetterInspector) {
+	if operators == nil {
+		fmt.Printf("No operator authentication configured. Not serving the dead-letter queues.\n")
+		return
+	}
+
+	admin := []string{scopeFleetAdmin}
+	mx.HandleFunc(deadLettersRoute, operators.require(admin, deadLetterHandler(formatter, inspector, func(req *http.Request, queueName string) (interface{}, error) {
+		limit, err := strconv.Atoi(req.URL.Query().Get("limit"))
+		if err != nil || limit <= 0 {
+			limit = defaultDeadLetterLimit
+		}
+		if limit > maxDeadLetterScan {
+			limit = maxDeadLetterScan
+		}
+		return inspector.list(queueName, limit)
+	}))).Methods("GET")
+	mx.HandleFunc(deadLetterRoute, operators.require(admin, deadLetterHandler(formatter, inspector, func(req *http.Request, queueName string) (interface{}, error) {
+		return inspector.inspect(queueName, mux.Vars(req)["event"])
+	}))).Methods("GET")
+	mx.HandleFunc(deadLetterRequeueRoute, operators.require(admin, deadLetterHandler(formatter, inspector, func(req *http.Request, queueName string) (interface{}, error) {
+		return inspector.requeue(queueName, mux.Vars(req)["event"])
+	}))).Methods("POST")
+	mx.HandleFunc(deadLetterRoute, operators.require(admin, deadLetterHandler(formatter, inspector, func(req *http.Request, queueName string) (interface{}, error) {
+		return inspector.discard(queueName, mux.Vars(req)["event"])
+	}))).Methods("DELETE")
+}
+
+func deadLetterHandler(formatter *render.Render, inspector *deadLetterInspector, operation func(req *http.Request, queueName string) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if rejectDrones(w, req) {
+			return
+		}
+		if inspector == nil {
+			writeProblem(w, req, newProblem(problemBrokerUnavailable, http.StatusServiceUnavailable, "No broker to inspect."))
+			return
+		}
+
+		queueName := mux.Vars(req)["queue"]
+		if op, ok := authenticatedOperator(req); ok && op.Tenant != "" && !strings.HasPrefix(queueName, op.Tenant+tenantQueueSeparator) {
+			p := newProblem(problemForbidden, http.StatusForbidden, "Queue of another tenant.")
+			p.Detail = fmt.Sprintf("Operator '%s' may only inspect the queues of tenant '%s'.", op.Subject, op.Tenant)
+			writeProblem(w, req, p)
+			return
+		}
+		if !inspector.knows(queueName) {
+			p := newProblem(problemUnknownQueue, http.StatusNotFound, "Unknown queue.")
+			p.Detail = fmt.Sprintf("Queue '%s' has no dead-letter queue.", queueName)
+			writeProblem(w, req, p)
+			return
+		}
+
+		result, err := operation(req, queueName)
+		if err == errDeadLetterNotFound {
+			p := newProblem(problemDeadLetterMissing, http.StatusNotFound, "Dead letter not found.")
+			p.Detail = fmt.Sprintf("No message %s in '%s'.", mux.Vars(req)["event"], deadLetterQueue(queueName))
+			writeProblem(w, req, p)
+			return
+		}
+		if err != nil {
+			fmt.Printf("Failed to access dead letters of queue '%s': %s\n", queueName, err)
+			p := newProblem(problemBrokerUnavailable, http.StatusServiceUnavailable, "Failed to access dead letters.")
+			p.Detail = err.Error()
+			writeProblem(w, req, p)
+			return
+		}
+		formatter.JSON(w, http.StatusOK, result)
+	}
+}
@@ -0,0 +1,212 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/maxsuelmarinho/golang-event-driven-example/drones-cmds/fakes"
+	dronescommon "github.com/maxsuelmarinho/golang-event-driven-example/drones-common"
+	"github.com/streadway/amqp"
+)
+
+func deadLetterDelivery(t *testing.T, droneID string, exchange string, key string) amqp.Delivery {
+	envelope, _ := dronescommon.NewEventEnvelope(dronescommon.TelemetryUpdatedEventType, 1, eventSource, dronescommon.TelemetryUpdatedEvent{DroneID: droneID})
+	publishing, err := newPublishing(envelope, false, nil)
+	if err != nil {
+		t.Fatalf("Failed to build publishing: %s", err)
+	}
+	publishing.Headers["x-death"] = []interface{}{amqp.Table{
+		"reason":       "rejected",
+		"count":        int64(1),
+		"queue":        "telemetry",
+		"time":         receivedAt,
+		"exchange":     exchange,
+		"routing-keys": []interface{}{key},
+	}}
+	return amqp.Delivery{
+		Headers:     publishing.Headers,
+		ContentType: publishing.ContentType,
+		MessageId:   publishing.MessageId,
+		Type:        publishing.Type,
+		Timestamp:   publishing.Timestamp,
+		AppId:       publishing.AppId,
+		Body:        publishing.Body,
+	}
+}
+
+func makeDeadLetterServer(channel *fakes.FakePublishChannel) http.Handler {
+	inspector := newDeadLetterInspector(func() (amqpChannel, error) { return channel, nil }, defaultCommands.queues())
+	mx := mux.NewRouter()
+	initDeadLetterRoutes(mx, formatter, newJWTAuthenticator(nil, systemClock{}), inspector)
+	return asAdmin(mx)
+}
+
+func TestListAndInspectDeadLetters(t *testing.T) {
+	channel := fakes.NewFakePublishChannel()
+	first := deadLetterDelivery(t, "drone1", "", "telemetry")
+	channel.Queued = map[string][]amqp.Delivery{"telemetry.dlq": {first, deadLetterDelivery(t, "drone2", "", "telemetry")}}
+	server := makeDeadLetterServer(channel)
+
+	recorder := sendRequest(server, "GET", "/api/admin/dead-letters/telemetry?limit=1", "")
+	var letters []deadLetter
+	json.Unmarshal(recorder.Body.Bytes(), &letters)
+	if recorder.Code != http.StatusOK || len(letters) != 1 || letters[0].EventID != first.MessageId || letters[0].Reason != "rejected" || !letters[0].DeadAt.Equal(receivedAt) {
+		t.Fatalf("Expected first dead letter to be listed, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if len(channel.Settled.Nacked) != 1 || len(channel.Settled.Acked) != 0 {
+		t.Errorf("Expected listed message to be requeued, got %v and %v", channel.Settled.Acked, channel.Settled.Nacked)
+	}
+
+	channel.Queued["telemetry.dlq"] = []amqp.Delivery{first}
+	recorder = sendRequest(server, "GET", "/api/admin/dead-letters/telemetry/"+first.MessageId, "")
+	var letter struct {
+		Event dronescommon.TelemetryUpdatedEvent `json:"event"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &letter)
+	if recorder.Code != http.StatusOK || letter.Event.DroneID != "drone1" {
+		t.Errorf("Expected decoded event of the dead letter, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestRequeueAndDiscardDeadLetters(t *testing.T) {
+	channel := fakes.NewFakePublishChannel()
+	routed := deadLetterDelivery(t, "drone1", "drones.events", "telemetry.crop-sprayers.drone1")
+	other := deadLetterDelivery(t, "drone2", "", "telemetry")
+	channel.Queued = map[string][]amqp.Delivery{"telemetry.dlq": {other, routed}}
+	server := makeDeadLetterServer(channel)
+
+	if recorder := sendRequest(server, "POST", "/api/admin/dead-letters/telemetry/"+routed.MessageId+"/requeue", ""); recorder.Code != http.StatusOK {
+		t.Fatalf("Expected dead letter to be requeued, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if len(channel.Published) != 1 || channel.Exchanges[0] != "drones.events" || channel.RoutingKeys[0] != "telemetry.crop-sprayers.drone1" || channel.Published[0].MessageId != routed.MessageId {
+		t.Errorf("Expected message to be published where it was first published, got %v with %v", channel.Exchanges, channel.RoutingKeys)
+	}
+	if len(channel.Settled.Acked) != 1 || channel.Settled.Acked[0] != 2 || len(channel.Settled.Nacked) != 1 {
+		t.Errorf("Expected requeued message to be acked and the other one requeued, got %v and %v", channel.Settled.Acked, channel.Settled.Nacked)
+	}
+
+	channel.Queued["telemetry.dlq"] = []amqp.Delivery{other}
+	if recorder := sendRequest(server, "DELETE", "/api/admin/dead-letters/telemetry/"+other.MessageId, ""); recorder.Code != http.StatusOK || len(channel.Published) != 1 {
+		t.Errorf("Expected dead letter to be discarded, got %d", recorder.Code)
+	}
+	if recorder := sendRequest(server, "DELETE", "/api/admin/dead-letters/telemetry/"+other.MessageId, ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected missing dead letter to be reported, got %d", recorder.Code)
+	}
+	if recorder := sendRequest(server, "GET", "/api/admin/dead-letters/drone-registrations", ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected queue without dead letters to be rejected, got %d", recorder.Code)
+	}
+}
+
+func TestUnconfirmedRequeueKeepsDeadLetter(t *testing.T) {
+	for name, refuse := range map[string]func(*fakes.FakePublishChannel){
+		"nacked":   func(channel *fakes.FakePublishChannel) { channel.Nack = true },
+		"returned": func(channel *fakes.FakePublishChannel) { channel.Return = &amqp.Return{ReplyCode: 312, ReplyText: "NO_ROUTE"} },
+	} {
+		channel := fakes.NewFakePublishChannel()
+		refuse(channel)
+		letter := deadLetterDelivery(t, "drone1", "drones.events", "telemetry.crop-sprayers.drone1")
+		channel.Queued = map[string][]amqp.Delivery{"telemetry.dlq": {letter}}
+		server := makeDeadLetterServer(channel)
+
+		if recorder := sendRequest(server, "POST", "/api/admin/dead-letters/telemetry/"+letter.MessageId+"/requeue", ""); recorder.Code != http.StatusServiceUnavailable {
+			t.Errorf("Expected %s requeue to fail, got %d: %s", name, recorder.Code, recorder.Body.String())
+		}
+		if len(channel.Settled.Acked) != 0 || len(channel.Settled.Nacked) != 1 {
+			t.Errorf("Expected %s message to stay dead-lettered, got %v and %v", name, channel.Settled.Acked, channel.Settled.Nacked)
+		}
+	}
+}
+
+func TestDeadLetterRoutesWithoutBroker(t *testing.T) {
+	mx := mux.NewRouter()
+	initDeadLetterRoutes(mx, formatter, newJWTAuthenticator(nil, systemClock{}), nil)
+	if recorder := sendRequest(asAdmin(mx), "GET", "/api/admin/dead-letters/telemetry", ""); recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected unavailable broker to be reported, got %d", recorder.Code)
+	}
+}
+
+func TestDeadLetterTopology(t *testing.T) {
+	topology := (*amqpTopology)(nil).withDeadLetters([]string{"telemetry", "alerts"}, nil)
+	if err := topology.check(); err != nil {
+		t.Fatalf("Expected valid topology, got %s", err)
+	}
+
+	dialer := &fakeDialer{}
+	manager := newTestConnectionManager(dialer)
+	manager.topology = topology
+	defer manager.Close()
+	manager.Dispatcher("telemetry")
+	if err := manager.Start(); err != nil {
+		t.Fatalf("Expected connection to succeed, got %s", err)
+	}
+
+	channel := dialer.connections[0].channels[0]
+	if len(channel.DeclaredExchanges) != 2 || channel.DeclaredExchanges[1] != "telemetry.dlx fanout" {
+		t.Errorf("Expected dead-letter exchanges to be declared, got %v", channel.DeclaredExchanges)
+	}
+	for index, queueName := range channel.Declared {
+		if queueName == "telemetry" && channel.DeclaredArgs[index]["x-dead-letter-exchange"] != "telemetry.dlx" {
+			t.Errorf("Expected telemetry to dead-letter to its exchange, got %v", channel.DeclaredArgs[index])
+		}
+	}
+	if len(channel.Bindings) != 2 || channel.Bindings[1] != "telemetry.dlq telemetry.dlx " {
+		t.Errorf("Expected dead-letter queues to be bound, got %v", channel.Bindings)
+	}
+	if len(channel.Declared) != 4 {
+		t.Errorf("Expected both queues and their dead-letter queues to be declared once, got %v", channel.Declared)
+	}
+}
+
+func TestTenantQueuesDeadLetterApart(t *testing.T) {
+	topology := (*amqpTopology)(nil).withDeadLetters([]string{"telemetry"}, []string{"telemetry"})
+	if exchange := topology.queue("acme.telemetry").DeadLetterExchange; exchange != "acme.telemetry.dlx" {
+		t.Errorf("Expected tenant queue to dead-letter to its own exchange, got '%s'", exchange)
+	}
+	if topology.tenantDeadLetters("telemetry") != nil || (*amqpTopology)(nil).withDeadLetters([]string{"alerts"}, nil).tenantDeadLetters("acme.telemetry") != nil {
+		t.Errorf("Expected only tenant queues of dead-lettered queues to get dead-letter queues")
+	}
+
+	dialer := &fakeDialer{}
+	manager := newTestConnectionManager(dialer)
+	manager.topology = topology
+	defer manager.Close()
+	if err := manager.Start(); err != nil {
+		t.Fatalf("Expected connection to succeed, got %s", err)
+	}
+	manager.Dispatcher("acme.telemetry")
+
+	channel := dialer.connections[0].channels[1]
+	if len(channel.DeclaredExchanges) != 1 || channel.DeclaredExchanges[0] != "acme.telemetry.dlx headers" {
+		t.Errorf("Expected the dead-letter exchange of the tenant to be declared, got %v", channel.DeclaredExchanges)
+	}
+	if len(channel.Declared) != 3 || channel.Declared[0] != "acme.telemetry.archive" || channel.Declared[1] != "acme.telemetry.dlq" || channel.Declared[2] != "acme.telemetry" {
+		t.Errorf("Expected the archive and dead-letter queue of the tenant before its queue, got %v", channel.Declared)
+	}
+	if len(channel.Bindings) != 4 || !strings.HasPrefix(channel.Bindings[0], "acme.telemetry.archive acme.telemetry.dlx") {
+		t.Errorf("Expected tenant dead-letter queues to be bound to the exchange of the tenant, got %v", channel.Bindings)
+	}
+}
+
+func TestTenantOperatorsInspectTheirDeadLettersOnly(t *testing.T) {
+	channel := fakes.NewFakePublishChannel()
+	channel.Queued = map[string][]amqp.Delivery{"acme.telemetry.dlq": {deadLetterDelivery(t, "drone1", "", "acme.telemetry")}}
+	inspector := newDeadLetterInspector(func() (amqpChannel, error) { return channel, nil }, defaultCommands.queues())
+	mx := mux.NewRouter()
+	initDeadLetterRoutes(mx, formatter, newJWTAuthenticator(nil, systemClock{}), inspector)
+	server := asOperator(mx, &operator{Subject: "ground-control", Tenant: "acme", permissions: map[string]bool{scopeFleetAdmin: true}})
+
+	var letters []deadLetter
+	recorder := sendRequest(server, "GET", "/api/admin/dead-letters/acme.telemetry", "")
+	json.Unmarshal(recorder.Body.Bytes(), &letters)
+	if recorder.Code != http.StatusOK || len(letters) != 1 {
+		t.Errorf("Expected dead letters of the tenant to be listed, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	for _, queueName := range []string{"telemetry", "initech.telemetry"} {
+		if recorder := sendRequest(server, "GET", "/api/admin/dead-letters/"+queueName, ""); recorder.Code != http.StatusForbidden {
+			t.Errorf("Expected dead letters of '%s' to be kept from another tenant, got %d", queueName, recorder.Code)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package service
+
+import (
+	"net/http"
+	"strconv"
+)
+
+const dispatchRetryAfterSeconds = 5
+
+func dispatchFailureProblem(err error) problem {
+	p := newProblem(problemDispatchFailed, http.StatusServiceUnavailable, "Failed to dispatch event, please retry later.")
+	p.RetryAfter = dispatchRetryAfterSeconds
+	return p
+}
+
+func renderDispatchFailure(w http.ResponseWriter, req *http.Request, err error) {
+	w.Header().Set("Retry-After", strconv.Itoa(dispatchRetryAfterSeconds))
+	writeProblem(w, req, dispatchFailureProblem(err))
+}
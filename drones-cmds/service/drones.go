@@ -0,0 +1,453 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	dronescommon "github.com/maxsuelmarinho/golang-event-driven-example/drones-common"
+	"github.com/unrolled/render"
+)
+
+const (
+	droneActive         = "active"
+	droneDecommissioned = "decommissioned"
+
+	droneRegistrationsQueue = "drone-registrations"
+	droneDecommissionsQueue = "drone-decommissions"
+
+	dronesRoute            = "/api/drones"
+	droneRoute             = "/api/drones/{drone}"
+	droneDecommissionRoute = "/api/drones/{drone}/decommission"
+
+	codeUnregisteredDrone      = "unregistered_drone"
+	problemDroneNotFound       = problemTypePrefix + "drone-not-found"
+	problemDroneDecommissioned = problemTypePrefix + "drone-decommissioned"
+)
+
+// droneRecord is what the registry knows about a drone.
+type droneRecord struct {
+	DroneID          string     `json:"drone_id"`
+	Model            string     `json:"model"`
+	Owner            string     `json:"owner"`
+	FleetID          string     `json:"fleet_id,omitempty"`
+	TenantID         string     `json:"tenant_id,omitempty"`
+	Status           string     `json:"status"`
+	RegisteredAt     time.Time  `json:"registered_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+	DecommissionedAt *time.Time `json:"decommissioned_at,omitempty"`
+}
+
+type registerDroneCommand struct {
+	DroneID string `json:"drone_id"`
+	Model   string `json:"model"`
+	Owner   string `json:"owner"`
+	FleetID string `json:"fleet_id,omitempty"`
+}
+
+type decommissionDroneCommand struct {
+	Reason string `json:"reason"`
+}
+
+// droneDirectory tells whether a drone may send commands.
+type droneDirectory interface {
+	active(droneID string) bool
+}
+
+// droneFleets tells the fleet a registered drone belongs to.
+type droneFleets interface {
+	fleetOf(droneID string) (string, bool)
+}
+
+// droneRegistry keeps the registered drones in memory, saving them to a
+// JSON file after every change when it has a path.
+type droneRegistry struct {
+	path  string
+	clock clock
+
+	// changes serializes registry changes from the check of the current
+	// record to the put of the new one, so a change emits its event once.
+	changes sync.Mutex
+
+	mutex  sync.RWMutex
+	drones map[string]droneRecord
+}
+
+func newDroneRegistry(c clock) *droneRegistry {
+	return &droneRegistry{clock: c, drones: make(map[string]droneRecord)}
+}
+
+// loadDroneRegistry reads the drones saved at path, if any.
+func loadDroneRegistry(path string, c clock) (*droneRegistry, error) {
+	registry := newDroneRegistry(c)
+	registry.path = path
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return registry, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]droneRecord, 0)
+	err = json.Unmarshal(data, &records)
+	if err != nil {
+		return nil, fmt.Errorf("invalid drone registry '%s': %s", path, err)
+	}
+	for _, record := range records {
+		registry.drones[record.DroneID] = record
+	}
+	return registry, nil
+}
+
+func (r *droneRegistry) get(droneID string) (droneRecord, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	record, ok := r.drones[droneID]
+	return record, ok
+}
+
+// fleetOf returns the fleet a drone was registered with, if it is registered.
+func (r *droneRegistry) fleetOf(droneID string) (string, bool) {
+	record, ok := r.get(droneID)
+	return record.FleetID, ok
+}
+
+func (r *droneRegistry) active(droneID string) bool {
+	record, ok := r.get(droneID)
+	return ok && record.Status == droneActive
+}
+
+// put stores a record, restoring the previous one if it can't be saved.
+func (r *droneRegistry) put(record droneRecord) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	previous, existed := r.drones[record.DroneID]
+	r.drones[record.DroneID] = record
+	err := r.save()
+	if err != nil {
+		if existed {
+			r.drones[record.DroneID] = previous
+		} else {
+			delete(r.drones, record.DroneID)
+		}
+	}
+	return err
+}
+
+func (r *droneRegistry) save() error {
+	if r.path == "" {
+		return nil
+	}
+
+	records := make([]droneRecord, 0, len(r.drones))
+	for _, record := range r.drones {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].DroneID < records[j].DroneID })
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp := r.path + ".tmp"
+	err = ioutil.WriteFile(temp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp, r.path)
+}
+
+// initDroneRoutes registers the admin API of the drone registry. Without
+// operator authentication anyone could read and change it, so it is not
+// served at all. Operators with a tenant or fleet claim only see and manage
+// the drones of their tenant or fleet.
+func initDroneRoutes(mx *mux.Router, formatter *render.Render, operators *jwtAuthenticator, tenants *tenantDirectory, drones *droneRegistry, dispatchers map[string]queueDispatcher) {
+	if operators == nil {
+		fmt.Printf("No operator authentication configured. Not serving the drone registry.\n")
+		return
+	}
+
+	admin := []string{scopeFleetAdmin}
+	mx.HandleFunc(dronesRoute, operators.require(admin, registerDroneHandler(formatter, tenants, drones, dispatchers[droneRegistrationsQueue]))).Methods("POST")
+	mx.HandleFunc(droneRoute, operators.require(admin, updateDroneHandler(formatter, tenants, drones, dispatchers[droneRegistrationsQueue]))).Methods("PUT")
+	mx.HandleFunc(droneRoute, operators.require(admin, getDroneHandler(formatter, drones))).Methods("GET")
+	mx.HandleFunc(droneDecommissionRoute, operators.require(admin, decommissionDroneHandler(formatter, drones, dispatchers[droneDecommissionsQueue]))).Methods("POST")
+}
+
+func registerDroneHandler(formatter *render.Render, tenants *tenantDirectory, drones *droneRegistry, dispatcher queueDispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var command registerDroneCommand
+		if rejectDrones(w, req) || !readDroneCommand(w, req, &command) || !operatorFleet(w, req, tenants, &command) {
+			return
+		}
+
+		drones.changes.Lock()
+		defer drones.changes.Unlock()
+		op, _ := authenticatedOperator(req)
+		if record, ok := drones.get(command.DroneID); ok && (record.Status == droneActive || !op.manages(record)) {
+			p := newProblem(problemConflict, http.StatusConflict, "Drone already registered.")
+			if op.manages(record) {
+				p.Detail = fmt.Sprintf("Drone '%s' is registered since %s.", command.DroneID, record.RegisteredAt.Format(time.RFC3339))
+			}
+			writeProblem(w, req, p)
+			return
+		}
+
+		now := drones.clock.Now().UTC()
+		record := droneRecord{
+			DroneID:      command.DroneID,
+			Model:        command.Model,
+			Owner:        command.Owner,
+			FleetID:      command.FleetID,
+			TenantID:     droneTenant(tenants, command.FleetID, op.tenant()),
+			Status:       droneActive,
+			RegisteredAt: now,
+			UpdatedAt:    now,
+		}
+		saveDrone(formatter, w, req, drones, dispatcher, record, http.StatusCreated, dronescommon.DroneRegisteredEventType, dronescommon.DroneRegisteredSchemaVersion, registeredEvent(record))
+	}
+}
+
+func updateDroneHandler(formatter *render.Render, tenants *tenantDirectory, drones *droneRegistry, dispatcher queueDispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if rejectDrones(w, req) {
+			return
+		}
+		drones.changes.Lock()
+		defer drones.changes.Unlock()
+		record, ok := activeDrone(w, req, drones)
+		if !ok {
+			return
+		}
+
+		var command registerDroneCommand
+		if !readDroneCommand(w, req, &command) || !operatorFleet(w, req, tenants, &command) {
+			return
+		}
+		if command.DroneID != record.DroneID {
+			writeProblem(w, req, invalidCommandProblem("drone", []fieldError{{Field: "drone_id", Code: codeInvalidValue, Message: "drone_id must match the drone of the URL"}}))
+			return
+		}
+
+		record.Model = command.Model
+		record.Owner = command.Owner
+		record.FleetID = command.FleetID
+		record.TenantID = droneTenant(tenants, command.FleetID, record.TenantID)
+		record.UpdatedAt = drones.clock.Now().UTC()
+		saveDrone(formatter, w, req, drones, dispatcher, record, http.StatusOK, dronescommon.DroneRegisteredEventType, dronescommon.DroneRegisteredSchemaVersion, registeredEvent(record))
+	}
+}
+
+func decommissionDroneHandler(formatter *render.Render, drones *droneRegistry, dispatcher queueDispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if rejectDrones(w, req) {
+			return
+		}
+		drones.changes.Lock()
+		defer drones.changes.Unlock()
+		record, ok := activeDrone(w, req, drones)
+		if !ok {
+			return
+		}
+
+		var command decommissionDroneCommand
+		if req.ContentLength != 0 {
+			payload, _ := ioutil.ReadAll(req.Body)
+			if len(payload) > 0 && json.Unmarshal(payload, &command) != nil {
+				writeProblem(w, req, malformedCommandProblem("Failed to parse decommission command."))
+				return
+			}
+		}
+
+		now := drones.clock.Now().UTC()
+		record.Status = droneDecommissioned
+		record.UpdatedAt = now
+		record.DecommissionedAt = &now
+		event := dronescommon.DroneDecommissionedEvent{DroneID: record.DroneID, Reason: command.Reason, ReceivedOn: now.Unix()}
+		saveDrone(formatter, w, req, drones, dispatcher, record, http.StatusOK, dronescommon.DroneDecommissionedEventType, dronescommon.DroneDecommissionedSchemaVersion, event)
+	}
+}
+
+func getDroneHandler(formatter *render.Render, drones *droneRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		record, ok := operatorDrone(w, req, drones)
+		if !ok {
+			return
+		}
+		formatter.JSON(w, http.StatusOK, record)
+	}
+}
+
+// operatorDrone returns the drone of the URL, reporting the drones of other
+// tenants and fleets than the operator's as not found.
+func operatorDrone(w http.ResponseWriter, req *http.Request, drones *droneRegistry) (droneRecord, bool) {
+	droneID := mux.Vars(req)["drone"]
+	record, ok := drones.get(droneID)
+	if op, _ := authenticatedOperator(req); !ok || !op.manages(record) {
+		writeProblem(w, req, droneNotFoundProblem(droneID))
+		return record, false
+	}
+	return record, true
+}
+
+// operatorFleet puts drones of operators with a fleet claim in their fleet
+// and refuses fleets that are not the operator's or not of their tenant.
+// Without a tenant directory, nothing tells the fleets of a tenant, so
+// operators of a tenant but no fleet may only register drones without one.
+func operatorFleet(w http.ResponseWriter, req *http.Request, tenants *tenantDirectory, command *registerDroneCommand) bool {
+	op, _ := authenticatedOperator(req)
+	if op == nil {
+		return true
+	}
+	if command.FleetID == "" {
+		command.FleetID = op.Fleet
+	}
+	switch {
+	case command.FleetID == "":
+		return true
+	case op.Fleet != "":
+		if command.FleetID == op.Fleet {
+			return true
+		}
+	case op.Tenant != "":
+		if tenants != nil && tenants.fleetTenants[command.FleetID] == op.Tenant {
+			return true
+		}
+	default:
+		return true
+	}
+	p := newProblem(problemForbidden, http.StatusForbidden, "Drone of another fleet.")
+	p.Detail = fmt.Sprintf("Operator '%s' may not put drones in fleet '%s'.", op.Subject, command.FleetID)
+	writeProblem(w, req, p)
+	return false
+}
+
+// droneTenant returns the tenant of the fleet of a drone, when the tenant
+// directory knows it, or else the tenant the drone was registered for.
+func droneTenant(tenants *tenantDirectory, fleet string, tenant string) string {
+	if tenants != nil && tenants.fleetTenants[fleet] != "" {
+		return tenants.fleetTenants[fleet]
+	}
+	return tenant
+}
+
+// rejectDrones keeps drones from managing the registry, even when operators
+// are not authenticated.
+func rejectDrones(w http.ResponseWriter, req *http.Request) bool {
+	droneID, ok := authenticatedDrone(req)
+	if ok {
+		p := newProblem(problemForbidden, http.StatusForbidden, "Drones may not manage the registry.")
+		p.Detail = fmt.Sprintf("Request signed by drone '%s'.", droneID)
+		writeProblem(w, req, p)
+	}
+	return ok
+}
+
+func readDroneCommand(w http.ResponseWriter, req *http.Request, command *registerDroneCommand) bool {
+	payload, err := ioutil.ReadAll(req.Body)
+	if err == nil {
+		err = json.Unmarshal(payload, command)
+	}
+	if err != nil {
+		writeProblem(w, req, malformedCommandProblem("Failed to parse drone registration.", parseErrors(err)...))
+		return false
+	}
+
+	errs := make([]fieldError, 0)
+	for field, value := range map[string]string{"drone_id": command.DroneID, "model": command.Model, "owner": command.Owner} {
+		if value == "" {
+			errs = append(errs, requiredField(field))
+		}
+	}
+	if len(errs) > 0 {
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+		writeProblem(w, req, invalidCommandProblem("drone", errs))
+		return false
+	}
+	return true
+}
+
+func activeDrone(w http.ResponseWriter, req *http.Request, drones *droneRegistry) (droneRecord, bool) {
+	droneID := mux.Vars(req)["drone"]
+	record, ok := operatorDrone(w, req, drones)
+	if !ok {
+		return record, false
+	}
+	if record.Status != droneActive {
+		p := newProblem(problemDroneDecommissioned, http.StatusConflict, "Drone is decommissioned.")
+		p.Detail = fmt.Sprintf("Drone '%s' was decommissioned at %s.", droneID, record.DecommissionedAt.Format(time.RFC3339))
+		writeProblem(w, req, p)
+		return record, false
+	}
+	return record, true
+}
+
+// saveDrone dispatches the event of a registry change and then stores the
+// record, so that the registry never holds changes consumers missed.
+func saveDrone(formatter *render.Render, w http.ResponseWriter, req *http.Request, drones *droneRegistry, dispatcher queueDispatcher, record droneRecord, status int, eventType string, schemaVersion int, event interface{}) {
+	envelope, err := newCommandEnvelope(req, eventType, schemaVersion, record.UpdatedAt, event)
+	if err != nil {
+		writeProblem(w, req, newProblem(problemInternal, http.StatusInternalServerError, "Failed to build event envelope."))
+		return
+	}
+
+	err = dispatcher.DispatchMessage(envelope)
+	if err != nil {
+		fmt.Printf("Failed to dispatch event %s: %s\n", envelope.EventID, err)
+		renderDispatchFailure(w, req, err)
+		return
+	}
+
+	err = drones.put(record)
+	if err != nil {
+		fmt.Printf("Failed to save drone %s: %s\n", record.DroneID, err)
+		writeProblem(w, req, newProblem(problemInternal, http.StatusInternalServerError, "Failed to save drone."))
+		return
+	}
+
+	fmt.Printf("Drone %s is %s\n", record.DroneID, record.Status)
+	w.Header().Set(eventIDHeader, envelope.EventID)
+	w.Header().Set(correlationIDHeader, envelope.CorrelationID)
+	formatter.JSON(w, status, record)
+}
+
+func registeredEvent(record droneRecord) dronescommon.DroneRegisteredEvent {
+	return dronescommon.DroneRegisteredEvent{
+		DroneID:    record.DroneID,
+		Model:      record.Model,
+		Owner:      record.Owner,
+		FleetID:    record.FleetID,
+		ReceivedOn: record.UpdatedAt.Unix(),
+	}
+}
+
+func droneNotFoundProblem(droneID string) problem {
+	p := newProblem(problemDroneNotFound, http.StatusNotFound, "Drone not registered.")
+	p.Detail = fmt.Sprintf("No drone '%s' in the registry.", droneID)
+	return p
+}
+
+func unregisteredDroneField(droneID string) fieldError {
+	return fieldError{Field: "drone_id", Code: codeUnregisteredDrone, Message: fmt.Sprintf("drone '%s' is not an active registered drone", droneID)}
+}
+
+func resolveDroneRegistry() *droneRegistry {
+	path := os.Getenv("DRONE_REGISTRY_FILE")
+	if path == "" {
+		return newDroneRegistry(systemClock{})
+	}
+
+	registry, err := loadDroneRegistry(path, systemClock{})
+	failOnError(err, "Failed to load drone registry")
+	fmt.Printf("Using drone registry '%s' with %d drone(s)\n", registry.path, len(registry.drones))
+	return registry
+}
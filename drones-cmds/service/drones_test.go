@@ -0,0 +1,262 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/maxsuelmarinho/golang-event-driven-example/drones-cmds/fakes"
+	dronescommon "github.com/maxsuelmarinho/golang-event-driven-example/drones-common"
+)
+
+// asOperator serves every request as authenticated by the operator.
+func asOperator(handler http.Handler, op *operator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), authenticatedOperatorKey, op)))
+	})
+}
+
+// asAdmin serves every request as an operator holding the fleet:admin scope.
+func asAdmin(handler http.Handler) http.Handler {
+	return asOperator(handler, &operator{Subject: "admin", permissions: map[string]bool{scopeFleetAdmin: true}})
+}
+
+func makeRegistryServer(drones *droneRegistry, dispatcher queueDispatcher, requireRegistered bool) http.Handler {
+	dispatchers := make(map[string]queueDispatcher)
+	for _, queueName := range append(defaultCommands.queues(), droneRegistrationsQueue, droneDecommissionsQueue) {
+		dispatchers[queueName] = dispatcher
+	}
+
+	rules := newDefaultRulesEngine()
+	if requireRegistered {
+		rules.directory = drones
+	}
+	mx := mux.NewRouter()
+	initRoutes(mx, formatter, NewLRUIdempotencyStore(100, time.Minute), rules, newTimestamper(systemClock{}), nil, nil, defaultCommands, dispatchers)
+	initDroneRoutes(mx, formatter, newJWTAuthenticator(nil, systemClock{}), nil, drones, dispatchers)
+	return asAdmin(mx)
+}
+
+func sendRequest(handler http.Handler, method string, path string, body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+	handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestDroneLifecycleEmitsEvents(t *testing.T) {
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	drones := newDroneRegistry(&fakes.FakeClock{Time: receivedAt})
+	server := makeRegistryServer(drones, dispatcher, false)
+
+	recorder := sendRequest(server, "POST", "/api/drones", `{"drone_id": "drone1", "model": "T30", "owner": "acme", "fleet_id": "crop-sprayers"}`)
+	if recorder.Code != http.StatusCreated || !drones.active("drone1") {
+		t.Fatalf("Expected drone to be registered, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	if recorder := sendRequest(server, "POST", "/api/drones", `{"drone_id": "drone1", "model": "T30", "owner": "acme"}`); recorder.Code != http.StatusConflict {
+		t.Errorf("Expected registering an active drone twice to conflict, got %d", recorder.Code)
+	}
+
+	recorder = sendRequest(server, "PUT", "/api/drones/drone1", `{"drone_id": "drone1", "model": "T40", "owner": "acme"}`)
+	if record, _ := drones.get("drone1"); recorder.Code != http.StatusOK || record.Model != "T40" {
+		t.Errorf("Expected drone to be updated, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = sendRequest(server, "POST", "/api/drones/drone1/decommission", `{"reason": "crashed"}`)
+	if recorder.Code != http.StatusOK || drones.active("drone1") {
+		t.Errorf("Expected drone to be decommissioned, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	if recorder := sendRequest(server, "PUT", "/api/drones/drone1", `{"drone_id": "drone1", "model": "T40", "owner": "acme"}`); recorder.Code != http.StatusConflict {
+		t.Errorf("Expected decommissioned drone not to be updated, got %d", recorder.Code)
+	}
+
+	types := make([]string, 0)
+	for _, message := range dispatcher.Messages {
+		types = append(types, message.(dronescommon.EventEnvelope).EventType)
+	}
+	if len(types) != 3 || types[0] != dronescommon.DroneRegisteredEventType || types[1] != dronescommon.DroneRegisteredEventType || types[2] != dronescommon.DroneDecommissionedEventType {
+		t.Errorf("Expected registered, registered and decommissioned events, got %v", types)
+	}
+
+	var event dronescommon.DroneDecommissionedEvent
+	json.Unmarshal(dispatcher.Messages[2].(dronescommon.EventEnvelope).Data, &event)
+	if event.Reason != "crashed" || event.ReceivedOn != receivedAt.Unix() {
+		t.Errorf("Expected decommission reason and time in the event, got %+v", event)
+	}
+}
+
+func TestUnknownDroneIsNotFound(t *testing.T) {
+	server := makeRegistryServer(newDroneRegistry(systemClock{}), fakes.NewFakeQueueDispatcher(), false)
+	for _, recorder := range []*httptest.ResponseRecorder{
+		sendRequest(server, "GET", "/api/drones/ghost", ""),
+		sendRequest(server, "POST", "/api/drones/ghost/decommission", ""),
+	} {
+		if recorder.Code != http.StatusNotFound {
+			t.Errorf("Expected unknown drone to be not found, got %d", recorder.Code)
+		}
+	}
+}
+
+func TestRegistrationIsKeptWhenDispatchFails(t *testing.T) {
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	dispatcher.Err = errors.New("broker down")
+	drones := newDroneRegistry(systemClock{})
+	server := makeRegistryServer(drones, dispatcher, false)
+
+	recorder := sendRequest(server, "POST", "/api/drones", `{"drone_id": "drone1", "model": "T30", "owner": "acme"}`)
+	if recorder.Code != http.StatusServiceUnavailable || drones.active("drone1") {
+		t.Errorf("Expected drone not to be registered without its event, got %d", recorder.Code)
+	}
+}
+
+func TestAdminRoutesNeedOperatorAuthentication(t *testing.T) {
+	mx := mux.NewRouter()
+	initDroneRoutes(mx, formatter, nil, nil, newDroneRegistry(systemClock{}), map[string]queueDispatcher{})
+	initDeadLetterRoutes(mx, formatter, nil, nil)
+
+	for _, path := range []string{"/api/drones/drone1", "/api/admin/dead-letters/telemetry"} {
+		if recorder := sendRequest(mx, "GET", path, ""); recorder.Code != http.StatusNotFound {
+			t.Errorf("Expected %s not to be served without operator authentication, got %d", path, recorder.Code)
+		}
+	}
+
+	mx = mux.NewRouter()
+	initDroneRoutes(mx, formatter, newJWTAuthenticator(nil, systemClock{}), nil, newDroneRegistry(systemClock{}), map[string]queueDispatcher{})
+	if recorder := sendRequest(mx, "GET", "/api/drones/drone1", ""); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected registry to need an operator token, got %d", recorder.Code)
+	}
+}
+
+func TestConcurrentRegistrationsEmitOneEvent(t *testing.T) {
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	drones := newDroneRegistry(systemClock{})
+	server := makeRegistryServer(drones, dispatcher, false)
+
+	codes := make(chan int, 8)
+	var registrations sync.WaitGroup
+	for i := 0; i < cap(codes); i++ {
+		registrations.Add(1)
+		go func() {
+			defer registrations.Done()
+			codes <- sendRequest(server, "POST", "/api/drones", `{"drone_id": "drone1", "model": "T30", "owner": "acme"}`).Code
+		}()
+	}
+	registrations.Wait()
+	close(codes)
+
+	created := 0
+	for code := range codes {
+		if code == http.StatusCreated {
+			created++
+		}
+	}
+	if created != 1 || len(dispatcher.Messages) != 1 {
+		t.Errorf("Expected drone to be registered once, got %d registration(s) and %d event(s)", created, len(dispatcher.Messages))
+	}
+}
+
+func TestCommandsOfUnregisteredDronesAreRejected(t *testing.T) {
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	drones := newDroneRegistry(systemClock{})
+	server := makeRegistryServer(drones, dispatcher, true)
+
+	recorder := sendRequest(server, "POST", "/api/cmds/telemetry", `{"drone_id": "ghost", "uptime": 10}`)
+	var p problem
+	json.Unmarshal(recorder.Body.Bytes(), &p)
+	if recorder.Code != http.StatusBadRequest || len(p.Errors) != 1 || p.Errors[0].Code != codeUnregisteredDrone {
+		t.Errorf("Expected unregistered drone to be rejected, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	sendRequest(server, "POST", "/api/drones", `{"drone_id": "drone1", "model": "T30", "owner": "acme"}`)
+	if recorder := sendRequest(server, "POST", "/api/cmds/telemetry", `{"drone_id": "drone1", "uptime": 10}`); recorder.Code != http.StatusCreated {
+		t.Errorf("Expected registered drone to be accepted, got %d", recorder.Code)
+	}
+
+	sendRequest(server, "POST", "/api/drones/drone1/decommission", "")
+	if recorder := sendRequest(server, "POST", "/api/cmds/telemetry", `{"drone_id": "drone1", "uptime": 10}`); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected decommissioned drone to be rejected, got %d", recorder.Code)
+	}
+}
+
+func TestDroneRegistryIsSavedToFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "drones")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "drones.json")
+
+	drones, err := loadDroneRegistry(path, systemClock{})
+	if err != nil {
+		t.Fatalf("Failed to open drone registry: %s", err)
+	}
+	drones.put(droneRecord{DroneID: "drone1", Model: "T30", Owner: "acme", Status: droneActive})
+
+	reloaded, err := loadDroneRegistry(path, systemClock{})
+	if err != nil || !reloaded.active("drone1") {
+		t.Errorf("Expected saved drone to be loaded again, got %v", err)
+	}
+}
+
+func TestOperatorsManageOnlyTheDronesOfTheirTenant(t *testing.T) {
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	drones := newDroneRegistry(systemClock{})
+	tenants := newTestTenants(t, systemClock{})
+	serverFor := func(tenants *tenantDirectory, tenant string, fleet string) http.Handler {
+		mx := mux.NewRouter()
+		initDroneRoutes(mx, formatter, newJWTAuthenticator(nil, systemClock{}), tenants, drones, map[string]queueDispatcher{droneRegistrationsQueue: dispatcher, droneDecommissionsQueue: dispatcher})
+		return asOperator(mx, &operator{Subject: tenant + "-admin", Tenant: tenant, Fleet: fleet, permissions: map[string]bool{scopeFleetAdmin: true}})
+	}
+	acme := serverFor(tenants, "acme", "")
+	initech := serverFor(tenants, "initech", "")
+
+	recorder := sendRequest(acme, "POST", "/api/drones", `{"drone_id": "drone1", "model": "T30", "owner": "acme", "fleet_id": "crop-sprayers"}`)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected drone to be registered, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if record, _ := drones.get("drone1"); record.TenantID != "acme" {
+		t.Errorf("Expected drone to be registered for its tenant, got %+v", record)
+	}
+
+	for _, recorder := range []*httptest.ResponseRecorder{
+		sendRequest(initech, "GET", "/api/drones/drone1", ""),
+		sendRequest(initech, "PUT", "/api/drones/drone1", `{"drone_id": "drone1", "model": "T40", "owner": "initech", "fleet_id": "surveyors"}`),
+		sendRequest(initech, "POST", "/api/drones/drone1/decommission", ""),
+		sendRequest(serverFor(tenants, "acme", "spotters"), "GET", "/api/drones/drone1", ""),
+	} {
+		if recorder.Code != http.StatusNotFound {
+			t.Errorf("Expected drone of another tenant or fleet to be not found, got %d", recorder.Code)
+		}
+	}
+	if !drones.active("drone1") || len(dispatcher.Messages) != 1 {
+		t.Errorf("Expected drone of another tenant to be left alone, got %d events", len(dispatcher.Messages))
+	}
+
+	if recorder := sendRequest(initech, "POST", "/api/drones", `{"drone_id": "drone1", "model": "T40", "owner": "initech"}`); recorder.Code != http.StatusConflict {
+		t.Errorf("Expected drone of another tenant not to be registered again, got %d", recorder.Code)
+	}
+	for _, server := range []http.Handler{initech, serverFor(nil, "initech", ""), serverFor(tenants, "initech", "surveyors")} {
+		if recorder := sendRequest(server, "POST", "/api/drones", `{"drone_id": "drone2", "model": "T40", "owner": "initech", "fleet_id": "crop-sprayers"}`); recorder.Code != http.StatusForbidden {
+			t.Errorf("Expected drone not to be put in the fleet of another tenant, got %d", recorder.Code)
+		}
+	}
+	if recorder := sendRequest(initech, "POST", "/api/drones", `{"drone_id": "drone2", "model": "T40", "owner": "initech", "fleet_id": "surveyors"}`); recorder.Code != http.StatusCreated {
+		t.Errorf("Expected drone to be put in a fleet of its tenant, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	if recorder := sendRequest(serverFor(tenants, "", ""), "POST", "/api/drones", `{"drone_id": "drone3", "model": "T40", "owner": "initech", "fleet_id": "surveyors"}`); recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected drone to be registered by an operator of every tenant, got %d", recorder.Code)
+	}
+	if recorder := sendRequest(initech, "GET", "/api/drones/drone3", ""); recorder.Code != http.StatusOK {
+		t.Errorf("Expected drone to belong to the tenant of its fleet, got %d", recorder.Code)
+	}
+}
@@ -3,7 +3,6 @@ package service
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"time"
 
@@ -12,87 +11,146 @@ import (
 	"github.com/unrolled/render"
 )
 
-func addTelemetryHandler(formatter *render.Render, dispatcher queueDispatcher) http.HandlerFunc {
+const (
+	eventSource = "drones-cmds"
+
+	eventIDHeader       = "X-Event-ID"
+	correlationIDHeader = "X-Correlation-ID"
+	requestIDHeader     = "X-Request-ID"
+
+	// maxRequestBytes bounds every request body; a full batch of commands
+	// fits comfortably.
+	maxRequestBytes = 1 << 20
+)
+
+// addCommandHandler accepts commands of one registered type and dispatches
+// the events they map onto.
+func addCommandHandler(formatter *render.Render, rules *rulesEngine, stamper *timestamper, definition commandDefinition, dispatcher queueDispatcher) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
-		payload, _ := ioutil.ReadAll(req.Body)
-		var newTelemetryCommand telemetryCommand
-		err := json.Unmarshal(payload, &newTelemetryCommand)
-		if err != nil {
-			formatter.Text(w, http.StatusBadRequest, "Failed to parse add telemetry command.")
+		command := definition.NewCommand()
+		if !readCommand(w, req, definition, command, rules) {
 			return
 		}
 
-		if !newTelemetryCommand.isValid() {
-			formatter.Text(w, http.StatusBadRequest, "Invalid telemetry command.")
-			return
-		}
+		timing := stamper.stamp(command)
+		event := command.toEvent(timing)
+		fmt.Printf("Dispatching %s event for drone %s\n", definition.Name, command.droneID())
+		dispatchEvent(formatter, w, req, dispatcher, definition.EventType, definition.SchemaVersion, *timing.ReceivedAt, event)
+	}
+}
 
-		event := dronescommon.TelemetryUpdatedEvent{
-			DroneID:          newTelemetryCommand.DroneID,
-			RemainingBattery: newTelemetryCommand.RemainingBattery,
-			Uptime:           newTelemetryCommand.Uptime,
-			CoreTemp:         newTelemetryCommand.CoreTemp,
-			ReceivedOn:       time.Now().Unix(),
-		}
-		fmt.Printf("Dispatching telemetry event for drone %s\n", newTelemetryCommand.DroneID)
-		dispatcher.DispatchMessage(event)
-		formatter.JSON(w, http.StatusCreated, event)
+// readCommand reads and validates the command of a request, replying with a
+// problem document and returning false when it is malformed or invalid.
+func readCommand(w http.ResponseWriter, req *http.Request, definition commandDefinition, command eventCommand, rules *rulesEngine) bool {
+	payload, err := readCommandPayload(req, definition.CommandType)
+	if err != nil {
+		writeProblem(w, req, malformedCommandProblem(fmt.Sprintf("Failed to read add %s command: %s", definition.Name, err)))
+		return false
 	}
+
+	p := decodeCommand(payload, definition, scopeOf(req).Fleet, command, rules)
+	if p == nil {
+		p = authorizeCommand(req, command, rules.fleets)
+	}
+	if p != nil {
+		writeProblem(w, req, *p)
+		return false
+	}
+	return true
 }
 
-func addAlertHandler(formatter *render.Render, dispatcher queueDispatcher) http.HandlerFunc {
-	return func(w http.ResponseWriter, req *http.Request) {
-		payload, _ := ioutil.ReadAll(req.Body)
-		var newAlertCommand alertCommand
-		err := json.Unmarshal(payload, &newAlertCommand)
-		if err != nil {
-			formatter.Text(w, http.StatusBadRequest, "Failed to parse add alert command.")
-			return
-		}
+// decodeCommand unmarshals a command and validates it against the rules of
+// the fleet it was sent for and the validator of its definition, describing
+// every problem found. Valid alerts are classified by severity.
+func decodeCommand(payload []byte, definition commandDefinition, fleet string, command eventCommand, rules *rulesEngine) *problem {
+	err := json.Unmarshal(payload, command)
+	if err != nil {
+		p := malformedCommandProblem(fmt.Sprintf("Failed to parse add %s command.", definition.Name), parseErrors(err)...)
+		return &p
+	}
 
-		if !newAlertCommand.isValid() {
-			formatter.Text(w, http.StatusBadRequest, "Invalid alert command.")
-			return
-		}
+	errs := rules.validate(definition.Name, fleet, command)
+	if definition.Validate != nil {
+		errs = append(errs, definition.Validate(command)...)
+	}
+	if len(errs) > 0 {
+		p := invalidCommandProblem(definition.Name, errs)
+		return &p
+	}
+	if classified, ok := command.(severityCommand); ok {
+		classified.classify(rules.severities)
+	}
+	return nil
+}
 
-		event := dronescommon.AlertSignalledEvent{
-			DroneID:     newAlertCommand.DroneID,
-			FaultCode:   newAlertCommand.FaultCode,
-			Description: newAlertCommand.Description,
-			ReceivedOn:  time.Now().Unix(),
-		}
-		fmt.Printf("Dispatching alert event for drone %s\n", newAlertCommand.DroneID)
-		dispatcher.DispatchMessage(event)
-		formatter.JSON(w, http.StatusCreated, event)
+func dispatchEvent(formatter *render.Render, w http.ResponseWriter, req *http.Request, dispatcher queueDispatcher, eventType string, schemaVersion int, receivedAt time.Time, event interface{}) {
+	envelope, err := newCommandEnvelope(req, eventType, schemaVersion, receivedAt, event)
+	if err != nil {
+		writeProblem(w, req, newProblem(problemInternal, http.StatusInternalServerError, "Failed to build event envelope."))
+		return
+	}
+
+	err = dispatcher.DispatchMessage(envelope)
+	if err != nil {
+		fmt.Printf("Failed to dispatch event %s: %s\n", envelope.EventID, err)
+		renderDispatchFailure(w, req, err)
+		return
+	}
+
+	w.Header().Set(eventIDHeader, envelope.EventID)
+	w.Header().Set(correlationIDHeader, envelope.CorrelationID)
+	formatter.JSON(w, http.StatusCreated, event)
+}
+
+func newCommandEnvelope(req *http.Request, eventType string, schemaVersion int, receivedAt time.Time, event interface{}) (envelope dronescommon.EventEnvelope, err error) {
+	envelope, err = dronescommon.NewEventEnvelope(eventType, schemaVersion, eventSource, event)
+	if err != nil {
+		return
+	}
+	envelope.OccurredAt = receivedAt.UTC()
+	envelope.ReceivedOn = receivedAt.Unix()
+	envelope.CorrelationID = resolveCorrelationID(req)
+	scope := scopeOf(req)
+	envelope.TenantID = scope.Tenant
+	envelope.FleetID = scope.Fleet
+	return
+}
+
+// resolveCorrelationID takes the correlation ID from the request headers,
+// starting a new one when the client did not send any.
+func resolveCorrelationID(req *http.Request) string {
+	correlationID := req.Header.Get(correlationIDHeader)
+	if correlationID == "" {
+		correlationID = req.Header.Get(requestIDHeader)
+	}
+	if correlationID == "" {
+		correlationID = dronescommon.NewEventID()
 	}
+	return correlationID
 }
 
-func addPositionHandler(formatter *render.Render, dispatcher queueDispatcher) http.HandlerFunc {
+func healthHandler(formatter *render.Render, health connectionHealth) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
-		payload, _ := ioutil.ReadAll(req.Body)
-		var newPositionCommand positionCommand
-		err := json.Unmarshal(payload, &newPositionCommand)
-		if err != nil {
-			formatter.Text(w, http.StatusBadRequest, "Failed to parse add position command.")
-			return
+		status := http.StatusOK
+		if !health.Healthy() {
+			status = http.StatusServiceUnavailable
 		}
+		formatter.JSON(w, status, map[string]interface{}{"amqp": health.Status()})
+	}
+}
 
-		if !newPositionCommand.isValid() {
-			formatter.Text(w, http.StatusBadRequest, "Invalid position command.")
+// limitRequestBodies refuses bodies that declare more than maxBytes and cuts
+// off the ones that turn out longer while they are read.
+func limitRequestBodies(maxBytes int64) func(http.ResponseWriter, *http.Request, http.HandlerFunc) {
+	return func(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+		if req.ContentLength > maxBytes {
+			p := newProblem(problemInvalidCommand, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body exceeds %d bytes.", maxBytes))
+			writeProblem(w, req, p)
 			return
 		}
-
-		event := dronescommon.PositionChangedEvent{
-			DroneID:         newPositionCommand.DroneID,
-			Longitude:       newPositionCommand.Longitude,
-			Latitude:        newPositionCommand.Latitude,
-			Altitude:        newPositionCommand.Altitude,
-			CurrentSpeed:    newPositionCommand.CurrentSpeed,
-			HeadingCardinal: newPositionCommand.HeadingCardinal,
-			ReceivedOn:      time.Now().Unix(),
+		if req.Body != nil {
+			req.Body = http.MaxBytesReader(w, req.Body, maxBytes)
 		}
-		fmt.Printf("Dispatching position event for drone %s\n", newPositionCommand.DroneID)
-		dispatcher.DispatchMessage(event)
-		formatter.JSON(w, http.StatusCreated, event)
+		next(w, req)
 	}
 }
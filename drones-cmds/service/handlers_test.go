@@ -3,9 +3,11 @@ package service
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/codegangsta/negroni"
 	"github.com/gorilla/mux"
@@ -23,7 +25,11 @@ var (
 func makeTestServer(dispatcher queueDispatcher) *negroni.Negroni {
 	server := negroni.New()
 	mx := mux.NewRouter()
-	initRoutes(mx, formatter, dispatcher, dispatcher, dispatcher)
+	dispatchers := make(map[string]queueDispatcher)
+	for _, queueName := range defaultCommands.queues() {
+		dispatchers[queueName] = dispatcher
+	}
+	initRoutes(mx, formatter, NewLRUIdempotencyStore(100, time.Minute), newDefaultRulesEngine(), newTimestamper(systemClock{}), nil, nil, defaultCommands, dispatchers)
 	server.UseHandler(mx)
 	return server
 }
@@ -213,3 +219,273 @@ func TestAddInvalidAlertReturnsBadRequest(t *testing.T) {
 		t.Errorf("Expected dispatcher to dispatch 0 messages, got %d", len(dispatcher.Messages))
 	}
 }
+
+func TestFailedDispatchReturnsServiceUnavailable(t *testing.T) {
+	var (
+		request  *http.Request
+		recorder *httptest.ResponseRecorder
+	)
+
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	dispatcher.Err = errors.New("channel/connection is not open")
+	server := makeTestServer(dispatcher)
+	recorder = httptest.NewRecorder()
+	body := []byte("{\"drone_id\":\"drone123\",\"battery\":72,\"uptime\":6941,\"core_temp\":21}")
+	reader := bytes.NewReader(body)
+	request, _ = http.NewRequest("POST", "/api/cmds/telemetry", reader)
+	server.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected failed dispatch to return 503, got %d", recorder.Code)
+	}
+
+	if recorder.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected failed dispatch to set a Retry-After header")
+	}
+
+	var errorResponse problem
+	err := json.Unmarshal(recorder.Body.Bytes(), &errorResponse)
+	if err != nil {
+		t.Errorf("Could not unmarshal payload into error response object")
+	}
+
+	if errorResponse.RetryAfter != dispatchRetryAfterSeconds {
+		t.Errorf("Expected retry after of %d, got %d", dispatchRetryAfterSeconds, errorResponse.RetryAfter)
+	}
+}
+
+func TestDispatchedEventCarriesEnvelopeMetadata(t *testing.T) {
+	var (
+		request  *http.Request
+		recorder *httptest.ResponseRecorder
+	)
+
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	server := makeTestServer(dispatcher)
+	recorder = httptest.NewRecorder()
+	body := []byte("{\"drone_id\":\"drone123\",\"battery\":72,\"uptime\":6941,\"core_temp\":21}")
+	reader := bytes.NewReader(body)
+	request, _ = http.NewRequest("POST", "/api/cmds/telemetry", reader)
+	request.Header.Set("X-Correlation-ID", "flight-42")
+	server.ServeHTTP(recorder, request)
+
+	if len(dispatcher.Messages) != 1 {
+		t.Fatalf("Expected queue dispatch count of 1, got %d", len(dispatcher.Messages))
+	}
+
+	envelope, ok := dispatcher.Messages[0].(dronescommon.EventEnvelope)
+	if !ok {
+		t.Fatalf("Expected an event envelope to be dispatched, got %T", dispatcher.Messages[0])
+	}
+
+	if envelope.EventType != dronescommon.TelemetryUpdatedEventType {
+		t.Errorf("Expected event type %s, got %s", dronescommon.TelemetryUpdatedEventType, envelope.EventType)
+	}
+
+	if envelope.CorrelationID != "flight-42" {
+		t.Errorf("Expected correlation ID 'flight-42', got %s", envelope.CorrelationID)
+	}
+
+	if recorder.Header().Get("X-Event-ID") != envelope.EventID {
+		t.Errorf("Expected response to carry event ID %s, got %s", envelope.EventID, recorder.Header().Get("X-Event-ID"))
+	}
+}
+
+func TestAddTelemetryAcceptsStructuredCloudEvent(t *testing.T) {
+	var (
+		request  *http.Request
+		recorder *httptest.ResponseRecorder
+	)
+
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	server := makeTestServer(dispatcher)
+	recorder = httptest.NewRecorder()
+	body := []byte("{\"specversion\":\"1.0\",\"id\":\"ce-1\",\"source\":\"/drones/drone123\",\"type\":\"drones.command.telemetry\",\"datacontenttype\":\"application/json\",\"data\":{\"drone_id\":\"drone123\",\"battery\":72,\"uptime\":6941,\"core_temp\":21}}")
+	reader := bytes.NewReader(body)
+	request, _ = http.NewRequest("POST", "/api/cmds/telemetry", reader)
+	request.Header.Set("Content-Type", "application/cloudevents+json; charset=utf-8")
+	server.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected structured CloudEvent to return 201, got %d/%s", recorder.Code, recorder.Body.String())
+	}
+
+	envelope := dispatcher.Messages[0].(dronescommon.EventEnvelope)
+	if envelope.CorrelationID != "ce-1" {
+		t.Errorf("Expected CloudEvent ID to become the correlation ID, got %s", envelope.CorrelationID)
+	}
+}
+
+func TestAddAlertAcceptsBinaryCloudEvent(t *testing.T) {
+	var (
+		request  *http.Request
+		recorder *httptest.ResponseRecorder
+	)
+
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	server := makeTestServer(dispatcher)
+	recorder = httptest.NewRecorder()
+	body := []byte("{\"drone_id\":\"alertingdrone123\",\"fault_code\":12,\"description\":\"all the things are failing\"}")
+	reader := bytes.NewReader(body)
+	request, _ = http.NewRequest("POST", "/api/cmds/alerts", reader)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("ce-specversion", "1.0")
+	request.Header.Set("ce-id", "ce-2")
+	request.Header.Set("ce-source", "/drones/alertingdrone123")
+	request.Header.Set("ce-type", "drones.command.alert")
+	server.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusCreated {
+		t.Errorf("Expected binary CloudEvent to return 201, got %d/%s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestCloudEventOfWrongTypeReturnsBadRequest(t *testing.T) {
+	var (
+		request  *http.Request
+		recorder *httptest.ResponseRecorder
+	)
+
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	server := makeTestServer(dispatcher)
+	recorder = httptest.NewRecorder()
+	body := []byte("{\"drone_id\":\"positiondrone123\",\"latitude\":81.231,\"longitude\":43.1231,\"altitude\":2301.1,\"current_speed\":41.3,\"heading_cardinal\":1}")
+	reader := bytes.NewReader(body)
+	request, _ = http.NewRequest("POST", "/api/cmds/positions", reader)
+	request.Header.Set("ce-specversion", "1.0")
+	request.Header.Set("ce-id", "ce-3")
+	request.Header.Set("ce-source", "/drones/positiondrone123")
+	request.Header.Set("ce-type", "drones.command.telemetry")
+	server.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected CloudEvent of the wrong type to return 400, got %d", recorder.Code)
+	}
+
+	if len(dispatcher.Messages) != 0 {
+		t.Errorf("Expected dispatcher to dispatch 0 messages, got %d", len(dispatcher.Messages))
+	}
+}
+
+func TestInvalidCommandReturnsFieldErrors(t *testing.T) {
+	var (
+		request  *http.Request
+		recorder *httptest.ResponseRecorder
+	)
+
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	server := makeTestServer(dispatcher)
+	recorder = httptest.NewRecorder()
+	body := []byte("{\"battery\":72}")
+	reader := bytes.NewReader(body)
+	request, _ = http.NewRequest("POST", "/api/cmds/telemetry", reader)
+	server.ServeHTTP(recorder, request)
+
+	if recorder.Header().Get("Content-Type") != "application/problem+json" {
+		t.Errorf("Expected a problem document, got content type %s", recorder.Header().Get("Content-Type"))
+	}
+
+	var response problem
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	if response.Status != http.StatusBadRequest || response.Instance != "/api/cmds/telemetry" {
+		t.Errorf("Expected problem with status 400 for /api/cmds/telemetry, got %+v", response)
+	}
+
+	fields := make(map[string]string)
+	for _, fieldErr := range response.Errors {
+		fields[fieldErr.Field] = fieldErr.Code
+	}
+	if fields["drone_id"] != "required" || fields["uptime"] != "required" {
+		t.Errorf("Expected drone_id and uptime to be reported as required, got %+v", response.Errors)
+	}
+}
+
+func TestUnparseableCommandReportsOffendingField(t *testing.T) {
+	var (
+		request  *http.Request
+		recorder *httptest.ResponseRecorder
+	)
+
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	server := makeTestServer(dispatcher)
+	recorder = httptest.NewRecorder()
+	body := []byte("{\"drone_id\":\"alertingdrone123\",\"fault_code\":\"twelve\",\"description\":\"all the things are failing\"}")
+	reader := bytes.NewReader(body)
+	request, _ = http.NewRequest("POST", "/api/cmds/alerts", reader)
+	server.ServeHTTP(recorder, request)
+
+	var response problem
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	if len(response.Errors) != 1 || response.Errors[0].Field != "fault_code" || response.Errors[0].Code != "invalid_type" {
+		t.Errorf("Expected an invalid_type error on fault_code, got %+v", response.Errors)
+	}
+}
+
+func TestAddPositionInSouthernAndWesternHemispheres(t *testing.T) {
+	var (
+		request  *http.Request
+		recorder *httptest.ResponseRecorder
+	)
+
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	server := makeTestServer(dispatcher)
+	recorder = httptest.NewRecorder()
+	body := []byte("{\"drone_id\":\"positiondrone123\",\"latitude\":-33.8688,\"longitude\":-70.6693,\"altitude\":520.5,\"current_speed\":12.3,\"heading_cardinal\":2}")
+	reader := bytes.NewReader(body)
+	request, _ = http.NewRequest("POST", "/api/cmds/positions", reader)
+	server.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusCreated {
+		t.Errorf("Expected position with negative coordinates to return 201, got %d/%s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestAddPositionOutOfGeographicBoundsReturnsBadRequest(t *testing.T) {
+	var (
+		request  *http.Request
+		recorder *httptest.ResponseRecorder
+	)
+
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	server := makeTestServer(dispatcher)
+	recorder = httptest.NewRecorder()
+	body := []byte("{\"drone_id\":\"positiondrone123\",\"latitude\":91.5,\"longitude\":-180.5,\"altitude\":520.5,\"current_speed\":-1,\"heading_cardinal\":4}")
+	reader := bytes.NewReader(body)
+	request, _ = http.NewRequest("POST", "/api/cmds/positions", reader)
+	server.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected out of bounds position to return 400, got %d", recorder.Code)
+	}
+
+	var response problem
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	if len(response.Errors) != 4 {
+		t.Errorf("Expected latitude, longitude, current_speed and heading_cardinal errors, got %+v", response.Errors)
+	}
+}
+
+func TestRequestBodiesAreLimited(t *testing.T) {
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	server := negroni.New(negroni.HandlerFunc(limitRequestBodies(32)))
+	server.UseHandler(makeTestServer(dispatcher))
+	body := "{\"drone_id\":\"drone123\",\"battery\":72,\"uptime\":6941,\"core_temp\":21}"
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/api/cmds/telemetry", bytes.NewReader([]byte(body)))
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected declared oversized body to return 413, got %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/api/cmds/telemetry", bytes.NewReader([]byte(body)))
+	request.ContentLength = -1
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected undeclared oversized body to be cut off with 400, got %d", recorder.Code)
+	}
+	if len(dispatcher.Messages) != 0 {
+		t.Errorf("Expected no oversized command to be dispatched, got %d", len(dispatcher.Messages))
+	}
+}
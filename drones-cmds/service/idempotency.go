@@ -0,0 +1,244 @@
+package service
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotentReplayedHeader  = "Idempotent-Replayed"
+	defaultIdempotencyWindow  = time.Hour
+	defaultIdempotencyEntries = 10000
+)
+
+// IdempotencyStore remembers the responses of commands by idempotency key.
+type IdempotencyStore interface {
+	Get(key string) (StoredResponse, bool)
+	Put(key string, response StoredResponse)
+}
+
+// StoredResponse is a response replayed for repeated submissions of a
+// command. RequestHash identifies the body it answered.
+type StoredResponse struct {
+	Status      int
+	Header      http.Header
+	Body        []byte
+	RequestHash [sha256.Size]byte
+}
+
+// LRUIdempotencyStore keeps at most capacity responses in memory, each for
+// the length of the window.
+type LRUIdempotencyStore struct {
+	capacity int
+	window   time.Duration
+	now      func() time.Time
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type lruEntry struct {
+	key       string
+	response  StoredResponse
+	expiresAt time.Time
+}
+
+func NewLRUIdempotencyStore(capacity int, window time.Duration) *LRUIdempotencyStore {
+	return &LRUIdempotencyStore{
+		capacity: capacity,
+		window:   window,
+		now:      time.Now,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (s *LRUIdempotencyStore) Get(key string) (StoredResponse, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	element, ok := s.entries[key]
+	if !ok {
+		return StoredResponse{}, false
+	}
+
+	entry := element.Value.(*lruEntry)
+	if s.now().After(entry.expiresAt) {
+		s.order.Remove(element)
+		delete(s.entries, key)
+		return StoredResponse{}, false
+	}
+	s.order.MoveToFront(element)
+	return entry.response, true
+}
+
+func (s *LRUIdempotencyStore) Put(key string, response StoredResponse) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry := &lruEntry{key: key, response: response, expiresAt: s.now().Add(s.window)}
+	if element, ok := s.entries[key]; ok {
+		element.Value = entry
+		s.order.MoveToFront(element)
+		return
+	}
+
+	s.entries[key] = s.order.PushFront(entry)
+	for s.order.Len() > s.capacity {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+// idempotent replays the stored response when a command is submitted again
+// by the same drone or operator with the same Idempotency-Key header or
+// command_id body field, instead of dispatching it twice. Only successful
+// responses are stored: rejected commands may pass once the drone is
+// registered or the client fixed, and server errors can be retried, as can
+// batches reporting items to retry with Retry-After.
+func idempotent(store IdempotencyStore, next http.HandlerFunc) http.HandlerFunc {
+	var (
+		mutex    sync.Mutex
+		inFlight = make(map[string]bool)
+	)
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		payload, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			writeProblem(w, req, malformedCommandProblem("Failed to read command."))
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(payload))
+
+		key := idempotencyKey(req, payload)
+		if key == "" {
+			next(w, req)
+			return
+		}
+		key = principalOf(req) + " " + req.URL.Path + " " + key
+		requestHash := sha256.Sum256(payload)
+
+		if stored, ok := store.Get(key); ok {
+			if stored.RequestHash != requestHash {
+				writeProblem(w, req, newProblem(problemConflict, http.StatusUnprocessableEntity, "Idempotency key was already used for a different command."))
+				return
+			}
+			replayResponse(w, stored)
+			return
+		}
+
+		mutex.Lock()
+		if inFlight[key] {
+			mutex.Unlock()
+			writeProblem(w, req, newProblem(problemConflict, http.StatusConflict, "A command with this idempotency key is already being processed."))
+			return
+		}
+		inFlight[key] = true
+		mutex.Unlock()
+		defer func() {
+			mutex.Lock()
+			delete(inFlight, key)
+			mutex.Unlock()
+		}()
+
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(recorder, req)
+		if recorder.status >= http.StatusOK && recorder.status < http.StatusMultipleChoices && w.Header().Get("Retry-After") == "" {
+			store.Put(key, StoredResponse{
+				Status:      recorder.status,
+				Header:      w.Header().Clone(),
+				Body:        recorder.body.Bytes(),
+				RequestHash: requestHash,
+			})
+		}
+	}
+}
+
+// principalOf identifies who sent a request within its tenant, so a key
+// reused by another drone or operator never replays their response.
+func principalOf(req *http.Request) string {
+	principal := scopeOf(req).Tenant + "/"
+	if droneID, ok := authenticatedDrone(req); ok {
+		return principal + "drone:" + droneID
+	}
+	if op, ok := authenticatedOperator(req); ok {
+		return principal + "operator:" + op.Subject
+	}
+	return principal
+}
+
+func idempotencyKey(req *http.Request, payload []byte) string {
+	key := req.Header.Get(idempotencyKeyHeader)
+	if key != "" {
+		return key
+	}
+
+	var command struct {
+		CommandID string `json:"command_id"`
+	}
+	json.Unmarshal(payload, &command)
+	return command.CommandID
+}
+
+func replayResponse(w http.ResponseWriter, stored StoredResponse) {
+	for name, values := range stored.Header {
+		w.Header()[name] = values
+	}
+	w.Header().Set(idempotentReplayedHeader, "true")
+	w.WriteHeader(stored.Status)
+	w.Write(stored.Body)
+}
+
+// responseRecorder captures what a handler writes while passing it through.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
+
+func resolveIdempotencyStore() IdempotencyStore {
+	window, err := parseIdempotencyWindow(os.Getenv("IDEMPOTENCY_WINDOW"))
+	failOnError(err, "Invalid IDEMPOTENCY_WINDOW")
+
+	capacity := defaultIdempotencyEntries
+	if value, err := strconv.Atoi(os.Getenv("IDEMPOTENCY_CAPACITY")); err == nil && value > 0 {
+		capacity = value
+	}
+	return NewLRUIdempotencyStore(capacity, window)
+}
+
+// parseIdempotencyWindow refuses windows that would never remember a key:
+// with a zero or negative window every retry would be dispatched again.
+func parseIdempotencyWindow(value string) (time.Duration, error) {
+	if value == "" {
+		return defaultIdempotencyWindow, nil
+	}
+	window, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if window <= 0 {
+		return 0, fmt.Errorf("idempotency window %s must be positive", value)
+	}
+	return window, nil
+}
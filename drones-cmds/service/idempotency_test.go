@@ -0,0 +1,145 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/maxsuelmarinho/golang-event-driven-example/drones-cmds/fakes"
+)
+
+func TestRepeatedIdempotencyKeyReplaysOriginalResponse(t *testing.T) {
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	server := makeTestServer(dispatcher)
+	body := []byte("{\"drone_id\":\"drone123\",\"battery\":72,\"uptime\":6941,\"core_temp\":21}")
+
+	responses := make([]*httptest.ResponseRecorder, 2)
+	for i := range responses {
+		responses[i] = httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", "/api/cmds/telemetry", bytes.NewReader(body))
+		request.Header.Set("Idempotency-Key", "retry-1")
+		server.ServeHTTP(responses[i], request)
+	}
+
+	if len(dispatcher.Messages) != 1 {
+		t.Errorf("Expected retried command to be dispatched once, got %d", len(dispatcher.Messages))
+	}
+
+	if responses[1].Code != http.StatusCreated || responses[1].Body.String() != responses[0].Body.String() {
+		t.Errorf("Expected retry to get the original response, got %d/%s", responses[1].Code, responses[1].Body.String())
+	}
+
+	if responses[1].Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Expected replayed response to be flagged")
+	}
+}
+
+func TestRepeatedCommandIDIsNotRedispatched(t *testing.T) {
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	server := makeTestServer(dispatcher)
+	body := []byte("{\"command_id\":\"cmd-7\",\"drone_id\":\"alertingdrone123\",\"fault_code\":12,\"description\":\"all the things are failing\"}")
+
+	for i := 0; i < 3; i++ {
+		request, _ := http.NewRequest("POST", "/api/cmds/alerts", bytes.NewReader(body))
+		server.ServeHTTP(httptest.NewRecorder(), request)
+	}
+
+	if len(dispatcher.Messages) != 1 {
+		t.Errorf("Expected command to be dispatched once, got %d", len(dispatcher.Messages))
+	}
+}
+
+func TestFailedDispatchIsNotRemembered(t *testing.T) {
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	dispatcher.Err = ErrNotConnected
+	server := makeTestServer(dispatcher)
+	body := []byte("{\"drone_id\":\"drone123\",\"battery\":72,\"uptime\":6941,\"core_temp\":21}")
+
+	request, _ := http.NewRequest("POST", "/api/cmds/telemetry", bytes.NewReader(body))
+	request.Header.Set("Idempotency-Key", "retry-2")
+	server.ServeHTTP(httptest.NewRecorder(), request)
+
+	dispatcher.Err = nil
+	recorder := httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/api/cmds/telemetry", bytes.NewReader(body))
+	request.Header.Set("Idempotency-Key", "retry-2")
+	server.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusCreated || len(dispatcher.Messages) != 1 {
+		t.Errorf("Expected retry after a failed dispatch to be dispatched, got %d with %d message(s)", recorder.Code, len(dispatcher.Messages))
+	}
+}
+
+func TestRejectedCommandIsNotRemembered(t *testing.T) {
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	server := makeTestServer(dispatcher)
+
+	request, _ := http.NewRequest("POST", "/api/cmds/telemetry", bytes.NewReader([]byte("{\"drone_id\":\"drone123\"}")))
+	request.Header.Set("Idempotency-Key", "retry-3")
+	server.ServeHTTP(httptest.NewRecorder(), request)
+
+	recorder := httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/api/cmds/telemetry", bytes.NewReader([]byte("{\"drone_id\":\"drone123\",\"battery\":72,\"uptime\":6941,\"core_temp\":21}")))
+	request.Header.Set("Idempotency-Key", "retry-3")
+	server.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusCreated || len(dispatcher.Messages) != 1 {
+		t.Errorf("Expected fixed command to be dispatched under the same key, got %d with %d message(s)", recorder.Code, len(dispatcher.Messages))
+	}
+}
+
+func TestIdempotencyKeysAreScopedToTheSender(t *testing.T) {
+	handled := 0
+	handler := idempotent(NewLRUIdempotencyStore(10, time.Minute), func(w http.ResponseWriter, req *http.Request) {
+		handled++
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	for _, droneID := range []string{"drone1", "drone2", "drone1"} {
+		request, _ := http.NewRequest("POST", "/api/cmds/telemetry", bytes.NewReader([]byte("{}")))
+		request.Header.Set("Idempotency-Key", "shared")
+		request = request.WithContext(context.WithValue(request.Context(), authenticatedDroneKey, droneID))
+		handler(httptest.NewRecorder(), request)
+	}
+
+	if handled != 2 {
+		t.Errorf("Expected each drone to get its own response, got %d handled request(s)", handled)
+	}
+}
+
+func TestLRUIdempotencyStoreEvictsAndExpires(t *testing.T) {
+	now := time.Now()
+	store := NewLRUIdempotencyStore(2, time.Minute)
+	store.now = func() time.Time { return now }
+
+	store.Put("a", StoredResponse{Status: 201})
+	store.Put("b", StoredResponse{Status: 201})
+	store.Get("a")
+	store.Put("c", StoredResponse{Status: 201})
+
+	if _, ok := store.Get("b"); ok {
+		t.Errorf("Expected least recently used key to be evicted")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, ok := store.Get("a"); ok {
+		t.Errorf("Expected key to expire after the window")
+	}
+}
+
+func TestIdempotencyWindowMustBePositive(t *testing.T) {
+	if window, err := parseIdempotencyWindow(""); err != nil || window != defaultIdempotencyWindow {
+		t.Errorf("Expected the default window when unset, got %v (%v)", window, err)
+	}
+	if window, err := parseIdempotencyWindow("15m"); err != nil || window != 15*time.Minute {
+		t.Errorf("Expected a 15m window, got %v (%v)", window, err)
+	}
+	for _, value := range []string{"0", "0s", "-1h", "an hour"} {
+		if _, err := parseIdempotencyWindow(value); err == nil {
+			t.Errorf("Expected window %q to be refused", value)
+		}
+	}
+}
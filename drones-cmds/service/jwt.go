@@ -0,0 +1,389 @@
+package service
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	scopeDroneWrite  = "drone:write"
+	scopeAlertsWrite = "alerts:write"
+	scopeFleetAdmin  = "fleet:admin"
+
+	jwtLeeway = time.Minute
+)
+
+const authenticatedOperatorKey contextKey = "authenticated-operator"
+
+// operator is a person or service authenticated by a JWT. Permissions hold
+// both its scopes and its roles.
+type operator struct {
+	Subject     string
+	Tenant      string
+	Fleet       string
+	permissions map[string]bool
+}
+
+func (o *operator) allowed(scopes []string) bool {
+	if o.permissions[scopeFleetAdmin] {
+		return true
+	}
+	for _, scope := range scopes {
+		if o.permissions[scope] {
+			return true
+		}
+	}
+	return false
+}
+
+// manages tells whether a registered drone is of the tenant and fleet the
+// operator is limited to, if any. Without an operator, every drone is.
+func (o *operator) manages(record droneRecord) bool {
+	if o == nil {
+		return true
+	}
+	return (o.Tenant == "" || o.Tenant == record.TenantID) && (o.Fleet == "" || o.Fleet == record.FleetID)
+}
+
+func (o *operator) tenant() string {
+	if o == nil {
+		return ""
+	}
+	return o.Tenant
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if json.Unmarshal(data, &single) == nil {
+		*a = audience{single}
+		return nil
+	}
+	var many []string
+	err := json.Unmarshal(data, &many)
+	*a = many
+	return err
+}
+
+type jwtClaims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+	Scope     string   `json:"scope"`
+	Roles     []string `json:"roles"`
+	Tenant    string   `json:"tenant"`
+	Fleet     string   `json:"fleet"`
+}
+
+// jwtAuthenticator is a negroni middleware authenticating operators by the
+// bearer tokens they send, signed with one of the keys of a JWKS file
+// (RS256/384/512 or ES256/384/512). Requests without a bearer token are left
+// to the drone authentication. It also enforces the scopes of the routes
+// registered through require.
+type jwtAuthenticator struct {
+	keys     map[string]crypto.PublicKey
+	issuer   string
+	audience string
+	clock    clock
+}
+
+func newJWTAuthenticator(keys map[string]crypto.PublicKey, c clock) *jwtAuthenticator {
+	return &jwtAuthenticator{keys: keys, clock: c}
+}
+
+// loadJWKS reads the public keys of a JWKS file, by key ID.
+func loadJWKS(path string) (map[string]crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err = json.Unmarshal(data, &set)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid key '%s': %s", jwk.Kid, err)
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no keys in JWKS")
+	}
+	return keys, nil
+}
+
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curve, err := namedCurve(jwk.Crv)
+		if err != nil {
+			return nil, err
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type '%s'", jwk.Kty)
+}
+
+func namedCurve(name string) (elliptic.Curve, error) {
+	switch name {
+	case "P-256":
+		return elliptic.P256(), nil
+	case "P-384":
+		return elliptic.P384(), nil
+	case "P-521":
+		return elliptic.P521(), nil
+	}
+	return nil, fmt.Errorf("unsupported curve '%s'", name)
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+func (a *jwtAuthenticator) ServeHTTP(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	authorization := req.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		next(w, req)
+		return
+	}
+
+	op, err := a.authenticate(strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer ")))
+	if err != nil {
+		fmt.Printf("Rejected bearer token for %s: %s\n", req.URL.Path, err)
+		p := newProblem(problemUnauthorized, http.StatusUnauthorized, "Invalid bearer token.")
+		p.Detail = err.Error()
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeProblem(w, req, p)
+		return
+	}
+
+	next(w, req.WithContext(context.WithValue(req.Context(), authenticatedOperatorKey, op)))
+}
+
+func (a *jwtAuthenticator) authenticate(token string) (*operator, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("token is not a signed JWT")
+	}
+
+	var header jwtHeader
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return nil, fmt.Errorf("invalid header: %s", err)
+	}
+
+	key, ok := a.keys[header.Kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key '%s'", header.Kid)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature encoding: %s", err)
+	}
+	err = verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], signature)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims jwtClaims
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return nil, fmt.Errorf("invalid claims: %s", err)
+	}
+	err = a.checkClaims(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	op := &operator{Subject: claims.Subject, Tenant: claims.Tenant, Fleet: claims.Fleet, permissions: make(map[string]bool)}
+	for _, scope := range strings.Fields(claims.Scope) {
+		op.permissions[scope] = true
+	}
+	for _, role := range claims.Roles {
+		op.permissions[role] = true
+	}
+	return op, nil
+}
+
+func (a *jwtAuthenticator) checkClaims(claims jwtClaims) error {
+	now := a.clock.Now()
+	if claims.ExpiresAt == 0 || now.After(time.Unix(claims.ExpiresAt, 0).Add(jwtLeeway)) {
+		return errors.New("token expired or without expiry")
+	}
+	if claims.NotBefore != 0 && now.Add(jwtLeeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return errors.New("token not valid yet")
+	}
+	if a.issuer != "" && claims.Issuer != a.issuer {
+		return fmt.Errorf("unexpected issuer '%s'", claims.Issuer)
+	}
+	if a.audience != "" && !containsString(claims.Audience, a.audience) {
+		return fmt.Errorf("token not meant for audience '%s'", a.audience)
+	}
+	if claims.Tenant != "" {
+		return checkTenantName(claims.Tenant)
+	}
+	return nil
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm '%s'", alg)
+	}
+	hasher := hash.New()
+	hasher.Write([]byte(signed))
+	digest := hasher.Sum(nil)
+
+	switch publicKey := key.(type) {
+	case *rsa.PublicKey:
+		if alg[0] != 'R' {
+			return fmt.Errorf("algorithm '%s' does not match RSA key", alg)
+		}
+		if rsa.VerifyPKCS1v15(publicKey, hash, digest, signature) != nil {
+			return errors.New("invalid signature")
+		}
+	case *ecdsa.PublicKey:
+		size := (publicKey.Curve.Params().BitSize + 7) / 8
+		if alg[0] != 'E' || len(signature) != 2*size {
+			return fmt.Errorf("algorithm '%s' does not match EC key", alg)
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(publicKey, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+	default:
+		return errors.New("unsupported key")
+	}
+	return nil
+}
+
+func decodeSegment(segment string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
+// require rejects requests not authenticated as a drone or as an operator
+// holding one of the scopes. A nil authenticator leaves routes open.
+func (a *jwtAuthenticator) require(scopes []string, next http.HandlerFunc) http.HandlerFunc {
+	if a == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		if _, ok := authenticatedDrone(req); ok {
+			next(w, req)
+			return
+		}
+
+		op, ok := authenticatedOperator(req)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeProblem(w, req, newProblem(problemUnauthorized, http.StatusUnauthorized, "Authentication required."))
+			return
+		}
+		if !op.allowed(scopes) {
+			p := newProblem(problemForbidden, http.StatusForbidden, "Missing scope.")
+			p.Detail = fmt.Sprintf("Requires one of: %s, %s.", strings.Join(scopes, ", "), scopeFleetAdmin)
+			writeProblem(w, req, p)
+			return
+		}
+		next(w, req)
+	}
+}
+
+// authenticatedOperator returns the operator that sent the request, if any.
+func authenticatedOperator(req *http.Request) (*operator, bool) {
+	op, ok := req.Context().Value(authenticatedOperatorKey).(*operator)
+	return op, ok
+}
+
+func resolveJWTAuthenticator() *jwtAuthenticator {
+	path := os.Getenv("JWKS_FILE")
+	if path == "" {
+		return nil
+	}
+
+	keys, err := loadJWKS(path)
+	failOnError(err, "Failed to load JWKS")
+
+	authenticator := newJWTAuthenticator(keys, systemClock{})
+	authenticator.issuer = os.Getenv("JWT_ISSUER")
+	authenticator.audience = os.Getenv("JWT_AUDIENCE")
+	fmt.Printf("Authenticating operators with %d key(s) from '%s'\n", len(keys), path)
+	return authenticator
+}
@@ -0,0 +1,225 @@
+package service
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/codegangsta/negroni"
+	"github.com/gorilla/mux"
+	"github.com/maxsuelmarinho/golang-event-driven-example/drones-cmds/fakes"
+	dronescommon "github.com/maxsuelmarinho/golang-event-driven-example/drones-common"
+)
+
+var (
+	rsaTestKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	ecTestKey, _  = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+)
+
+func encodeSegment(value interface{}) string {
+	data, _ := json.Marshal(value)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func signJWT(kid string, alg string, claims map[string]interface{}) string {
+	signed := encodeSegment(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + encodeSegment(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	if alg == "ES256" {
+		r, s, _ := ecdsa.Sign(rand.Reader, ecTestKey, digest[:])
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	} else {
+		signature, _ = rsa.SignPKCS1v15(rand.Reader, rsaTestKey, crypto.SHA256, digest[:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func writeTestJWKS(t *testing.T) string {
+	encode := func(value *big.Int) string { return base64.RawURLEncoding.EncodeToString(value.Bytes()) }
+	jwks := map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa1", "n": encode(rsaTestKey.N), "e": encode(big.NewInt(int64(rsaTestKey.E)))},
+		{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": encode(ecTestKey.X), "y": encode(ecTestKey.Y)},
+	}}
+	file, _ := ioutil.TempFile("", "jwks")
+	json.NewEncoder(file).Encode(jwks)
+	file.Close()
+	return file.Name()
+}
+
+func makeOperatorServer(t *testing.T, dispatcher queueDispatcher) *negroni.Negroni {
+	path := writeTestJWKS(t)
+	defer os.Remove(path)
+	keys, err := loadJWKS(path)
+	if err != nil {
+		t.Fatalf("Failed to load JWKS: %s", err)
+	}
+
+	operators := newJWTAuthenticator(keys, &fakes.FakeClock{Time: signedAt})
+	operators.audience = "drones-cmds"
+	dispatchers := make(map[string]queueDispatcher)
+	for _, queueName := range defaultCommands.queues() {
+		dispatchers[queueName] = dispatcher
+	}
+
+	drones := newDroneRegistry(systemClock{})
+	drones.put(droneRecord{DroneID: "drone1", FleetID: "crop-sprayers", Status: droneActive})
+	drones.put(droneRecord{DroneID: "drone8", FleetID: "delivery", Status: droneActive})
+	rules := newDefaultRulesEngine()
+	rules.fleets = drones
+
+	mx := mux.NewRouter()
+	initRoutes(mx, formatter, NewLRUIdempotencyStore(100, time.Minute), rules, newTimestamper(systemClock{}), operators, nil, defaultCommands, dispatchers)
+
+	server := negroni.New()
+	server.Use(operators)
+	server.Use(newDroneAuthenticator(map[string]string{"drone1": "secret1"}, &fakes.FakeClock{Time: signedAt}))
+	server.UseHandler(mx)
+	return server
+}
+
+func operatorClaims(scope string) map[string]interface{} {
+	return map[string]interface{}{
+		"sub": "ground-control", "aud": []string{"drones-cmds"}, "exp": signedAt.Unix() + 60,
+		"scope": scope, "tenant": "acme", "fleet": "crop-sprayers",
+	}
+}
+
+func postAsOperator(server http.Handler, token string, path string, body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	server.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestOperatorTokenGrantsScopedRoutes(t *testing.T) {
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	server := makeOperatorServer(t, dispatcher)
+
+	for _, alg := range []string{"RS256", "ES256"} {
+		kid := map[string]string{"RS256": "rsa1", "ES256": "ec1"}[alg]
+		token := signJWT(kid, alg, operatorClaims("drone:write"))
+
+		recorder := postAsOperator(server, token, "/api/cmds/telemetry", `{"drone_id": "drone7", "uptime": 10}`)
+		if recorder.Code != http.StatusCreated {
+			t.Errorf("Expected %s token with drone:write to send telemetry, got %d: %s", alg, recorder.Code, recorder.Body.String())
+		}
+
+		recorder = postAsOperator(server, token, "/api/cmds/alerts", `{"drone_id": "drone7", "description": "x"}`)
+		if recorder.Code != http.StatusForbidden {
+			t.Errorf("Expected %s token without alerts:write to be forbidden alerts, got %d", alg, recorder.Code)
+		}
+	}
+
+	envelope := dispatcher.Messages[0].(dronescommon.EventEnvelope)
+	if envelope.TenantID != "acme" || envelope.FleetID != "crop-sprayers" {
+		t.Errorf("Expected tenant and fleet claims in the event, got %+v", envelope)
+	}
+
+	admin := signJWT("rsa1", "RS256", operatorClaims("fleet:admin"))
+	if recorder := postAsOperator(server, admin, "/api/cmds/alerts", `{"drone_id": "drone7", "description": "x"}`); recorder.Code != http.StatusCreated {
+		t.Errorf("Expected fleet:admin to send alerts, got %d", recorder.Code)
+	}
+}
+
+func TestOperatorIsConfinedToItsFleet(t *testing.T) {
+	server := makeOperatorServer(t, fakes.NewFakeQueueDispatcher())
+	token := signJWT("rsa1", "RS256", operatorClaims("drone:write"))
+
+	recorder := postAsOperator(server, token, "/api/cmds/positions", `{"drone_id": "drone7", "fleet_id": "delivery"}`)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected position of another fleet to be forbidden, got %d", recorder.Code)
+	}
+
+	batch := `[{"type": "alert", "drone_id": "drone7", "description": "x"}, {"type": "telemetry", "drone_id": "drone7", "uptime": 1}]`
+	recorder = postAsOperator(server, token, "/api/cmds/batch", batch)
+	var report batchReport
+	json.Unmarshal(recorder.Body.Bytes(), &report)
+	if recorder.Code != http.StatusMultiStatus || report.Items[0].Status != http.StatusForbidden || report.Items[1].Status != http.StatusCreated {
+		t.Errorf("Expected batch items to need the scope of their type, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestCommandsAreConfinedToTheFleetOfTheDrone(t *testing.T) {
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	server := makeOperatorServer(t, dispatcher)
+	token := signJWT("rsa1", "RS256", operatorClaims("fleet:admin"))
+
+	for path, body := range map[string]string{
+		"/api/cmds/telemetry": `{"drone_id": "drone8", "uptime": 10}`,
+		"/api/cmds/alerts":    `{"drone_id": "drone8", "description": "x"}`,
+		"/api/cmds/batch":     `[{"type": "telemetry", "drone_id": "drone8", "uptime": 1}]`,
+	} {
+		recorder := postAsOperator(server, token, path, body)
+		var report batchReport
+		json.Unmarshal(recorder.Body.Bytes(), &report)
+		if recorder.Code != http.StatusForbidden && (len(report.Items) != 1 || report.Items[0].Status != http.StatusForbidden) {
+			t.Errorf("Expected %s for a drone of another fleet to be forbidden, got %d: %s", path, recorder.Code, recorder.Body.String())
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, signedRequest("drone1", "secret1", "/api/cmds/telemetry", `{"drone_id": "drone1", "uptime": 10}`, "n1", signedAt))
+	if recorder.Code != http.StatusCreated || len(dispatcher.Messages) != 1 {
+		t.Fatalf("Expected drone to send its own telemetry, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if envelope := dispatcher.Messages[0].(dronescommon.EventEnvelope); envelope.FleetID != "crop-sprayers" {
+		t.Errorf("Expected event of a signed request to carry the fleet of the drone, got '%s'", envelope.FleetID)
+	}
+}
+
+func TestInvalidOperatorTokensAreRejected(t *testing.T) {
+	server := makeOperatorServer(t, fakes.NewFakeQueueDispatcher())
+	body := `{"drone_id": "drone7", "uptime": 10}`
+
+	expired := operatorClaims("drone:write")
+	expired["exp"] = signedAt.Unix() - 3600
+	otherAudience := operatorClaims("drone:write")
+	otherAudience["aud"] = "billing"
+	escapingTenant := operatorClaims("drone:write")
+	escapingTenant["tenant"] = "../acme"
+	valid := signJWT("rsa1", "RS256", operatorClaims("drone:write"))
+
+	for name, token := range map[string]string{
+		"expired":        signJWT("rsa1", "RS256", expired),
+		"other audience": signJWT("rsa1", "RS256", otherAudience),
+		"invalid tenant": signJWT("rsa1", "RS256", escapingTenant),
+		"unknown key":    signJWT("rsa9", "RS256", operatorClaims("drone:write")),
+		"wrong alg":      signJWT("ec1", "RS256", operatorClaims("drone:write")),
+		"tampered":       valid[:len(valid)-4] + "AAAA",
+		"none":           encodeSegment(map[string]string{"alg": "none", "kid": "rsa1"}) + "." + encodeSegment(operatorClaims("fleet:admin")) + ".",
+	} {
+		if recorder := postAsOperator(server, token, "/api/cmds/telemetry", body); recorder.Code != http.StatusUnauthorized {
+			t.Errorf("Expected %s token to be rejected, got %d", name, recorder.Code)
+		}
+	}
+
+	if recorder := postAsOperator(server, "", "/api/cmds/telemetry", body); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected request without credentials to be rejected, got %d", recorder.Code)
+	}
+}
+
+func TestSignedDroneRequestPassesScopeChecks(t *testing.T) {
+	server := makeOperatorServer(t, fakes.NewFakeQueueDispatcher())
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, signedRequest("drone1", "secret1", "/api/cmds/alerts", `{"drone_id": "drone1", "description": "x"}`, "n1", signedAt))
+	if recorder.Code != http.StatusCreated {
+		t.Errorf("Expected signed drone request to be accepted, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
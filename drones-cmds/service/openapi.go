@@ -0,0 +1,755 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	dronescommon "github.com/maxsuelmarinho/golang-event-driven-example/drones-common"
+	"github.com/unrolled/render"
+)
+
+const (
+	openAPIVersion = "3.0.3"
+	apiVersion     = "1.0.0"
+
+	openAPIRoute  = "/api/cmds/openapi.json"
+	healthRoute   = "/api/cmds/health"
+	batchRoute    = "/api/cmds/batch"
+	problemSchema = "#/components/schemas/Problem"
+
+	codeInvalidValue = "invalid_value"
+)
+
+type openAPIDocument struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       openAPIInfo                             `json:"info"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components openAPIComponents                       `json:"components"`
+}
+
+type openAPIInfo struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+type openAPIComponents struct {
+	Schemas         map[string]*openAPISchema         `json:"schemas"`
+	SecuritySchemes map[string]*openAPISecurityScheme `json:"securitySchemes"`
+}
+
+type openAPISecurityScheme struct {
+	Type         string `json:"type"`
+	Description  string `json:"description,omitempty"`
+	Scheme       string `json:"scheme,omitempty"`
+	BearerFormat string `json:"bearerFormat,omitempty"`
+	In           string `json:"in,omitempty"`
+	Name         string `json:"name,omitempty"`
+}
+
+type openAPIOperation struct {
+	OperationID string                      `json:"operationId"`
+	Summary     string                      `json:"summary"`
+	RequestBody *openAPIRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*openAPIResponse `json:"responses"`
+	Security    []map[string][]string       `json:"security,omitempty"`
+}
+
+type openAPIRequestBody struct {
+	Required bool                        `json:"required"`
+	Content  map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIMediaType struct {
+	Schema *openAPISchema `json:"schema"`
+}
+
+type openAPISchema struct {
+	Ref         string                    `json:"$ref,omitempty"`
+	Type        string                    `json:"type,omitempty"`
+	Format      string                    `json:"format,omitempty"`
+	Description string                    `json:"description,omitempty"`
+	Properties  map[string]*openAPISchema `json:"properties,omitempty"`
+	Required    []string                  `json:"required,omitempty"`
+	Items       *openAPISchema            `json:"items,omitempty"`
+	OneOf       []*openAPISchema          `json:"oneOf,omitempty"`
+	Enum        []string                  `json:"enum,omitempty"`
+	Minimum     *float64                  `json:"minimum,omitempty"`
+	Maximum     *float64                  `json:"maximum,omitempty"`
+	Pattern     string                    `json:"pattern,omitempty"`
+}
+
+// buildOpenAPIDocument describes the routes of the registered commands. The
+// command schemas carry the current validation rules; fleet rules are not
+// part of the document.
+func buildOpenAPIDocument(registry *commandRegistry, rules *rulesEngine) *openAPIDocument {
+	doc := &openAPIDocument{
+		OpenAPI: openAPIVersion,
+		Info: openAPIInfo{
+			Title:       "Drones Commands API",
+			Description: "Accepts drone commands and dispatches them as events. Fleets may narrow the ranges documented here.",
+			Version:     apiVersion,
+		},
+		Paths:      make(map[string]map[string]*openAPIOperation),
+		Components: openAPIComponents{Schemas: commonSchemas(), SecuritySchemes: securitySchemes()},
+	}
+
+	names := make([]string, 0)
+	for _, definition := range registry.all() {
+		schemaName := commandSchemaName(definition.Name)
+		doc.Components.Schemas[schemaName] = commandSchema(definition, rules.rulesFor(definition.Name, ""))
+		names = append(names, definition.Name)
+
+		doc.Paths[definition.Route] = map[string]*openAPIOperation{
+			"post": {
+				OperationID: "add" + strings.Title(definition.Name),
+				Summary:     fmt.Sprintf("Dispatches a %s event to the '%s' queue.", definition.EventType, definition.Queue),
+				RequestBody: jsonRequestBody(&openAPISchema{Ref: "#/components/schemas/" + schemaName}),
+				Responses: map[string]*openAPIResponse{
+					"201": {Description: "The dispatched event.", Content: jsonContent("application/json", &openAPISchema{Type: "object"})},
+					"400": problemResponse("The command is malformed or invalid."),
+					"401": problemResponse("The request is not signed by a known drone, when drones are authenticated."),
+					"403": problemResponse("The command is about another drone than the one that signed it."),
+					"409": problemResponse("A request with the same idempotency key is in progress."),
+					"422": problemResponse("The idempotency key was used with a different request."),
+					"503": problemResponse("The event could not be dispatched."),
+				},
+				Security: commandSecurity(definition.Scopes),
+			},
+		}
+	}
+
+	doc.Paths[batchRoute] = map[string]*openAPIOperation{
+		"post": {
+			OperationID: "addBatch",
+			Summary:     "Dispatches a JSON array or an NDJSON stream of commands tagged with their type.",
+			RequestBody: jsonRequestBody(&openAPISchema{
+				Type: "array",
+				Items: &openAPISchema{
+					Type:       "object",
+					Properties: map[string]*openAPISchema{"type": {Type: "string", Enum: names}},
+					Required:   []string{"type"},
+				},
+			}),
+			Responses: map[string]*openAPIResponse{
+				"201": {Description: "Every command was dispatched.", Content: jsonContent("application/json", &openAPISchema{Ref: "#/components/schemas/BatchReport"})},
+				"207": {Description: "Some commands were rejected.", Content: jsonContent("application/json", &openAPISchema{Ref: "#/components/schemas/BatchReport"})},
+				"400": problemResponse("The batch is malformed."),
+				"401": problemResponse("The request is not signed by a known drone, when drones are authenticated."),
+				"413": problemResponse(fmt.Sprintf("The batch exceeds %d items.", maxBatchItems)),
+			},
+			Security: commandSecurity(registry.scopes()),
+		},
+	}
+	addFleetPaths(doc, registry)
+	addDroneRegistryPaths(doc)
+	addDeadLetterPaths(doc)
+	doc.Paths[healthRoute] = map[string]*openAPIOperation{
+		"get": {
+			OperationID: "health",
+			Summary:     "Reports the state of the broker connection.",
+			Responses: map[string]*openAPIResponse{
+				"200": {Description: "The broker is connected.", Content: jsonContent("application/json", &openAPISchema{Type: "object"})},
+				"503": {Description: "The broker is disconnected.", Content: jsonContent("application/json", &openAPISchema{Type: "object"})},
+			},
+		},
+	}
+	doc.Paths[openAPIRoute] = map[string]*openAPIOperation{
+		"get": {
+			OperationID: "openAPI",
+			Summary:     "Returns this document.",
+			Responses: map[string]*openAPIResponse{
+				"200": {Description: "The OpenAPI document.", Content: jsonContent("application/json", &openAPISchema{Type: "object"})},
+			},
+		},
+	}
+	return doc
+}
+
+// addFleetPaths documents the fleet-scoped variants of the command routes,
+// which add the tenant checks to the operations they mirror.
+func addFleetPaths(doc *openAPIDocument, registry *commandRegistry) {
+	routes := []string{batchRoute}
+	for _, definition := range registry.all() {
+		routes = append(routes, definition.Route)
+	}
+
+	for _, route := range routes {
+		operation := *doc.Paths[route]["post"]
+		operation.OperationID += "ForFleet"
+		operation.Summary += " Scoped to the fleet of the route."
+		operation.Responses = make(map[string]*openAPIResponse)
+		for status, response := range doc.Paths[route]["post"].Responses {
+			operation.Responses[status] = response
+		}
+		operation.Responses["403"] = problemResponse("The command or operator belongs to another fleet or tenant.")
+		operation.Responses["404"] = problemResponse("The fleet belongs to no tenant, when tenants are configured.")
+		operation.Responses["429"] = problemResponse("The tenant exceeded its request quota.")
+		doc.Paths[fleetRoute(route)] = map[string]*openAPIOperation{"post": &operation}
+	}
+}
+
+func addDroneRegistryPaths(doc *openAPIDocument) {
+	registration := &openAPISchema{Type: "object", Properties: make(map[string]*openAPISchema), Required: []string{"drone_id", "model", "owner"}}
+	addFieldSchemas(registration, reflect.TypeOf(registerDroneCommand{}))
+	record := &openAPISchema{Type: "object", Properties: make(map[string]*openAPISchema)}
+	addFieldSchemas(record, reflect.TypeOf(droneRecord{}))
+	decommission := &openAPISchema{Type: "object", Properties: make(map[string]*openAPISchema)}
+	addFieldSchemas(decommission, reflect.TypeOf(decommissionDroneCommand{}))
+	doc.Components.Schemas["DroneRegistration"] = registration
+	doc.Components.Schemas["DroneRecord"] = record
+	doc.Components.Schemas["DroneDecommission"] = decommission
+
+	recordContent := jsonContent("application/json", &openAPISchema{Ref: "#/components/schemas/DroneRecord"})
+	admin := []map[string][]string{{"operatorToken": {scopeFleetAdmin}}}
+	doc.Paths[dronesRoute] = map[string]*openAPIOperation{
+		"post": {
+			OperationID: "registerDrone",
+			Summary:     fmt.Sprintf("Registers a drone, dispatching a %s event.", dronescommon.DroneRegisteredEventType),
+			RequestBody: jsonRequestBody(&openAPISchema{Ref: "#/components/schemas/DroneRegistration"}),
+			Responses: map[string]*openAPIResponse{
+				"201": {Description: "The registered drone.", Content: recordContent},
+				"400": problemResponse("The registration is malformed or invalid."),
+				"403": problemResponse("The fleet is not the operator's or not of their tenant."),
+				"409": problemResponse("The drone is already registered."),
+				"503": problemResponse("The event could not be dispatched."),
+			},
+			Security: admin,
+		},
+	}
+	doc.Paths[droneRoute] = map[string]*openAPIOperation{
+		"get": {
+			OperationID: "getDrone",
+			Summary:     "Returns a registered drone.",
+			Responses: map[string]*openAPIResponse{
+				"200": {Description: "The drone.", Content: recordContent},
+				"404": problemResponse("The drone is not registered, or not of the tenant and fleet of the operator."),
+			},
+			Security: admin,
+		},
+		"put": {
+			OperationID: "updateDrone",
+			Summary:     fmt.Sprintf("Updates the metadata of an active drone, dispatching a %s event.", dronescommon.DroneRegisteredEventType),
+			RequestBody: jsonRequestBody(&openAPISchema{Ref: "#/components/schemas/DroneRegistration"}),
+			Responses: map[string]*openAPIResponse{
+				"200": {Description: "The updated drone.", Content: recordContent},
+				"403": problemResponse("The fleet is not the operator's or not of their tenant."),
+				"404": problemResponse("The drone is not registered, or not of the tenant and fleet of the operator."),
+				"409": problemResponse("The drone is decommissioned."),
+				"503": problemResponse("The event could not be dispatched."),
+			},
+			Security: admin,
+		},
+	}
+	doc.Paths[droneDecommissionRoute] = map[string]*openAPIOperation{
+		"post": {
+			OperationID: "decommissionDrone",
+			Summary:     fmt.Sprintf("Decommissions an active drone, dispatching a %s event.", dronescommon.DroneDecommissionedEventType),
+			RequestBody: &openAPIRequestBody{Content: jsonContent("application/json", &openAPISchema{Ref: "#/components/schemas/DroneDecommission"})},
+			Responses: map[string]*openAPIResponse{
+				"200": {Description: "The decommissioned drone.", Content: recordContent},
+				"404": problemResponse("The drone is not registered, or not of the tenant and fleet of the operator."),
+				"409": problemResponse("The drone is already decommissioned."),
+				"503": problemResponse("The event could not be dispatched."),
+			},
+			Security: admin,
+		},
+	}
+}
+
+func addDeadLetterPaths(doc *openAPIDocument) {
+	letter := &openAPISchema{Type: "object", Properties: make(map[string]*openAPISchema)}
+	addFieldSchemas(letter, reflect.TypeOf(deadLetter{}))
+	doc.Components.Schemas["DeadLetter"] = letter
+
+	letterContent := jsonContent("application/json", &openAPISchema{Ref: "#/components/schemas/DeadLetter"})
+	admin := []map[string][]string{{"operatorToken": {scopeFleetAdmin}}}
+	missing := problemResponse("The queue has no dead-letter queue, or the message is not in it.")
+	unavailable := problemResponse("The broker is unavailable.")
+	doc.Paths[deadLettersRoute] = map[string]*openAPIOperation{
+		"get": {
+			OperationID: "listDeadLetters",
+			Summary:     fmt.Sprintf("Lists up to 'limit' (default %d) messages of the dead-letter queue of a queue.", defaultDeadLetterLimit),
+			Responses: map[string]*openAPIResponse{
+				"200": {Description: "The dead letters, oldest first.", Content: jsonContent("application/json", &openAPISchema{Type: "array", Items: &openAPISchema{Ref: "#/components/schemas/DeadLetter"}})},
+				"404": problemResponse("The queue has no dead-letter queue."),
+				"503": unavailable,
+			},
+			Security: admin,
+		},
+	}
+	doc.Paths[deadLetterRoute] = map[string]*openAPIOperation{
+		"get": {
+			OperationID: "inspectDeadLetter",
+			Summary:     "Returns a dead-lettered message with its decoded event.",
+			Responses:   map[string]*openAPIResponse{"200": {Description: "The dead letter.", Content: letterContent}, "404": missing, "503": unavailable},
+			Security:    admin,
+		},
+		"delete": {
+			OperationID: "discardDeadLetter",
+			Summary:     "Drops a dead-lettered message.",
+			Responses:   map[string]*openAPIResponse{"200": {Description: "The discarded dead letter.", Content: letterContent}, "404": missing, "503": unavailable},
+			Security:    admin,
+		},
+	}
+	doc.Paths[deadLetterRequeueRoute] = map[string]*openAPIOperation{
+		"post": {
+			OperationID: "requeueDeadLetter",
+			Summary:     "Publishes a dead-lettered message again where it was first published.",
+			Responses:   map[string]*openAPIResponse{"200": {Description: "The requeued dead letter.", Content: letterContent}, "404": missing, "503": unavailable},
+			Security:    admin,
+		},
+	}
+}
+
+// commandSchema describes the JSON fields of a command, taken from the
+// struct tags of its type, constrained by its rules.
+func commandSchema(definition commandDefinition, rules *commandRules) *openAPISchema {
+	schema := &openAPISchema{Type: "object", Properties: make(map[string]*openAPISchema)}
+	addFieldSchemas(schema, reflect.TypeOf(definition.NewCommand()))
+	if rules == nil {
+		return schema
+	}
+
+	schema.Required = append(schema.Required, rules.Required...)
+	for field, limits := range rules.Ranges {
+		if property, ok := schema.Properties[field]; ok {
+			property.Minimum = limits.Min
+			property.Maximum = limits.Max
+			if limits.Unit != "" {
+				property.Description = "Unit: " + limits.Unit + "."
+			}
+			if limits.Reference != "" {
+				property.Description = strings.TrimSpace(property.Description + " Reference: " + strings.ToUpper(limits.Reference) + ".")
+			}
+			if len(limits.References) > 0 {
+				describeReferences(property, field, limits)
+				if declared, ok := schema.Properties[field+referenceSuffix]; ok {
+					declared.Enum = limits.references()
+				}
+			}
+		}
+	}
+	for field, pattern := range rules.Patterns {
+		if property, ok := schema.Properties[field]; ok {
+			property.Pattern = pattern
+		}
+	}
+
+	checks := make([]string, 0, len(rules.CrossField))
+	for _, rule := range rules.CrossField {
+		check := rule.message()
+		if rule.When != nil {
+			check = fmt.Sprintf("%s (when %s %s %v)", check, rule.When.Field, rule.When.Operator, rule.When.Value)
+		}
+		checks = append(checks, check)
+	}
+	if len(checks) > 0 {
+		schema.Description = strings.Join(checks, "; ") + "."
+	}
+	return schema
+}
+
+// describeReferences widens the bounds of a field to those of every
+// reference and tells which hold for each one.
+func describeReferences(property *openAPISchema, field string, limits rangeRule) {
+	bounds := make([]string, 0, len(limits.References)+1)
+	for _, reference := range limits.references() {
+		reference, _ := limits.forReference(reference)
+		if reference.Min == nil || (property.Minimum != nil && *reference.Min < *property.Minimum) {
+			property.Minimum = reference.Min
+		}
+		if reference.Max == nil || (property.Maximum != nil && *reference.Max > *property.Maximum) {
+			property.Maximum = reference.Max
+		}
+		bounds = append(bounds, strings.TrimPrefix(reference.describe(), "must be "))
+	}
+	property.Description = fmt.Sprintf("Depending on %s%s: %s.", field, referenceSuffix, strings.Join(bounds, " or "))
+}
+
+// addFieldSchemas adds the JSON fields of a struct, flattening embedded
+// structs the way encoding/json does.
+func addFieldSchemas(schema *openAPISchema, structType reflect.Type) {
+	for structType.Kind() == reflect.Ptr {
+		structType = structType.Elem()
+	}
+
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			addFieldSchemas(schema, field.Type)
+			continue
+		}
+		if field.PkgPath != "" || name == "" || name == "-" {
+			continue
+		}
+		schema.Properties[name] = fieldSchema(field.Type)
+	}
+}
+
+func fieldSchema(fieldType reflect.Type) *openAPISchema {
+	for fieldType.Kind() == reflect.Ptr {
+		fieldType = fieldType.Elem()
+	}
+	if fieldType == reflect.TypeOf(time.Time{}) {
+		return &openAPISchema{Type: "string", Format: "date-time"}
+	}
+	if fieldType == reflect.TypeOf(observedTime{}) {
+		return &openAPISchema{
+			Description: "RFC 3339 time or Unix time in milliseconds.",
+			OneOf:       []*openAPISchema{{Type: "string", Format: "date-time"}, {Type: "integer", Format: "int64"}},
+		}
+	}
+
+	switch fieldType.Kind() {
+	case reflect.String:
+		return &openAPISchema{Type: "string"}
+	case reflect.Bool:
+		return &openAPISchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &openAPISchema{Type: "integer", Format: "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return &openAPISchema{Type: "integer", Format: "int64"}
+	case reflect.Float32:
+		return &openAPISchema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &openAPISchema{Type: "number", Format: "double"}
+	case reflect.Slice, reflect.Array:
+		return &openAPISchema{Type: "array", Items: fieldSchema(fieldType.Elem())}
+	}
+	return &openAPISchema{Type: "object"}
+}
+
+func commonSchemas() map[string]*openAPISchema {
+	return map[string]*openAPISchema{
+		"FieldError": {
+			Type: "object",
+			Properties: map[string]*openAPISchema{
+				"field":   {Type: "string"},
+				"code":    {Type: "string"},
+				"message": {Type: "string"},
+			},
+		},
+		"Problem": {
+			Type: "object",
+			Properties: map[string]*openAPISchema{
+				"type":        {Type: "string"},
+				"title":       {Type: "string"},
+				"status":      {Type: "integer"},
+				"detail":      {Type: "string"},
+				"instance":    {Type: "string"},
+				"errors":      {Type: "array", Items: &openAPISchema{Ref: "#/components/schemas/FieldError"}},
+				"retry_after": {Type: "integer"},
+			},
+			Required: []string{"type", "title", "status"},
+		},
+		"BatchReport": {
+			Type: "object",
+			Properties: map[string]*openAPISchema{
+				"accepted": {Type: "integer"},
+				"rejected": {Type: "integer"},
+				"items": {Type: "array", Items: &openAPISchema{
+					Type: "object",
+					Properties: map[string]*openAPISchema{
+						"index":    {Type: "integer"},
+						"type":     {Type: "string"},
+						"status":   {Type: "integer"},
+						"event_id": {Type: "string"},
+						"error":    {Type: "string"},
+						"errors":   {Type: "array", Items: &openAPISchema{Ref: "#/components/schemas/FieldError"}},
+					},
+				}},
+			},
+		},
+	}
+}
+
+// securitySchemes describes how drones and operators authenticate, when
+// authentication is enabled.
+func securitySchemes() map[string]*openAPISecurityScheme {
+	return map[string]*openAPISecurityScheme{
+		"operatorToken": {
+			Type:         "http",
+			Scheme:       "bearer",
+			BearerFormat: "JWT",
+			Description:  fmt.Sprintf("Operator token carrying scopes or roles; %s grants every command.", scopeFleetAdmin),
+		},
+		"droneSignature": {
+			Type: "apiKey",
+			In:   "header",
+			Name: droneSignatureHeader,
+			Description: fmt.Sprintf("Hex HMAC-SHA256 with the drone secret of the method, path, %s, %s and hex SHA-256 of the body, one per line; sent along with %s.",
+				droneTimestampHeader, droneNonceHeader, droneIDHeader),
+		},
+	}
+}
+
+func commandSecurity(scopes []string) []map[string][]string {
+	return []map[string][]string{{"operatorToken": scopes}, {"droneSignature": {}}}
+}
+
+func commandSchemaName(commandName string) string {
+	return strings.Title(commandName) + "Command"
+}
+
+func jsonRequestBody(schema *openAPISchema) *openAPIRequestBody {
+	return &openAPIRequestBody{Required: true, Content: jsonContent("application/json", schema)}
+}
+
+func jsonContent(contentType string, schema *openAPISchema) map[string]openAPIMediaType {
+	return map[string]openAPIMediaType{contentType: {Schema: schema}}
+}
+
+func problemResponse(description string) *openAPIResponse {
+	return &openAPIResponse{Description: description, Content: jsonContent(problemContentType, &openAPISchema{Ref: problemSchema})}
+}
+
+// resolve follows a reference to a component schema.
+func (doc *openAPIDocument) resolve(schema *openAPISchema) *openAPISchema {
+	for schema != nil && schema.Ref != "" {
+		schema = doc.Components.Schemas[strings.TrimPrefix(schema.Ref, "#/components/schemas/")]
+	}
+	return schema
+}
+
+// requestSchema returns the JSON body schema of an operation, if any. Paths
+// match templated routes like /api/fleets/{fleet}/cmds/telemetry.
+func (doc *openAPIDocument) requestSchema(path string, method string) *openAPISchema {
+	operations, ok := doc.Paths[path]
+	for template, templated := range doc.Paths {
+		if ok {
+			break
+		}
+		if matchPathTemplate(template, path) {
+			operations, ok = templated, true
+		}
+	}
+	operation := operations[strings.ToLower(method)]
+	if operation == nil || operation.RequestBody == nil {
+		return nil
+	}
+	return doc.resolve(operation.RequestBody.Content["application/json"].Schema)
+}
+
+func matchPathTemplate(template string, path string) bool {
+	templateSegments := strings.Split(template, "/")
+	pathSegments := strings.Split(path, "/")
+	if len(templateSegments) != len(pathSegments) {
+		return false
+	}
+	for index, segment := range templateSegments {
+		isParameter := strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+		if segment != pathSegments[index] && !(isParameter && pathSegments[index] != "") {
+			return false
+		}
+	}
+	return true
+}
+
+// validate reports where a decoded JSON value departs from a schema.
+func (doc *openAPIDocument) validate(schema *openAPISchema, value interface{}, path string) (errs []fieldError) {
+	schema = doc.resolve(schema)
+	if schema == nil || value == nil {
+		return nil
+	}
+	if len(schema.OneOf) > 0 {
+		types := make([]string, 0, len(schema.OneOf))
+		for _, alternative := range schema.OneOf {
+			if len(doc.validate(alternative, value, path)) == 0 {
+				return nil
+			}
+			types = append(types, alternative.Type)
+		}
+		return []fieldError{invalidTypeField(path, "a "+strings.Join(types, " or "))}
+	}
+
+	switch schema.Type {
+	case "object":
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			return []fieldError{invalidTypeField(path, "an object")}
+		}
+		for _, field := range schema.Required {
+			if _, ok := fields[field]; !ok {
+				errs = append(errs, requiredField(joinFieldPath(path, field)))
+			}
+		}
+		names := make([]string, 0, len(schema.Properties))
+		for name := range schema.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			errs = append(errs, doc.validate(schema.Properties[name], fields[name], joinFieldPath(path, name))...)
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return []fieldError{invalidTypeField(path, "an array")}
+		}
+		for index, item := range items {
+			errs = append(errs, doc.validate(schema.Items, item, fmt.Sprintf("%s[%d]", path, index))...)
+		}
+	case "string":
+		text, ok := value.(string)
+		if !ok {
+			return []fieldError{invalidTypeField(path, "a string")}
+		}
+		if schema.Pattern != "" {
+			if matched, _ := regexp.MatchString(schema.Pattern, text); !matched {
+				errs = append(errs, fieldError{Field: path, Code: codePattern, Message: fmt.Sprintf("%s must match %s", path, schema.Pattern)})
+			}
+		}
+		if len(schema.Enum) > 0 && !containsString(schema.Enum, text) {
+			errs = append(errs, fieldError{Field: path, Code: codeInvalidValue, Message: fmt.Sprintf("%s must be one of %s", path, strings.Join(schema.Enum, ", "))})
+		}
+	case "integer", "number":
+		number, ok := value.(float64)
+		if !ok || (schema.Type == "integer" && number != math.Trunc(number)) {
+			return []fieldError{invalidTypeField(path, "an "+schema.Type)}
+		}
+		if (schema.Minimum != nil && number < *schema.Minimum) || (schema.Maximum != nil && number > *schema.Maximum) {
+			errs = append(errs, outOfRangeField(path, rangeRule{Min: schema.Minimum, Max: schema.Maximum}.describe()))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return []fieldError{invalidTypeField(path, "a boolean")}
+		}
+	}
+	return errs
+}
+
+func invalidTypeField(field string, expected string) fieldError {
+	return fieldError{Field: field, Code: codeInvalidType, Message: fmt.Sprintf("%s must be %s", field, expected)}
+}
+
+func joinFieldPath(path string, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+// mountedOn drops the operations the router does not serve, like the drone
+// registry and dead-letter routes when no operators are authenticated.
+func (doc *openAPIDocument) mountedOn(router *mux.Router) *openAPIDocument {
+	mounted := make(map[string]bool)
+	router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, _ := route.GetPathTemplate()
+		methods, _ := route.GetMethods()
+		for _, method := range methods {
+			mounted[strings.ToLower(method)+" "+path] = true
+		}
+		return nil
+	})
+
+	for path, operations := range doc.Paths {
+		for method := range operations {
+			if !mounted[method+" "+path] {
+				delete(operations, method)
+			}
+		}
+		if len(operations) == 0 {
+			delete(doc.Paths, path)
+		}
+	}
+	return doc
+}
+
+// cachedOpenAPIDocument returns the document of the routes mounted on the
+// router, built on first use, once every route is mounted, and again only
+// when the rules were reloaded since.
+func cachedOpenAPIDocument(registry *commandRegistry, rules *rulesEngine, router *mux.Router) func() *openAPIDocument {
+	var (
+		mutex   sync.Mutex
+		doc     *openAPIDocument
+		builtOn *rulesFile
+	)
+	return func() *openAPIDocument {
+		mutex.Lock()
+		defer mutex.Unlock()
+		current := rules.loaded()
+		if doc == nil || builtOn != current {
+			doc = buildOpenAPIDocument(registry, rules).mountedOn(router)
+			builtOn = current
+		}
+		return doc
+	}
+}
+
+func openAPIHandler(formatter *render.Render, document func() *openAPIDocument) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		formatter.JSON(w, http.StatusOK, document())
+	}
+}
+
+// openAPIValidator is a negroni middleware rejecting JSON requests whose
+// body does not match the OpenAPI document. Bodies that are not a single
+// JSON value, like NDJSON batches and structured CloudEvents, are left to
+// the handlers.
+func openAPIValidator(document func() *openAPIDocument) func(http.ResponseWriter, *http.Request, http.HandlerFunc) {
+	return func(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+		contentType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if contentType == dronescommon.CloudEventsContentType || req.Body == nil {
+			next(w, req)
+			return
+		}
+
+		doc := document()
+		schema := doc.requestSchema(req.URL.Path, req.Method)
+		if schema == nil {
+			next(w, req)
+			return
+		}
+
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			writeProblem(w, req, malformedCommandProblem(fmt.Sprintf("Failed to read request: %s", err)))
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		var value interface{}
+		if json.Unmarshal(body, &value) != nil {
+			next(w, req)
+			return
+		}
+
+		errs := doc.validate(schema, value, "")
+		if len(errs) > 0 {
+			p := newProblem(problemInvalidCommand, http.StatusBadRequest, "Request does not match the API specification.")
+			p.Errors = errs
+			writeProblem(w, req, p)
+			return
+		}
+		next(w, req)
+	}
+}
@@ -0,0 +1,171 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codegangsta/negroni"
+	"github.com/gorilla/mux"
+	"github.com/maxsuelmarinho/golang-event-driven-example/drones-cmds/fakes"
+)
+
+func TestOpenAPIDocumentMatchesRoutes(t *testing.T) {
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	dispatchers := make(map[string]queueDispatcher)
+	for _, queueName := range defaultCommands.queues() {
+		dispatchers[queueName] = dispatcher
+	}
+	mx := mux.NewRouter()
+	document := initRoutes(mx, formatter, NewLRUIdempotencyStore(100, time.Minute), newDefaultRulesEngine(), newTimestamper(systemClock{}), nil, nil, defaultCommands, dispatchers)
+	initDroneRoutes(mx, formatter, newJWTAuthenticator(nil, systemClock{}), nil, newDroneRegistry(systemClock{}), dispatchers)
+	mx.HandleFunc(healthRoute, healthHandler(formatter, fakeConnectionHealth{})).Methods("GET")
+	initDeadLetterRoutes(mx, formatter, newJWTAuthenticator(nil, systemClock{}), nil)
+
+	routes := make([]string, 0)
+	mx.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, _ := route.GetPathTemplate()
+		methods, _ := route.GetMethods()
+		for _, method := range methods {
+			routes = append(routes, strings.ToLower(method)+" "+path)
+		}
+		return nil
+	})
+
+	doc := document()
+	if len(doc.Paths) != len(buildOpenAPIDocument(defaultCommands, newDefaultRulesEngine()).Paths) {
+		t.Errorf("Expected every documented route to be mounted, got %d paths", len(doc.Paths))
+	}
+	documented := make([]string, 0)
+	for path, operations := range doc.Paths {
+		for method := range operations {
+			documented = append(documented, method+" "+path)
+		}
+	}
+
+	sort.Strings(routes)
+	sort.Strings(documented)
+	if strings.Join(routes, "\n") != strings.Join(documented, "\n") {
+		t.Errorf("Expected documented operations %v to match routes %v", documented, routes)
+	}
+
+	for _, definition := range defaultCommands.all() {
+		data, _ := json.Marshal(definition.NewCommand())
+		fields := make(map[string]interface{})
+		json.Unmarshal(data, &fields)
+
+		schema := doc.Components.Schemas[commandSchemaName(definition.Name)]
+		for field := range fields {
+			if _, ok := schema.Properties[field]; !ok {
+				t.Errorf("Expected field '%s' of %s command to be documented", field, definition.Name)
+			}
+		}
+	}
+}
+
+func TestOpenAPIDocumentIsServed(t *testing.T) {
+	server := makeTestServer(fakes.NewFakeQueueDispatcher())
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", openAPIRoute, nil)
+	server.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected OpenAPI document to be served, got %d", recorder.Code)
+	}
+
+	var doc openAPIDocument
+	json.Unmarshal(recorder.Body.Bytes(), &doc)
+	position := doc.Components.Schemas["PositionCommand"]
+	if doc.OpenAPI != openAPIVersion || position == nil {
+		t.Fatalf("Expected position command schema, got %s", recorder.Body.String())
+	}
+
+	altitude := position.Properties["altitude"]
+	if altitude.Type != "number" || altitude.Maximum == nil || *altitude.Maximum != 10000 || altitude.Minimum == nil || *altitude.Minimum != -500 {
+		t.Errorf("Expected altitude range from the rules, got %+v", altitude)
+	}
+	if altitude.Description != "Depending on altitude_reference: between -500 and 10000 m MSL or between 0 and 10000 m AGL." {
+		t.Errorf("Expected altitude bounds per reference, got %q", altitude.Description)
+	}
+	if reference := position.Properties["altitude_reference"]; len(reference.Enum) != 2 || reference.Enum[0] != "msl" || reference.Enum[1] != "agl" {
+		t.Errorf("Expected the altitude references to be enumerated, got %+v", reference)
+	}
+	if len(position.Required) != 1 || position.Required[0] != "drone_id" {
+		t.Errorf("Expected drone_id to be required, got %v", position.Required)
+	}
+}
+
+func TestOpenAPIDocumentListsOnlyMountedRoutes(t *testing.T) {
+	server := makeTestServer(fakes.NewFakeQueueDispatcher())
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", openAPIRoute, nil)
+	server.ServeHTTP(recorder, request)
+
+	var doc openAPIDocument
+	json.Unmarshal(recorder.Body.Bytes(), &doc)
+	if doc.Paths[batchRoute] == nil || doc.Paths[dronesRoute] != nil || doc.Paths[deadLettersRoute] != nil {
+		t.Errorf("Expected only the command routes without operators, got %v", doc.Paths)
+	}
+}
+
+func TestOpenAPIValidatorRejectsRequestsNotMatchingSpec(t *testing.T) {
+	rules := newDefaultRulesEngine()
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	server := negroni.New()
+	server.UseFunc(openAPIValidator(func() *openAPIDocument { return buildOpenAPIDocument(defaultCommands, rules) }))
+	server.UseHandler(makeTestServer(dispatcher))
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/api/cmds/telemetry", bytes.NewBufferString(`{"drone_id": "drone1", "uptime": "ten", "battery": 1.5}`))
+	server.ServeHTTP(recorder, request)
+
+	var p problem
+	json.Unmarshal(recorder.Body.Bytes(), &p)
+	if recorder.Code != http.StatusBadRequest || len(p.Errors) != 2 || p.Errors[0].Field != "battery" || p.Errors[1].Code != codeInvalidType {
+		t.Errorf("Expected type errors from the spec, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/api/cmds/telemetry", bytes.NewBufferString(`{"drone_id": "drone1", "uptime": 10}`))
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusCreated {
+		t.Errorf("Expected valid request to pass the validator, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/api/cmds/batch", bytes.NewBufferString("{\"type\": \"telemetry\", \"drone_id\": \"drone1\", \"uptime\": 10}\n{\"type\": \"alert\", \"drone_id\": \"drone1\", \"description\": \"x\"}\n"))
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusCreated {
+		t.Errorf("Expected NDJSON batch to be left to the handler, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestOpenAPIDocumentIsRebuiltOnlyOnReload(t *testing.T) {
+	path := writeRulesFile(t, "commands: {telemetry: {required: [drone_id]}}")
+	defer os.Remove(path)
+	rules, err := loadRulesEngine(path)
+	if err != nil {
+		t.Fatalf("Failed to load rules: %s", err)
+	}
+
+	document := cachedOpenAPIDocument(defaultCommands, rules, mux.NewRouter())
+	first := document()
+	if document() != first {
+		t.Errorf("Expected document to be built once")
+	}
+
+	ioutil.WriteFile(path, []byte("commands: {telemetry: {required: [drone_id, core_temp]}}"), 0644)
+	if err := rules.reload(); err != nil {
+		t.Fatalf("Failed to reload rules: %s", err)
+	}
+	if reloaded := document(); reloaded == first || !containsString(reloaded.Components.Schemas[commandSchemaName("telemetry")].Required, "core_temp") {
+		t.Errorf("Expected document to be rebuilt with the reloaded rules")
+	}
+}
@@ -0,0 +1,354 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	dronescommon "github.com/maxsuelmarinho/golang-event-driven-example/drones-common"
+)
+
+const (
+	outboxOpEvent = "event"
+	outboxOpAck   = "ack"
+
+	// outboxExtension ends the name of the outbox of every queue.
+	outboxExtension = ".wal"
+
+	defaultOutboxCompactThreshold = 1000
+)
+
+// FileOutbox is a queueDispatcher that appends every message to a write-ahead
+// log on local disk before handing it to the wrapped dispatcher. Messages are
+// replayed, in order, by Flush, which runs in the background once the outbox
+// is started. Messages the broker refuses for good are moved to a parked log
+// next to it, so they do not hold back the others.
+type FileOutbox struct {
+	path             string
+	next             queueDispatcher
+	compactThreshold int
+
+	// replay serializes flushes; mutex guards the log, and is never held
+	// while dispatching.
+	replay       sync.Mutex
+	mutex        sync.Mutex
+	file         *os.File
+	pending      []outboxRecord
+	nextSequence uint64
+	acked        int
+
+	wake chan struct{}
+	done chan struct{}
+}
+
+type outboxRecord struct {
+	Sequence uint64          `json:"seq"`
+	Op       string          `json:"op"`
+	Envelope bool            `json:"envelope,omitempty"`
+	Message  json.RawMessage `json:"message,omitempty"`
+
+	// Error tells why a parked message was refused.
+	Error string `json:"error,omitempty"`
+}
+
+// NewFileOutbox opens (or creates) the log at path and recovers the entries
+// that were not acknowledged before the last shutdown.
+func NewFileOutbox(path string, next queueDispatcher) (*FileOutbox, error) {
+	outbox := &FileOutbox{
+		path:             path,
+		next:             next,
+		compactThreshold: defaultOutboxCompactThreshold,
+		wake:             make(chan struct{}, 1),
+		done:             make(chan struct{}),
+	}
+
+	err := outbox.recover()
+	if err != nil {
+		return nil, err
+	}
+
+	err = outbox.compact()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(outbox.pending) > 0 {
+		fmt.Printf("Recovered %d unsent message(s) from outbox '%s'\n", len(outbox.pending), path)
+	}
+	return outbox, nil
+}
+
+// Start replays the log in the background, right away and whenever a
+// message is written.
+func (o *FileOutbox) Start() {
+	go func() {
+		for {
+			o.Flush()
+			select {
+			case <-o.wake:
+			case <-o.done:
+				return
+			}
+		}
+	}()
+}
+
+// DispatchMessage succeeds as soon as the message is durably written; it is
+// delivered by the next flush.
+func (o *FileOutbox) DispatchMessage(message interface{}) (err error) {
+	body, err := json.Marshal(message)
+	if err != nil {
+		fmt.Printf("Failed to marshal message %v (%s)\n", message, err)
+		return err
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	_, isEnvelope := message.(dronescommon.EventEnvelope)
+	record := outboxRecord{Sequence: o.nextSequence, Op: outboxOpEvent, Envelope: isEnvelope, Message: body}
+	err = o.append(record)
+	if err != nil {
+		fmt.Printf("Failed to write message to outbox '%s': %s\n", o.path, err)
+		return err
+	}
+	o.nextSequence++
+	o.pending = append(o.pending, record)
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Flush replays unsent messages in order, stopping at the first failure the
+// broker may recover from.
+func (o *FileOutbox) Flush() {
+	o.replay.Lock()
+	defer o.replay.Unlock()
+	select {
+	case <-o.done:
+		return
+	default:
+	}
+
+	for {
+		o.mutex.Lock()
+		if len(o.pending) == 0 {
+			o.mutex.Unlock()
+			break
+		}
+		record := o.pending[0]
+		o.mutex.Unlock()
+
+		err := o.next.DispatchMessage(record.message())
+		if err != nil && !refused(err) {
+			fmt.Printf("Outbox '%s' holding %d unsent message(s): %s\n", o.path, o.Pending(), err)
+			return
+		}
+
+		o.mutex.Lock()
+		if err != nil {
+			o.park(record, err)
+		}
+		o.ack(record)
+		o.mutex.Unlock()
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.acked >= o.compactThreshold {
+		err := o.compact()
+		if err != nil {
+			fmt.Printf("Failed to compact outbox '%s': %s\n", o.path, err)
+		}
+	}
+}
+
+// Pending returns the number of messages not yet acknowledged.
+func (o *FileOutbox) Pending() int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return len(o.pending)
+}
+
+func (o *FileOutbox) Close() error {
+	select {
+	case <-o.done:
+	default:
+		close(o.done)
+	}
+	o.replay.Lock()
+	defer o.replay.Unlock()
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.file.Close()
+}
+
+func (o *FileOutbox) ack(record outboxRecord) {
+	err := o.append(outboxRecord{Sequence: record.Sequence, Op: outboxOpAck})
+	if err != nil {
+		// the message will be sent again after a restart
+		fmt.Printf("Failed to acknowledge message %d in outbox '%s': %s\n", record.Sequence, o.path, err)
+	}
+	o.pending = o.pending[1:]
+	o.acked++
+}
+
+// park appends a message the broker refused to <path>.parked, where it waits
+// for an operator instead of being retried.
+func (o *FileOutbox) park(record outboxRecord, reason error) {
+	fmt.Printf("Parking message %d of outbox '%s': %s\n", record.Sequence, o.path, reason)
+	record.Error = reason.Error()
+	line, err := json.Marshal(record)
+	if err != nil {
+		fmt.Printf("Failed to park message %d of outbox '%s': %s\n", record.Sequence, o.path, err)
+		return
+	}
+
+	parked, err := os.OpenFile(o.parkedPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err == nil {
+		_, err = parked.Write(append(line, '\n'))
+		if err == nil {
+			err = parked.Sync()
+		}
+		parked.Close()
+	}
+	if err != nil {
+		fmt.Printf("Failed to park message %d of outbox '%s': %s\n", record.Sequence, o.path, err)
+	}
+}
+
+func (o *FileOutbox) parkedPath() string {
+	return o.path + ".parked"
+}
+
+// refused tells whether the broker refused a message for good, so retrying
+// it would only hold back the messages after it.
+func refused(err error) bool {
+	var nacked *PublishNackedError
+	var returned *PublishReturnedError
+	return errors.As(err, &nacked) || errors.As(err, &returned)
+}
+
+// message restores envelopes, so the wrapped dispatcher still sees their
+// metadata when they are replayed.
+func (r outboxRecord) message() interface{} {
+	if !r.Envelope {
+		return r.Message
+	}
+
+	var envelope dronescommon.EventEnvelope
+	err := json.Unmarshal(r.Message, &envelope)
+	if err != nil {
+		return r.Message
+	}
+	return envelope
+}
+
+func (o *FileOutbox) append(record outboxRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	_, err = o.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	return o.file.Sync()
+}
+
+func (o *FileOutbox) recover() error {
+	file, err := os.OpenFile(o.path, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	pending := make(map[uint64]outboxRecord)
+	order := make([]uint64, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record outboxRecord
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			// a torn write at the tail of the log, left by a crash
+			fmt.Printf("Skipping unreadable outbox record in '%s': %s\n", o.path, err)
+			continue
+		}
+
+		if record.Sequence >= o.nextSequence {
+			o.nextSequence = record.Sequence + 1
+		}
+		switch record.Op {
+		case outboxOpEvent:
+			pending[record.Sequence] = record
+			order = append(order, record.Sequence)
+		case outboxOpAck:
+			delete(pending, record.Sequence)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	o.pending = make([]outboxRecord, 0, len(pending))
+	for _, sequence := range order {
+		if record, ok := pending[sequence]; ok {
+			o.pending = append(o.pending, record)
+		}
+	}
+	return nil
+}
+
+// compact rewrites the log with the pending entries only, dropping every
+// acknowledged one.
+func (o *FileOutbox) compact() error {
+	compactPath := o.path + ".compact"
+	compacted, err := os.OpenFile(compactPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(compacted)
+	for _, record := range o.pending {
+		line, err := json.Marshal(record)
+		if err == nil {
+			_, err = writer.Write(append(line, '\n'))
+		}
+		if err != nil {
+			compacted.Close()
+			return err
+		}
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = compacted.Sync()
+	}
+	compacted.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(compactPath, o.path)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(o.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if o.file != nil {
+		o.file.Close()
+	}
+	o.file = file
+	o.acked = 0
+	return nil
+}
@@ -0,0 +1,160 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/maxsuelmarinho/golang-event-driven-example/drones-cmds/fakes"
+	dronescommon "github.com/maxsuelmarinho/golang-event-driven-example/drones-common"
+)
+
+func newTestOutboxPath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	return filepath.Join(dir, "telemetry.wal")
+}
+
+func TestOutboxKeepsMessagesWhileBrokerIsDown(t *testing.T) {
+	path := newTestOutboxPath(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	dispatcher.Err = ErrNotConnected
+	outbox, err := NewFileOutbox(path, dispatcher)
+	if err != nil {
+		t.Fatalf("Failed to open outbox: %s", err)
+	}
+	defer outbox.Close()
+
+	for _, droneID := range []string{"drone1", "drone2"} {
+		err = outbox.DispatchMessage(dronescommon.TelemetryUpdatedEvent{DroneID: droneID})
+		if err != nil {
+			t.Errorf("Expected outbox to accept message while broker is down, got %s", err)
+		}
+	}
+
+	if outbox.Pending() != 2 {
+		t.Errorf("Expected 2 pending messages, got %d", outbox.Pending())
+	}
+
+	dispatcher.Err = nil
+	outbox.Flush()
+
+	if outbox.Pending() != 0 {
+		t.Errorf("Expected no pending messages after flush, got %d", outbox.Pending())
+	}
+
+	if len(dispatcher.Messages) != 2 {
+		t.Fatalf("Expected 2 replayed messages, got %d", len(dispatcher.Messages))
+	}
+
+	var first dronescommon.TelemetryUpdatedEvent
+	json.Unmarshal(dispatcher.Messages[0].(json.RawMessage), &first)
+	if first.DroneID != "drone1" {
+		t.Errorf("Expected messages to be replayed in order, got %s first", first.DroneID)
+	}
+}
+
+func TestOutboxRecoversUnsentMessagesOnStartup(t *testing.T) {
+	path := newTestOutboxPath(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	outbox, _ := NewFileOutbox(path, dispatcher)
+	outbox.DispatchMessage(dronescommon.AlertSignalledEvent{DroneID: "sent"})
+	outbox.Flush()
+	dispatcher.Err = errors.New("broker unavailable")
+	outbox.DispatchMessage(dronescommon.AlertSignalledEvent{DroneID: "unsent"})
+	outbox.Close()
+
+	dispatcher = fakes.NewFakeQueueDispatcher()
+	dispatcher.Err = errors.New("broker unavailable")
+	recovered, err := NewFileOutbox(path, dispatcher)
+	if err != nil {
+		t.Fatalf("Failed to reopen outbox: %s", err)
+	}
+	defer recovered.Close()
+
+	if recovered.Pending() != 1 {
+		t.Fatalf("Expected 1 recovered message, got %d", recovered.Pending())
+	}
+
+	dispatcher.Err = nil
+	recovered.Flush()
+	var event dronescommon.AlertSignalledEvent
+	json.Unmarshal(dispatcher.Messages[0].(json.RawMessage), &event)
+	if event.DroneID != "unsent" {
+		t.Errorf("Expected the unsent message to be replayed, got %s", event.DroneID)
+	}
+}
+
+func TestOutboxCompactsAcknowledgedMessages(t *testing.T) {
+	path := newTestOutboxPath(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	outbox, _ := NewFileOutbox(path, dispatcher)
+	defer outbox.Close()
+	outbox.compactThreshold = 3
+
+	for i := 0; i < 3; i++ {
+		outbox.DispatchMessage(dronescommon.PositionChangedEvent{DroneID: "drone1"})
+	}
+	outbox.Flush()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat outbox: %s", err)
+	}
+
+	if info.Size() != 0 {
+		t.Errorf("Expected compacted outbox to be empty, got %d bytes", info.Size())
+	}
+}
+
+func TestOutboxReplaysInTheBackground(t *testing.T) {
+	path := newTestOutboxPath(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	outbox, _ := NewFileOutbox(path, dispatcher)
+	defer outbox.Close()
+	outbox.Start()
+
+	outbox.DispatchMessage(dronescommon.TelemetryUpdatedEvent{DroneID: "drone1"})
+	waitFor(t, func() bool { return outbox.Pending() == 0 })
+	if len(dispatcher.Messages) != 1 {
+		t.Errorf("Expected message to be replayed, got %d", len(dispatcher.Messages))
+	}
+}
+
+func TestOutboxParksRefusedMessages(t *testing.T) {
+	path := newTestOutboxPath(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	outbox, _ := NewFileOutbox(path, dispatcher)
+	defer outbox.Close()
+
+	dispatcher.Err = &PublishReturnedError{Queue: "telemetry", ReplyCode: 312, ReplyText: "NO_ROUTE"}
+	outbox.DispatchMessage(dronescommon.TelemetryUpdatedEvent{DroneID: "poison"})
+	outbox.Flush()
+	dispatcher.Err = nil
+	outbox.DispatchMessage(dronescommon.TelemetryUpdatedEvent{DroneID: "drone1"})
+	outbox.Flush()
+
+	if outbox.Pending() != 0 || len(dispatcher.Messages) != 1 {
+		t.Errorf("Expected refused message not to hold back the next one, got %d pending", outbox.Pending())
+	}
+	parked, err := ioutil.ReadFile(outbox.parkedPath())
+	if err != nil || !strings.Contains(string(parked), "poison") || !strings.Contains(string(parked), "NO_ROUTE") {
+		t.Errorf("Expected refused message to be parked with its reason, got %s (%v)", parked, err)
+	}
+}
@@ -0,0 +1,108 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+const (
+	problemContentType = "application/problem+json"
+	problemTypePrefix  = "urn:drones:problem:"
+
+	problemMalformedCommand = problemTypePrefix + "malformed-command"
+	problemInvalidCommand   = problemTypePrefix + "invalid-command"
+	problemDispatchFailed   = problemTypePrefix + "dispatch-failed"
+	problemConflict         = problemTypePrefix + "conflict"
+	problemInternal         = problemTypePrefix + "internal-error"
+	problemUnauthorized     = problemTypePrefix + "unauthorized"
+	problemForbidden        = problemTypePrefix + "forbidden"
+
+	codeRequired    = "required"
+	codeOutOfRange  = "out_of_range"
+	codeInvalidType = "invalid_type"
+	codeMalformed   = "malformed"
+)
+
+// fieldError describes one violated rule of a command.
+type fieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// problem is an RFC 7807 problem document. Fields after Instance are
+// extension members.
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+
+	Errors     []fieldError `json:"errors,omitempty"`
+	RetryAfter int          `json:"retry_after,omitempty"`
+}
+
+func newProblem(problemType string, status int, title string) problem {
+	return problem{Type: problemType, Title: title, Status: status}
+}
+
+func writeProblem(w http.ResponseWriter, req *http.Request, p problem) {
+	if p.Instance == "" && req != nil {
+		p.Instance = req.URL.Path
+	}
+
+	body, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		http.Error(w, p.Title, p.Status)
+		return
+	}
+	w.Header().Set("Content-Type", problemContentType)
+	w.WriteHeader(p.Status)
+	w.Write(body)
+}
+
+func malformedCommandProblem(detail string, errs ...fieldError) problem {
+	p := newProblem(problemMalformedCommand, http.StatusBadRequest, "Malformed command.")
+	p.Detail = detail
+	p.Errors = errs
+	return p
+}
+
+func invalidCommandProblem(commandName string, errs []fieldError) problem {
+	p := newProblem(problemInvalidCommand, http.StatusBadRequest, fmt.Sprintf("Invalid %s command.", commandName))
+	p.Errors = errs
+	return p
+}
+
+// parseErrors describes why a payload could not be unmarshalled, pointing at
+// the offending field when the decoder knows it.
+func parseErrors(err error) []fieldError {
+	var typeError *json.UnmarshalTypeError
+	if errors.As(err, &typeError) {
+		return []fieldError{{
+			Field:   typeError.Field,
+			Code:    codeInvalidType,
+			Message: fmt.Sprintf("expected %s, got JSON %s", typeError.Type, typeError.Value),
+		}}
+	}
+
+	var syntaxError *json.SyntaxError
+	if errors.As(err, &syntaxError) {
+		return []fieldError{{
+			Code:    codeMalformed,
+			Message: fmt.Sprintf("%s at offset %d", syntaxError, syntaxError.Offset),
+		}}
+	}
+	return []fieldError{{Code: codeMalformed, Message: err.Error()}}
+}
+
+func requiredField(field string) fieldError {
+	return fieldError{Field: field, Code: codeRequired, Message: fmt.Sprintf("%s is required", field)}
+}
+
+func outOfRangeField(field string, message string) fieldError {
+	return fieldError{Field: field, Code: codeOutOfRange, Message: fmt.Sprintf("%s %s", field, message)}
+}
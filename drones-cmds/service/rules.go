@@ -0,0 +1,593 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	codePattern    = "pattern"
+	codeCrossField = "cross_field"
+
+	altitudeAboveMeanSeaLevel = "msl"
+	altitudeAboveGroundLevel  = "agl"
+
+	// referenceSuffix names the field in which readings declare what a
+	// ranged field is measured from, e.g. altitude_reference.
+	referenceSuffix = "_reference"
+
+	defaultRulesReloadInterval = 30 * time.Second
+)
+
+// defaultRules are used when no rules file is configured. Altitudes are in
+// meters above mean sea level unless the reading declares them above ground
+// level, speeds in meters per second.
+const defaultRules = `
+commands:
+  telemetry:
+    required: [drone_id, uptime]
+  alert:
+    required: [drone_id, description]
+  position:
+    required: [drone_id]
+    ranges:
+      latitude: {min: -90, max: 90}
+      longitude: {min: -180, max: 180}
+      altitude: {min: -500, max: 10000, unit: m, reference: msl, references: {agl: {min: 0, max: 10000}}}
+      current_speed: {min: 0, max: 100, unit: m/s}
+      heading_cardinal: {min: 0, max: 3}
+`
+
+// geographicBounds hold for every rules file: ranges of these fields may
+// only narrow them, and are bounded by them when missing.
+var geographicBounds = map[string]map[string]rangeRule{
+	"position": {
+		"latitude":  {Min: float64Ref(-90), Max: float64Ref(90)},
+		"longitude": {Min: float64Ref(-180), Max: float64Ref(180)},
+	},
+}
+
+// rangeRule bounds a numeric field. Reference tells what the bounds of an
+// altitude are measured from, msl or agl, and is assumed for readings that
+// declare none; readings declaring another reference in <field>_reference
+// are bounded by References instead.
+type rangeRule struct {
+	Min        *float64             `yaml:"min"`
+	Max        *float64             `yaml:"max"`
+	Unit       string               `yaml:"unit"`
+	Reference  string               `yaml:"reference"`
+	References map[string]rangeRule `yaml:"references"`
+}
+
+type fieldCondition struct {
+	Field    string      `yaml:"field"`
+	Operator string      `yaml:"operator"`
+	Value    interface{} `yaml:"value"`
+	Other    string      `yaml:"other"`
+}
+
+// crossFieldRule checks a field against a value or another field, only
+// when its optional condition holds.
+type crossFieldRule struct {
+	When    *fieldCondition `yaml:"when"`
+	Check   fieldCondition  `yaml:"check"`
+	Message string          `yaml:"message"`
+}
+
+type commandRules struct {
+	Required   []string             `yaml:"required"`
+	Ranges     map[string]rangeRule `yaml:"ranges"`
+	Patterns   map[string]string    `yaml:"patterns"`
+	CrossField []crossFieldRule     `yaml:"cross_field"`
+
+	patterns map[string]*regexp.Regexp
+}
+
+// rulesFile is the layout of a rules file, in YAML or JSON. Commands missing
+// from the file keep the default rules. Fleet rules are merged over the
+// command rules: ranges and patterns replace the ones of the same field,
+// required fields and cross-field rules are added.
+type rulesFile struct {
+	Commands map[string]*commandRules            `yaml:"commands"`
+	Fleets   map[string]map[string]*commandRules `yaml:"fleets"`
+}
+
+// rulesEngine validates commands against rules loaded from a file, which
+// can be reloaded while the service runs.
+type rulesEngine struct {
+	path string
+
+	// directory, when set, rejects commands of drones that are not active
+	// in the registry.
+	directory droneDirectory
+
+	// fleets, when set, tells the fleet of registered drones, so commands
+	// are only accepted for drones of the fleet of the request.
+	fleets droneFleets
+
+	// severities classifies the alerts that pass validation.
+	severities *severityMap
+
+	mutex   sync.RWMutex
+	rules   *rulesFile
+	modTime time.Time
+}
+
+func newDefaultRulesEngine() *rulesEngine {
+	rules, err := parseRules([]byte(defaultRules), nil)
+	if err != nil {
+		panic(fmt.Sprintf("invalid default rules: %s", err))
+	}
+	return &rulesEngine{rules: rules}
+}
+
+func loadRulesEngine(path string) (*rulesEngine, error) {
+	engine := &rulesEngine{path: path}
+	err := engine.reload()
+	if err != nil {
+		return nil, err
+	}
+	return engine, nil
+}
+
+// reload replaces the rules with the content of the file. Invalid files are
+// rejected and the current rules kept.
+func (e *rulesEngine) reload() error {
+	info, err := os.Stat(e.path)
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(e.path)
+	if err != nil {
+		return err
+	}
+
+	rules, err := parseRules(data, newDefaultRulesEngine().rules.Commands)
+	if err != nil {
+		return fmt.Errorf("invalid rules in '%s': %s", e.path, err)
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.rules = rules
+	e.modTime = info.ModTime()
+	return nil
+}
+
+// watch reloads the rules on SIGHUP and whenever the file changes.
+func (e *rulesEngine) watch(interval time.Duration) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		for {
+			select {
+			case <-hangup:
+			case <-ticker.C:
+				info, err := os.Stat(e.path)
+				if err != nil || !info.ModTime().After(e.lastModified()) {
+					continue
+				}
+			}
+
+			err := e.reload()
+			if err != nil {
+				fmt.Printf("Failed to reload validation rules: %s\n", err)
+				continue
+			}
+			fmt.Printf("Reloaded validation rules from '%s'\n", e.path)
+		}
+	}()
+}
+
+func (e *rulesEngine) lastModified() time.Time {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.modTime
+}
+
+// loaded returns the rules currently in use, replaced on every reload.
+func (e *rulesEngine) loaded() *rulesFile {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.rules
+}
+
+func (e *rulesEngine) rulesFor(commandName string, fleet string) *commandRules {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	if fleetRules, ok := e.rules.Fleets[fleet]; ok && fleetRules[commandName] != nil {
+		return fleetRules[commandName]
+	}
+	return e.rules.Commands[commandName]
+}
+
+// validate reports every rule the command violates. Rules address fields by
+// their JSON name; fleet rules apply to the fleet_id of the command or, when
+// it carries none, to the fleet the request was sent for.
+func (e *rulesEngine) validate(commandName string, fleet string, command interface{}) []fieldError {
+	fields, err := commandFields(command)
+	if err != nil {
+		return []fieldError{{Code: codeMalformed, Message: err.Error()}}
+	}
+
+	if commandFleet, _ := fields["fleet_id"].(string); commandFleet != "" {
+		fleet = commandFleet
+	}
+	var errs []fieldError
+	if rules := e.rulesFor(commandName, fleet); rules != nil {
+		errs = rules.validate(fields)
+	}
+
+	droneID, _ := fields["drone_id"].(string)
+	if e.directory != nil && droneID != "" && !e.directory.active(droneID) {
+		errs = append(errs, unregisteredDroneField(droneID))
+	}
+	return errs
+}
+
+func (r *commandRules) validate(fields map[string]interface{}) (errs []fieldError) {
+	for _, field := range r.Required {
+		if isZero(fields[field]) {
+			errs = append(errs, requiredField(field))
+		}
+	}
+
+	for _, field := range sortedKeys(r.Ranges) {
+		value, ok := toFloat(fields[field])
+		if !ok {
+			continue
+		}
+		declared, _ := fields[field+referenceSuffix].(string)
+		limits, ok := r.Ranges[field].forReference(declared)
+		if !ok {
+			errs = append(errs, fieldError{Field: field + referenceSuffix, Code: codeOutOfRange,
+				Message: fmt.Sprintf("%s%s must be one of %s", field, referenceSuffix, strings.Join(r.Ranges[field].references(), ", "))})
+			continue
+		}
+		if (limits.Min != nil && value < *limits.Min) || (limits.Max != nil && value > *limits.Max) {
+			errs = append(errs, outOfRangeField(field, limits.describe()))
+		}
+	}
+
+	for _, field := range sortedKeys(r.patterns) {
+		value, _ := fields[field].(string)
+		if value != "" && !r.patterns[field].MatchString(value) {
+			errs = append(errs, fieldError{Field: field, Code: codePattern,
+				Message: fmt.Sprintf("%s must match %s", field, r.Patterns[field])})
+		}
+	}
+
+	for _, rule := range r.CrossField {
+		if rule.When != nil && !rule.When.holds(fields) {
+			continue
+		}
+		if !rule.Check.holds(fields) {
+			errs = append(errs, fieldError{Field: rule.Check.Field, Code: codeCrossField, Message: rule.message()})
+		}
+	}
+	return errs
+}
+
+// forReference returns the bounds for readings measured from the declared
+// reference, or false when the rule has none for it.
+func (l rangeRule) forReference(declared string) (rangeRule, bool) {
+	if declared == "" || l.Reference == "" || declared == l.Reference {
+		return l, true
+	}
+	limits, ok := l.References[declared]
+	if !ok {
+		return l, false
+	}
+	limits.Unit = l.Unit
+	limits.Reference = declared
+	return limits, true
+}
+
+// references lists the references the rule has bounds for.
+func (l rangeRule) references() []string {
+	references := []string{l.Reference}
+	return append(references, sortedKeys(l.References)...)
+}
+
+func (l rangeRule) describe() string {
+	unit := ""
+	if l.Unit != "" {
+		unit = " " + l.Unit
+	}
+	if l.Reference != "" {
+		unit += " " + strings.ToUpper(l.Reference)
+	}
+	switch {
+	case l.Min != nil && l.Max != nil:
+		return fmt.Sprintf("must be between %g and %g%s", *l.Min, *l.Max, unit)
+	case l.Min != nil:
+		return fmt.Sprintf("must be at least %g%s", *l.Min, unit)
+	default:
+		return fmt.Sprintf("must be at most %g%s", *l.Max, unit)
+	}
+}
+
+func (c fieldCondition) holds(fields map[string]interface{}) bool {
+	expected := c.Value
+	if c.Other != "" {
+		expected = fields[c.Other]
+	}
+	actual := fields[c.Field]
+
+	left, leftIsNumber := toFloat(actual)
+	right, rightIsNumber := toFloat(expected)
+	if !leftIsNumber || !rightIsNumber {
+		actualText, expectedText := fmt.Sprint(actual), fmt.Sprint(expected)
+		if actual == nil {
+			actualText = ""
+		}
+		if expected == nil {
+			expectedText = ""
+		}
+		switch c.Operator {
+		case "==":
+			return actualText == expectedText
+		case "!=":
+			return actualText != expectedText
+		}
+		return false
+	}
+
+	switch c.Operator {
+	case "<":
+		return left < right
+	case "<=":
+		return left <= right
+	case ">":
+		return left > right
+	case ">=":
+		return left >= right
+	case "==":
+		return left == right
+	case "!=":
+		return left != right
+	}
+	return false
+}
+
+func (c fieldCondition) check() error {
+	switch c.Operator {
+	case "<", "<=", ">", ">=", "==", "!=":
+	default:
+		return fmt.Errorf("unknown operator '%s' on field '%s'", c.Operator, c.Field)
+	}
+	if c.Field == "" {
+		return fmt.Errorf("cross-field rule without a field")
+	}
+	return nil
+}
+
+func (rule crossFieldRule) message() string {
+	if rule.Message != "" {
+		return rule.Message
+	}
+	target := fmt.Sprint(rule.Check.Value)
+	if rule.Check.Other != "" {
+		target = rule.Check.Other
+	}
+	return fmt.Sprintf("%s must be %s %s", rule.Check.Field, rule.Check.Operator, target)
+}
+
+func parseRules(data []byte, defaults map[string]*commandRules) (*rulesFile, error) {
+	var rules rulesFile
+	err := yaml.UnmarshalStrict(data, &rules)
+	if err != nil {
+		return nil, err
+	}
+
+	if rules.Commands == nil {
+		rules.Commands = make(map[string]*commandRules)
+	}
+	for name, command := range defaults {
+		if _, ok := rules.Commands[name]; !ok {
+			rules.Commands[name] = command
+		}
+	}
+
+	for name, bounds := range geographicBounds {
+		if rules.Commands[name] == nil {
+			rules.Commands[name] = &commandRules{}
+		}
+		rules.Commands[name].bound(bounds)
+	}
+
+	for name, command := range rules.Commands {
+		err = command.compile()
+		if err != nil {
+			return nil, fmt.Errorf("command '%s': %s", name, err)
+		}
+	}
+
+	for fleet, commands := range rules.Fleets {
+		for name, overrides := range commands {
+			merged := mergeRules(rules.Commands[name], overrides)
+			merged.bound(geographicBounds[name])
+			err = merged.compile()
+			if err != nil {
+				return nil, fmt.Errorf("fleet '%s', command '%s': %s", fleet, name, err)
+			}
+			commands[name] = merged
+		}
+	}
+	return &rules, nil
+}
+
+// bound narrows the ranges of the rules to the bounds, adding those the
+// rules miss.
+func (r *commandRules) bound(bounds map[string]rangeRule) {
+	if len(bounds) > 0 && r.Ranges == nil {
+		r.Ranges = make(map[string]rangeRule)
+	}
+	for field, bound := range bounds {
+		limits, ok := r.Ranges[field]
+		if !ok {
+			r.Ranges[field] = bound
+			continue
+		}
+		if limits.Min == nil || *limits.Min < *bound.Min {
+			limits.Min = bound.Min
+		}
+		if limits.Max == nil || *limits.Max > *bound.Max {
+			limits.Max = bound.Max
+		}
+		r.Ranges[field] = limits
+	}
+}
+
+func (r *commandRules) compile() error {
+	r.patterns = make(map[string]*regexp.Regexp)
+	for field, pattern := range r.Patterns {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern of field '%s': %s", field, err)
+		}
+		r.patterns[field] = compiled
+	}
+
+	for field, limits := range r.Ranges {
+		if limits.Min == nil && limits.Max == nil {
+			return fmt.Errorf("range of field '%s' has neither min nor max", field)
+		}
+		if limits.Min != nil && limits.Max != nil && *limits.Min > *limits.Max {
+			return fmt.Errorf("range of field '%s' has min above max", field)
+		}
+		if limits.Reference != "" && limits.Reference != altitudeAboveMeanSeaLevel && limits.Reference != altitudeAboveGroundLevel {
+			return fmt.Errorf("reference of field '%s' must be '%s' or '%s', got '%s'", field, altitudeAboveMeanSeaLevel, altitudeAboveGroundLevel, limits.Reference)
+		}
+		if len(limits.References) > 0 && limits.Reference == "" {
+			return fmt.Errorf("range of field '%s' has bounds per reference but no reference of its own", field)
+		}
+		for reference, bounds := range limits.References {
+			switch {
+			case reference == limits.Reference || (reference != altitudeAboveMeanSeaLevel && reference != altitudeAboveGroundLevel):
+				return fmt.Errorf("references of field '%s' must be the other of '%s' or '%s', got '%s'", field, altitudeAboveMeanSeaLevel, altitudeAboveGroundLevel, reference)
+			case bounds.Min == nil && bounds.Max == nil:
+				return fmt.Errorf("range of field '%s' above %s has neither min nor max", field, reference)
+			case bounds.Min != nil && bounds.Max != nil && *bounds.Min > *bounds.Max:
+				return fmt.Errorf("range of field '%s' above %s has min above max", field, reference)
+			case bounds.Unit != "" || bounds.Reference != "" || len(bounds.References) > 0:
+				return fmt.Errorf("range of field '%s' above %s may only have a min and a max", field, reference)
+			}
+		}
+	}
+
+	for _, rule := range r.CrossField {
+		err := rule.Check.check()
+		if err == nil && rule.When != nil {
+			err = rule.When.check()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func mergeRules(base *commandRules, overrides *commandRules) *commandRules {
+	merged := &commandRules{Ranges: make(map[string]rangeRule), Patterns: make(map[string]string)}
+	for _, rules := range []*commandRules{base, overrides} {
+		if rules == nil {
+			continue
+		}
+		merged.Required = append(merged.Required, rules.Required...)
+		merged.CrossField = append(merged.CrossField, rules.CrossField...)
+		for field, limits := range rules.Ranges {
+			merged.Ranges[field] = limits
+		}
+		for field, pattern := range rules.Patterns {
+			merged.Patterns[field] = pattern
+		}
+	}
+	return merged
+}
+
+func float64Ref(value float64) *float64 {
+	return &value
+}
+
+func commandFields(command interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(command)
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]interface{})
+	err = json.Unmarshal(data, &fields)
+	return fields, err
+}
+
+func isZero(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case float64:
+		return v == 0
+	case bool:
+		return !v
+	}
+	return false
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+func sortedKeys(values interface{}) []string {
+	keys := make([]string, 0)
+	switch m := values.(type) {
+	case map[string]rangeRule:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]*regexp.Regexp:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func resolveRulesEngine() *rulesEngine {
+	path := os.Getenv("VALIDATION_RULES_FILE")
+	if path == "" {
+		return newDefaultRulesEngine()
+	}
+
+	engine, err := loadRulesEngine(path)
+	failOnError(err, "Failed to load validation rules")
+
+	interval := defaultRulesReloadInterval
+	if value, err := time.ParseDuration(os.Getenv("VALIDATION_RULES_RELOAD_INTERVAL")); err == nil && value > 0 {
+		interval = value
+	}
+	engine.watch(interval)
+	fmt.Printf("Using validation rules from '%s'\n", path)
+	return engine
+}
@@ -0,0 +1,248 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func writeRulesFile(t *testing.T, content string) string {
+	file, err := ioutil.TempFile("", "rules")
+	if err != nil {
+		t.Fatalf("Failed to create rules file: %s", err)
+	}
+	file.WriteString(content)
+	file.Close()
+	return file.Name()
+}
+
+func TestDefaultRulesMatchBuiltInChecks(t *testing.T) {
+	rules := newDefaultRulesEngine()
+
+	errs := rules.validate("position", "", positionCommand{Latitude: 91, Longitude: -181, HeadingCardinal: 4})
+	if len(errs) != 4 || errs[0].Field != "drone_id" || errs[1].Field != "heading_cardinal" {
+		t.Errorf("Expected drone_id, heading, latitude and longitude errors, got %+v", errs)
+	}
+
+	if errs := rules.validate("telemetry", "", telemetryCommand{DroneID: "drone1", Uptime: 10}); len(errs) != 0 {
+		t.Errorf("Expected valid telemetry to be accepted, got %+v", errs)
+	}
+}
+
+func TestFleetRulesOverrideCommandRules(t *testing.T) {
+	path := writeRulesFile(t, `
+commands:
+  position:
+    required: [drone_id]
+    ranges:
+      altitude: {min: -500, max: 3000, unit: m MSL}
+      current_speed: {min: 0, max: 100}
+fleets:
+  crop-sprayers:
+    position:
+      ranges:
+        altitude: {min: 0, max: 120, unit: m AGL}
+        current_speed: {min: 0, max: 15}
+`)
+	defer os.Remove(path)
+
+	rules, err := loadRulesEngine(path)
+	if err != nil {
+		t.Fatalf("Failed to load rules: %s", err)
+	}
+
+	position := positionCommand{DroneID: "sprayer1", FleetID: "crop-sprayers", Altitude: 150, CurrentSpeed: 10}
+	errs := rules.validate("position", "", position)
+	if len(errs) != 1 || errs[0].Field != "altitude" || errs[0].Message != "altitude must be between 0 and 120 m AGL" {
+		t.Errorf("Expected altitude above the fleet limit to be rejected, got %+v", errs)
+	}
+
+	position.FleetID = ""
+	if errs := rules.validate("position", "", position); len(errs) != 0 {
+		t.Errorf("Expected altitude within the command limits to be accepted, got %+v", errs)
+	}
+
+	if errs := rules.validate("alert", "", alertCommand{DroneID: "drone1"}); len(errs) != 1 || errs[0].Field != "description" {
+		t.Errorf("Expected commands missing from the file to keep the default rules, got %+v", errs)
+	}
+}
+
+func TestGeographicBoundsHoldForEveryRulesFile(t *testing.T) {
+	path := writeRulesFile(t, `
+commands:
+  position:
+    required: [drone_id]
+    ranges:
+      altitude: {min: 0, max: 120, unit: m, reference: agl}
+fleets:
+  coastal:
+    position:
+      ranges:
+        latitude: {min: -100, max: 100}
+        longitude: {min: 10, max: 20}
+`)
+	defer os.Remove(path)
+
+	rules, err := loadRulesEngine(path)
+	if err != nil {
+		t.Fatalf("Failed to load rules: %s", err)
+	}
+
+	errs := rules.validate("position", "", positionCommand{DroneID: "drone1", Latitude: -91, Longitude: 181, Altitude: 150})
+	if len(errs) != 3 || errs[0].Field != "altitude" || errs[0].Message != "altitude must be between 0 and 120 m AGL" || errs[1].Field != "latitude" || errs[2].Field != "longitude" {
+		t.Errorf("Expected geographic bounds without ranges in the file, got %+v", errs)
+	}
+
+	errs = rules.validate("position", "coastal", positionCommand{DroneID: "drone1", Latitude: 95, Longitude: 25})
+	if len(errs) != 2 || errs[0].Message != "latitude must be between -90 and 90" || errs[1].Message != "longitude must be between 10 and 20" {
+		t.Errorf("Expected fleet ranges to narrow but not widen the bounds, got %+v", errs)
+	}
+
+	if errs := rules.validate("position", "", positionCommand{DroneID: "drone1", Latitude: -33.9, Longitude: -70.6, Altitude: 50}); len(errs) != 0 {
+		t.Errorf("Expected positions in the southern and western hemispheres to be accepted, got %+v", errs)
+	}
+}
+
+func TestAltitudeBoundsFollowTheDeclaredReference(t *testing.T) {
+	path := writeRulesFile(t, `
+commands:
+  position:
+    ranges:
+      altitude: {min: -500, max: 3000, unit: m, reference: msl, references: {agl: {min: 0, max: 120}}}
+`)
+	defer os.Remove(path)
+
+	rules, err := loadRulesEngine(path)
+	if err != nil {
+		t.Fatalf("Failed to load rules: %s", err)
+	}
+
+	if errs := rules.validate("position", "", positionCommand{DroneID: "drone1", Altitude: 2000}); len(errs) != 0 {
+		t.Errorf("Expected readings without a reference to be bounded above mean sea level, got %+v", errs)
+	}
+
+	errs := rules.validate("position", "", positionCommand{DroneID: "drone1", Altitude: 2000, AltitudeReference: "agl"})
+	if len(errs) != 1 || errs[0].Message != "altitude must be between 0 and 120 m AGL" {
+		t.Errorf("Expected readings above ground level to be bounded by their own range, got %+v", errs)
+	}
+
+	errs = rules.validate("position", "", positionCommand{DroneID: "drone1", Altitude: -20, AltitudeReference: "msl"})
+	if len(errs) != 0 {
+		t.Errorf("Expected readings above mean sea level to be accepted below ground, got %+v", errs)
+	}
+
+	errs = rules.validate("position", "", positionCommand{DroneID: "drone1", Altitude: 50, AltitudeReference: "sea"})
+	if len(errs) != 1 || errs[0].Field != "altitude_reference" || errs[0].Message != "altitude_reference must be one of msl, agl" {
+		t.Errorf("Expected unknown references to be rejected, got %+v", errs)
+	}
+}
+
+func TestPatternAndCrossFieldRules(t *testing.T) {
+	path := writeRulesFile(t, `{
+  "commands": {
+    "alert": {
+      "patterns": {"drone_id": "^drone-[0-9]+$"},
+      "cross_field": [
+        {"when": {"field": "fault_code", "operator": ">=", "value": 500},
+         "check": {"field": "description", "operator": "!=", "value": ""},
+         "message": "critical faults need a description"}
+      ]
+    },
+    "telemetry": {
+      "cross_field": [{"check": {"field": "core_temp", "operator": "<", "other": "battery"}}]
+    }
+  }
+}`)
+	defer os.Remove(path)
+
+	rules, err := loadRulesEngine(path)
+	if err != nil {
+		t.Fatalf("Failed to load rules: %s", err)
+	}
+
+	errs := rules.validate("alert", "", alertCommand{DroneID: "rogue", FaultCode: 500})
+	if len(errs) != 2 || errs[0].Code != codePattern || errs[1].Code != codeCrossField || errs[1].Message != "critical faults need a description" {
+		t.Errorf("Expected pattern and cross-field errors, got %+v", errs)
+	}
+
+	if errs := rules.validate("alert", "", alertCommand{DroneID: "drone-1", FaultCode: 12}); len(errs) != 0 {
+		t.Errorf("Expected cross-field rule to be skipped when its condition fails, got %+v", errs)
+	}
+
+	errs = rules.validate("telemetry", "", telemetryCommand{DroneID: "drone-1", RemainingBattery: 20, CoreTemp: 40})
+	if len(errs) != 1 || errs[0].Message != "core_temp must be < battery" {
+		t.Errorf("Expected comparison against another field, got %+v", errs)
+	}
+}
+
+func TestInvalidRulesAreRejected(t *testing.T) {
+	for _, content := range []string{
+		"commands: {position: {ranges: {altitude: {min: 10, max: 5}}}}",
+		"commands: {alert: {patterns: {drone_id: '('}}}",
+		"commands: {alert: {cross_field: [{check: {field: fault_code, operator: '~'}}]}}",
+		"commands: {alert: {requird: [drone_id]}}",
+		"commands: {position: {ranges: {altitude: {min: 0, reference: sea}}}}",
+		"commands: {position: {ranges: {altitude: {min: 0, references: {agl: {min: 0}}}}}}",
+		"commands: {position: {ranges: {altitude: {min: 0, reference: msl, references: {msl: {min: 0}}}}}}",
+		"commands: {position: {ranges: {altitude: {min: 0, reference: msl, references: {agl: {min: 10, max: 5}}}}}}",
+		"commands: {position: {ranges: {altitude: {min: 0, reference: msl, references: {agl: {}}}}}}",
+		"commands: {position: {ranges: {latitude: {min: 95}}}}",
+	} {
+		path := writeRulesFile(t, content)
+		if _, err := loadRulesEngine(path); err == nil {
+			t.Errorf("Expected rules %q to be rejected", content)
+		}
+		os.Remove(path)
+	}
+}
+
+func TestReloadKeepsRulesOnInvalidFile(t *testing.T) {
+	path := writeRulesFile(t, "commands: {telemetry: {required: [drone_id]}}")
+	defer os.Remove(path)
+
+	rules, err := loadRulesEngine(path)
+	if err != nil {
+		t.Fatalf("Failed to load rules: %s", err)
+	}
+
+	ioutil.WriteFile(path, []byte("commands: {telemetry: {required: [drone_id, core_temp]}}"), 0644)
+	if err := rules.reload(); err != nil {
+		t.Fatalf("Failed to reload rules: %s", err)
+	}
+	if errs := rules.validate("telemetry", "", telemetryCommand{DroneID: "drone1"}); len(errs) != 1 || errs[0].Field != "core_temp" {
+		t.Errorf("Expected reloaded rules to apply, got %+v", errs)
+	}
+
+	ioutil.WriteFile(path, []byte("commands: {telemetry: {required: ["), 0644)
+	if err := rules.reload(); err == nil {
+		t.Errorf("Expected invalid rules to fail reloading")
+	}
+	if errs := rules.validate("telemetry", "", telemetryCommand{DroneID: "drone1"}); len(errs) != 1 {
+		t.Errorf("Expected previous rules to be kept, got %+v", errs)
+	}
+}
+
+func TestWatchReloadsChangedFile(t *testing.T) {
+	path := writeRulesFile(t, "commands: {telemetry: {required: [drone_id]}}")
+	defer os.Remove(path)
+
+	rules, err := loadRulesEngine(path)
+	if err != nil {
+		t.Fatalf("Failed to load rules: %s", err)
+	}
+	rules.watch(10 * time.Millisecond)
+
+	ioutil.WriteFile(path, []byte("commands: {telemetry: {required: [drone_id, core_temp]}}"), 0644)
+	later := time.Now().Add(time.Second)
+	os.Chtimes(path, later, later)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if len(rules.validate("telemetry", "", telemetryCommand{DroneID: "drone1"})) == 1 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Expected changed rules file to be reloaded")
+}
@@ -1,49 +1,188 @@
 package service
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/codegangsta/negroni"
 	"github.com/gorilla/mux"
 	"github.com/maxsuelmarinho/golang-event-driven-example/drones-cmds/fakes"
-	"github.com/streadway/amqp"
 	"github.com/unrolled/render"
 )
 
+type connectionHealth interface {
+	Healthy() bool
+	Status() ConnectionStatus
+}
+
+// fakeConnectionHealth reports the in-memory fake dispatchers as always up.
+type fakeConnectionHealth struct{}
+
+func (fakeConnectionHealth) Healthy() bool {
+	return true
+}
+
+func (fakeConnectionHealth) Status() ConnectionStatus {
+	return ConnectionStatus{Connected: true}
+}
+
 func NewServer() *negroni.Negroni {
 	formatter := render.New(render.Options{
 		IndentJSON: true,
 	})
 
 	n := negroni.Classic()
+	n.UseFunc(limitRequestBodies(maxRequestBytes))
 	mx := mux.NewRouter()
 
-	positionDispatcher := buildDispatcher("positions")
-	telemetryDispatcher := buildDispatcher("telemetry")
-	alertDispatcher := buildDispatcher("alerts")
+	severities := resolveSeverities()
+	connectionManager := buildConnectionManager(resolveAMQPURL(), severities)
+	tenants := resolveTenants()
+	dispatchers := make(map[string]queueDispatcher)
+	for _, queueName := range append(defaultCommands.queues(), droneRegistrationsQueue, droneDecommissionsQueue) {
+		dispatchers[queueName] = buildDispatcher(connectionManager, queueName)
+	}
+	if os.Getenv("TENANT_QUEUES") == "true" {
+		if connectionManager != nil {
+			failOnError(connectionManager.topology.checkTenantQueues(defaultCommands.queues()), "Failed to dispatch commands to per-tenant queues")
+		}
+		fmt.Printf("Dispatching commands to per-tenant queues\n")
+		build := func(queueName string) queueDispatcher { return buildDispatcher(connectionManager, queueName) }
+		for _, queueName := range defaultCommands.queues() {
+			dispatcher := newTenantDispatcher(queueName, dispatchers[queueName], tenants, build)
+			if outboxDir := os.Getenv("OUTBOX_DIR"); outboxDir != "" {
+				failOnError(dispatcher.openOutboxes(outboxDir), "Failed to open tenant outboxes")
+			}
+			dispatchers[queueName] = dispatcher
+		}
+	}
+
+	var health connectionHealth = fakeConnectionHealth{}
+	if connectionManager != nil {
+		connectionManager.Start()
+		health = connectionManager
+	}
+
+	rules := resolveRulesEngine()
+	rules.severities = severities
+	drones := resolveDroneRegistry()
+	rules.fleets = drones
+	if os.Getenv("REQUIRE_REGISTERED_DRONES") == "true" {
+		if drones.path == "" {
+			failOnError(errors.New("DRONE_REGISTRY_FILE is not set, so every drone would be rejected after a restart"), "Refusing to require registered drones")
+		}
+		fmt.Printf("Rejecting commands of unregistered drones\n")
+		rules.directory = drones
+	}
+
+	operators := resolveJWTAuthenticator()
+	document := initRoutes(mx, formatter, resolveIdempotencyStore(), rules, resolveTimestamper(), operators, tenants, defaultCommands, dispatchers)
+	initDroneRoutes(mx, formatter, operators, tenants, drones, dispatchers)
+	mx.HandleFunc(healthRoute, healthHandler(formatter, health)).Methods("GET")
 
-	initRoutes(mx, formatter, telemetryDispatcher, alertDispatcher, positionDispatcher)
+	var inspector *deadLetterInspector
+	if connectionManager != nil && deadLettersEnabled() {
+		inspector = newDeadLetterInspector(connectionManager.Channel, defaultCommands.queues())
+	}
+	initDeadLetterRoutes(mx, formatter, operators, inspector)
+
+	if operators != nil {
+		n.Use(operators)
+	}
+	if drones := resolveDroneAuthenticator(); drones != nil {
+		n.Use(drones)
+	}
+	if os.Getenv("OPENAPI_VALIDATION") == "true" {
+		fmt.Printf("Validating requests against the OpenAPI document\n")
+		n.UseFunc(openAPIValidator(document))
+	}
 
 	n.UseHandler(mx)
 	return n
 }
 
-func buildDispatcher(queueName string) queueDispatcher {
-	url := resolveAMQPURL()
+func buildConnectionManager(url string, severities *severityMap) *AMQPConnectionManager {
 	if strings.Compare(url, "fake://foo") == 0 {
+		return nil
+	}
+	connectionManager := NewAMQPConnectionManager(url)
+	connectionManager.topology = resolveTopology()
+	connectionManager.severities = severities
+	var deadLettered []string
+	if deadLettersEnabled() {
+		fmt.Printf("Dead-lettering the command queues\n")
+		deadLettered = defaultCommands.queues()
+	}
+	archived := resolveArchivedQueues()
+	if len(deadLettered) > 0 || len(archived) > 0 {
+		connectionManager.topology = connectionManager.topology.withDeadLetters(deadLettered, archived)
+	}
+	if os.Getenv("ALERT_PRIORITY_QUEUE") == "true" {
+		fmt.Printf("Declaring the queues of alerts as priority queues\n")
+		connectionManager.topology = connectionManager.topology.withMaxPriority("alerts", severities.maxPriority())
+	}
+	return connectionManager
+}
+
+func deadLettersEnabled() bool {
+	return os.Getenv("DEAD_LETTER_QUEUES") == "true"
+}
+
+// resolveArchivedQueues returns the queues whose expired messages are kept
+// in an archive queue, as a comma separated list.
+func resolveArchivedQueues() []string {
+	archived := make([]string, 0)
+	for _, queueName := range strings.Split(os.Getenv("ARCHIVE_EXPIRED_QUEUES"), ",") {
+		if queueName = strings.TrimSpace(queueName); queueName != "" {
+			fmt.Printf("Archiving expired messages of queue '%s'\n", queueName)
+			archived = append(archived, queueName)
+		}
+	}
+	return archived
+}
+
+func buildDispatcher(connectionManager *AMQPConnectionManager, queueName string) queueDispatcher {
+	if connectionManager == nil {
 		fmt.Printf("Building fake dispatcher for queue '%s'\n", queueName)
 		return fakes.NewFakeQueueDispatcher()
 	}
-	return createAMQPDispatcher(queueName, url)
+
+	dispatcher := connectionManager.Dispatcher(queueName)
+	dispatcher.structuredCloudEvents = resolveCloudEventsMode() == cloudEventsStructuredMode
+	outboxDir := os.Getenv("OUTBOX_DIR")
+	if outboxDir == "" {
+		return dispatcher
+	}
+
+	outbox, err := NewFileOutbox(filepath.Join(outboxDir, queueName+outboxExtension), dispatcher)
+	failOnError(err, "Failed to open outbox")
+	connectionManager.OnReconnect(outbox.Flush)
+	outbox.Start()
+	fmt.Printf("Using outbox '%s' for queue '%s'\n", outbox.path, queueName)
+	return outbox
 }
 
-func initRoutes(mx *mux.Router, formatter *render.Render, telemetryDispatcher queueDispatcher, alertDispatcher queueDispatcher, positionDispatcher queueDispatcher) {
-	mx.HandleFunc("/api/cmds/telemetry", addTelemetryHandler(formatter, telemetryDispatcher)).Methods("POST")
-	mx.HandleFunc("/api/cmds/alerts", addAlertHandler(formatter, alertDispatcher)).Methods("POST")
-	mx.HandleFunc("/api/cmds/positions", addPositionHandler(formatter, positionDispatcher)).Methods("POST")
+// initRoutes registers every command route twice: as is, scoped by the
+// operator claims, and under /api/fleets/{fleet}/cmds, scoped by the route.
+// initRoutes mounts the command routes and returns the OpenAPI document of
+// every route mounted on the router.
+func initRoutes(mx *mux.Router, formatter *render.Render, idempotencyStore IdempotencyStore, rules *rulesEngine, stamper *timestamper, operators *jwtAuthenticator, tenants *tenantDirectory, registry *commandRegistry, dispatchers map[string]queueDispatcher) func() *openAPIDocument {
+	registry.checkValidated(rules)
+	for _, definition := range registry.all() {
+		handler := operators.require(definition.Scopes, tenantScoped(tenants, rules.fleets, idempotent(idempotencyStore, addCommandHandler(formatter, rules, stamper, definition, dispatchers[definition.Queue]))))
+		mx.HandleFunc(definition.Route, handler).Methods("POST")
+		mx.HandleFunc(fleetRoute(definition.Route), handler).Methods("POST")
+	}
+	batchHandler := operators.require(registry.scopes(), tenantScoped(tenants, rules.fleets, idempotent(idempotencyStore, addBatchHandler(formatter, idempotencyStore, rules, stamper, registry, dispatchers))))
+	mx.HandleFunc(batchRoute, batchHandler).Methods("POST")
+	mx.HandleFunc(fleetRoute(batchRoute), batchHandler).Methods("POST")
+	document := cachedOpenAPIDocument(registry, rules, mx)
+	mx.HandleFunc(openAPIRoute, openAPIHandler(formatter, document)).Methods("GET")
+	return document
 }
 
 func resolveAMQPURL() string {
@@ -56,32 +195,17 @@ func resolveAMQPURL() string {
 	return url
 }
 
-func createAMQPDispatcher(queueName string, url string) queueDispatcher {
-	fmt.Printf("\nUsing URL (%s) for Rabbit.\n", url)
-
-	conn, err := amqp.Dial(url)
-	failOnError(err, "Failed to connect to RabbitMQ")
-
-	ch, err := conn.Channel()
-	failOnError(err, "Failed to open a channel")
-
-	q, err := ch.QueueDeclare(
-		queueName,
-		false,
-		false,
-		false,
-		false,
-		nil,
-	)
-
-	failOnError(err, "Failed to declare a queue")
-	dispatcher := NewAMQPDispatcher(ch, q.Name, false)
-	return dispatcher
-}
-
 func failOnError(err error, msg string) {
 	if err != nil {
 		log.Fatalf("%s: %s", msg, err)
 		panic(fmt.Sprintf("%s: %s", msg, err))
 	}
 }
+
+func resolveCloudEventsMode() string {
+	mode := os.Getenv("CLOUDEVENTS_MODE")
+	if mode != cloudEventsStructuredMode {
+		return cloudEventsBinaryMode
+	}
+	return mode
+}
@@ -0,0 +1,154 @@
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	severityInfo     = "info"
+	severityWarning  = "warning"
+	severityCritical = "critical"
+)
+
+// defaultSeverityPriorities are the AMQP priorities alerts are published
+// with, by severity, unless the severities file sets them.
+var defaultSeverityPriorities = map[string]uint8{
+	severityInfo:     1,
+	severityWarning:  5,
+	severityCritical: 9,
+}
+
+const defaultMaxSeverityPriority = 9
+
+// defaultSeverities are used when no severities file is configured.
+const defaultSeverities = `
+default: warning
+`
+
+type faultCodeRange struct {
+	Min      int    `yaml:"min"`
+	Max      int    `yaml:"max"`
+	Severity string `yaml:"severity"`
+}
+
+// severityMap maps the fault codes of alerts onto severities, and the
+// severities onto the AMQP priorities alerts are published with. The first
+// range holding a fault code wins; other codes get the default severity.
+// Priorities add to or override the default ones, and priority queues are
+// declared with MaxPriority, the highest priority unless set, as their
+// x-max-priority.
+type severityMap struct {
+	Default     string           `yaml:"default"`
+	FaultCodes  []faultCodeRange `yaml:"fault_codes"`
+	Priorities  map[string]uint8 `yaml:"priorities"`
+	MaxPriority uint8            `yaml:"max_priority"`
+}
+
+// severityCommand is implemented by commands whose events carry a severity.
+type severityCommand interface {
+	classify(severities *severityMap)
+}
+
+func parseSeverities(data []byte) (*severityMap, error) {
+	var severities severityMap
+	err := yaml.UnmarshalStrict(data, &severities)
+	if err != nil {
+		return nil, err
+	}
+
+	priorities := make(map[string]uint8)
+	for severity, priority := range defaultSeverityPriorities {
+		priorities[severity] = priority
+	}
+	for severity, priority := range severities.Priorities {
+		priorities[severity] = priority
+	}
+	highest := uint8(0)
+	for _, priority := range priorities {
+		if priority > highest {
+			highest = priority
+		}
+	}
+	severities.Priorities = priorities
+	if severities.MaxPriority == 0 {
+		severities.MaxPriority = highest
+	}
+	if highest > severities.MaxPriority {
+		return nil, fmt.Errorf("priorities up to %d are above the maximum priority %d", highest, severities.MaxPriority)
+	}
+
+	if _, ok := priorities[severities.Default]; !ok {
+		return nil, fmt.Errorf("unknown default severity '%s'", severities.Default)
+	}
+	for _, codes := range severities.FaultCodes {
+		if _, ok := priorities[codes.Severity]; !ok {
+			return nil, fmt.Errorf("unknown severity '%s' of fault codes %d-%d", codes.Severity, codes.Min, codes.Max)
+		}
+		if codes.Min > codes.Max {
+			return nil, fmt.Errorf("empty fault code range %d-%d", codes.Min, codes.Max)
+		}
+	}
+	return &severities, nil
+}
+
+// loadSeverities reads a YAML or JSON severities file.
+func loadSeverities(path string) (*severityMap, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseSeverities(data)
+}
+
+// of returns the severity of a fault code. Without a map, alerts have no
+// severity.
+func (s *severityMap) of(faultCode int) string {
+	if s == nil {
+		return ""
+	}
+	for _, codes := range s.FaultCodes {
+		if faultCode >= codes.Min && faultCode <= codes.Max {
+			return codes.Severity
+		}
+	}
+	return s.Default
+}
+
+// priority returns the AMQP priority of the alerts of a severity. Without a
+// map, the default priorities apply.
+func (s *severityMap) priority(severity string) uint8 {
+	if s == nil {
+		return defaultSeverityPriorities[severity]
+	}
+	return s.Priorities[severity]
+}
+
+// maxPriority returns the x-max-priority of the queues alerts go to.
+func (s *severityMap) maxPriority() uint8 {
+	if s == nil {
+		return defaultMaxSeverityPriority
+	}
+	return s.MaxPriority
+}
+
+func (alert *alertCommand) classify(severities *severityMap) {
+	alert.severity = severities.of(alert.FaultCode)
+}
+
+func resolveSeverities() *severityMap {
+	path := os.Getenv("ALERT_SEVERITIES_FILE")
+	if path == "" {
+		severities, err := parseSeverities([]byte(defaultSeverities))
+		failOnError(err, "Invalid default severities")
+		return severities
+	}
+
+	severities, err := loadSeverities(path)
+	failOnError(err, "Failed to load alert severities")
+	fmt.Printf("Using %d fault code range(s) from '%s'\n", len(severities.FaultCodes), path)
+	return severities
+}
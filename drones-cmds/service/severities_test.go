@@ -0,0 +1,109 @@
+package service
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/maxsuelmarinho/golang-event-driven-example/drones-cmds/fakes"
+	dronescommon "github.com/maxsuelmarinho/golang-event-driven-example/drones-common"
+)
+
+const testSeverities = `
+default: warning
+fault_codes:
+  - {min: 1, max: 99, severity: info}
+  - {min: 500, max: 599, severity: critical}
+`
+
+func TestSeverityOfFaultCodes(t *testing.T) {
+	severities, err := parseSeverities([]byte(testSeverities))
+	if err != nil {
+		t.Fatalf("Failed to parse severities: %s", err)
+	}
+
+	for faultCode, expected := range map[int]string{12: severityInfo, 200: severityWarning, 503: severityCritical} {
+		if severity := severities.of(faultCode); severity != expected {
+			t.Errorf("Expected fault code %d to be %s, got %s", faultCode, expected, severity)
+		}
+	}
+	if severity := (*severityMap)(nil).of(503); severity != "" {
+		t.Errorf("Expected no severity without a map, got %s", severity)
+	}
+
+	for _, invalid := range []string{"default: urgent", "default: info\nfault_codes: [{min: 9, max: 1, severity: info}]", "default: info\nfault_codes: [{min: 1, max: 9, severity: fatal}]"} {
+		if _, err := parseSeverities([]byte(invalid)); err == nil {
+			t.Errorf("Expected severities to be rejected: %s", invalid)
+		}
+	}
+}
+
+func TestSeverityPrioritiesAreConfigurable(t *testing.T) {
+	severities, err := parseSeverities([]byte("default: warning\npriorities: {warning: 2, fatal: 4}\nfault_codes: [{min: 1, max: 9, severity: fatal}]\nmax_priority: 10"))
+	if err != nil {
+		t.Fatalf("Failed to parse severities: %s", err)
+	}
+	if severities.priority(severityWarning) != 2 || severities.priority("fatal") != 4 || severities.priority(severityCritical) != 9 || severities.maxPriority() != 10 {
+		t.Errorf("Expected configured priorities over the default ones, got %v up to %d", severities.Priorities, severities.maxPriority())
+	}
+
+	severities, _ = parseSeverities([]byte("default: warning\npriorities: {critical: 20}"))
+	if severities.maxPriority() != 20 {
+		t.Errorf("Expected the highest priority to be the maximum, got %d", severities.maxPriority())
+	}
+	if _, err := parseSeverities([]byte("default: warning\nmax_priority: 5")); err == nil {
+		t.Errorf("Expected priorities above the maximum to be rejected")
+	}
+}
+
+func TestAlertsArePublishedWithTheirPriority(t *testing.T) {
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	rules := newDefaultRulesEngine()
+	rules.severities, _ = parseSeverities([]byte(testSeverities))
+	mx := mux.NewRouter()
+	initRoutes(mx, formatter, NewLRUIdempotencyStore(100, time.Minute), rules, newTimestamper(systemClock{}), nil, nil, defaultCommands, map[string]queueDispatcher{"alerts": dispatcher})
+
+	recorder := sendRequest(mx, "POST", "/api/cmds/alerts", `{"drone_id": "drone1", "fault_code": 503, "description": "motor failure"}`)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected alert to be accepted, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	envelope := dispatcher.Messages[0].(dronescommon.EventEnvelope)
+	publishing, _ := newPublishing(envelope, false, rules.severities)
+	if publishing.Priority != rules.severities.maxPriority() || publishing.Headers["severity"] != severityCritical {
+		t.Errorf("Expected critical alert to get the highest priority, got %d with %v", publishing.Priority, publishing.Headers["severity"])
+	}
+	if key := routingKey("alerts.{severity}", "alerts", envelope); key != "alerts.critical" {
+		t.Errorf("Expected alerts to be routable by severity, got '%s'", key)
+	}
+
+	telemetry, _ := dronescommon.NewEventEnvelope(dronescommon.TelemetryUpdatedEventType, 1, eventSource, dronescommon.TelemetryUpdatedEvent{DroneID: "drone1"})
+	if publishing, _ := newPublishing(telemetry, false, rules.severities); publishing.Priority != 0 {
+		t.Errorf("Expected events without severity to keep the default priority, got %d", publishing.Priority)
+	}
+}
+
+func TestAlertPriorityQueue(t *testing.T) {
+	topology := (*amqpTopology)(nil).withMaxPriority("alerts", defaultMaxSeverityPriority)
+	if args := topology.queue("acme.alerts").arguments(); args["x-max-priority"] != uint8(defaultMaxSeverityPriority) {
+		t.Errorf("Expected alerts to be declared as a priority queue, got %v", args)
+	}
+
+	configured := &amqpTopology{Queues: map[string]queueConfig{"alerts": {MaxPriority: 3}}}
+	if queue := configured.withMaxPriority("alerts", defaultMaxSeverityPriority).Queues["alerts"]; queue.MaxPriority != 3 {
+		t.Errorf("Expected configured priority to be kept, got %d", queue.MaxPriority)
+	}
+
+	path := writeTestTopology(t, testTopology)
+	defer os.Remove(path)
+	routed, _ := loadTopology(path)
+	routed = routed.withMaxPriority("alerts", defaultMaxSeverityPriority)
+	if routed.Queues["acme-alerts"].MaxPriority != defaultMaxSeverityPriority || routed.Queues["drone1-telemetry"].MaxPriority != 0 {
+		t.Errorf("Expected the queues bound for alerts to be priority queues, got %v", routed.Queues)
+	}
+	if _, ok := routed.Queues["alerts"]; ok {
+		t.Errorf("Expected no queue 'alerts' behind an exchange, got %v", routed.Queues["alerts"])
+	}
+}
@@ -0,0 +1,326 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	dronescommon "github.com/maxsuelmarinho/golang-event-driven-example/drones-common"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	fleetRoutePrefix = "/api/fleets/{fleet}/cmds"
+
+	problemUnknownFleet  = problemTypePrefix + "unknown-fleet"
+	problemQuotaExceeded = problemTypePrefix + "quota-exceeded"
+	requestScopeKey      = contextKey("request-scope")
+	tenantQueueSeparator = "."
+
+	// maxTenantDispatchers bounds the per-tenant queues built without a
+	// tenant directory, when any tenant claim may name a new one.
+	maxTenantDispatchers = 1000
+)
+
+// tenantNamePattern keeps tenant names usable in queue and outbox file
+// names.
+var tenantNamePattern = regexp.MustCompile("^[a-z0-9-]+$")
+
+func checkTenantName(tenant string) error {
+	if !tenantNamePattern.MatchString(tenant) {
+		return fmt.Errorf("tenant '%s' must match %s", tenant, tenantNamePattern)
+	}
+	return nil
+}
+
+// requestScope is the tenant and fleet a request acts for.
+type requestScope struct {
+	Tenant string
+	Fleet  string
+}
+
+type tenantConfig struct {
+	Fleets            []string `yaml:"fleets"`
+	RequestsPerMinute int      `yaml:"requests_per_minute"`
+}
+
+// tenantDirectory knows the fleets of every tenant and enforces their
+// request quotas.
+type tenantDirectory struct {
+	tenants      map[string]tenantConfig
+	fleetTenants map[string]string
+	clock        clock
+
+	mutex   sync.Mutex
+	buckets map[string]*quotaBucket
+}
+
+// quotaBucket is a token bucket refilled at the quota rate, holding at most
+// one minute of requests.
+type quotaBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+func newTenantDirectory(tenants map[string]tenantConfig, c clock) (*tenantDirectory, error) {
+	directory := &tenantDirectory{
+		tenants:      tenants,
+		fleetTenants: make(map[string]string),
+		clock:        c,
+		buckets:      make(map[string]*quotaBucket),
+	}
+	for tenant, config := range tenants {
+		if err := checkTenantName(tenant); err != nil {
+			return nil, err
+		}
+		for _, fleet := range config.Fleets {
+			if owner, ok := directory.fleetTenants[fleet]; ok {
+				return nil, fmt.Errorf("fleet '%s' belongs to tenants '%s' and '%s'", fleet, owner, tenant)
+			}
+			directory.fleetTenants[fleet] = tenant
+		}
+	}
+	return directory, nil
+}
+
+// loadTenants reads a YAML or JSON map of tenants to their fleets and quota.
+func loadTenants(path string, c clock) (*tenantDirectory, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config struct {
+		Tenants map[string]tenantConfig `yaml:"tenants"`
+	}
+	err = yaml.UnmarshalStrict(data, &config)
+	if err != nil {
+		return nil, err
+	}
+	return newTenantDirectory(config.Tenants, c)
+}
+
+func (d *tenantDirectory) knows(tenant string) bool {
+	_, ok := d.tenants[tenant]
+	return ok
+}
+
+// allow takes a request from the quota of a tenant, returning how long to
+// wait when there is none left.
+func (d *tenantDirectory) allow(tenant string) (bool, time.Duration) {
+	perMinute := d.tenants[tenant].RequestsPerMinute
+	if perMinute <= 0 {
+		return true, 0
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := d.clock.Now()
+	bucket, ok := d.buckets[tenant]
+	if !ok {
+		bucket = &quotaBucket{tokens: float64(perMinute), updatedAt: now}
+		d.buckets[tenant] = bucket
+	}
+
+	rate := float64(perMinute) / time.Minute.Seconds()
+	bucket.tokens = math.Min(float64(perMinute), bucket.tokens+now.Sub(bucket.updatedAt).Seconds()*rate)
+	bucket.updatedAt = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// tenantScoped resolves the tenant and fleet of a request from the route,
+// the operator claims and the fleet signing drones are registered with,
+// rejecting requests for fleets the sender does not belong to and requests
+// over the quota of their tenant. Without a tenant directory, the tenant
+// comes from the claims only, and nothing tells whether a fleet is of the
+// tenant of operators without a fleet claim, so they may not use the route
+// of any fleet.
+func tenantScoped(tenants *tenantDirectory, fleets droneFleets, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var scope requestScope
+		sender := "Request"
+		op, isOperator := authenticatedOperator(req)
+		if isOperator {
+			scope = requestScope{Tenant: op.Tenant, Fleet: op.Fleet}
+			sender = fmt.Sprintf("Operator '%s'", op.Subject)
+		}
+		droneID, isDrone := authenticatedDrone(req)
+		if isDrone {
+			if fleets != nil {
+				scope.Fleet, _ = fleets.fleetOf(droneID)
+			}
+			sender = fmt.Sprintf("Drone '%s'", droneID)
+		}
+
+		if fleet, ok := mux.Vars(req)["fleet"]; ok {
+			if (scope.Fleet != "" || isDrone) && scope.Fleet != fleet {
+				p := newProblem(problemForbidden, http.StatusForbidden, "Request is for another fleet.")
+				p.Detail = fmt.Sprintf("%s may not send commands for fleet '%s'.", sender, fleet)
+				writeProblem(w, req, p)
+				return
+			}
+			if tenants == nil && isOperator && op.Tenant != "" && op.Fleet == "" {
+				p := newProblem(problemForbidden, http.StatusForbidden, "Fleet of an unknown tenant.")
+				p.Detail = fmt.Sprintf("%s of tenant '%s' needs a fleet claim to send commands for fleet '%s'.", sender, op.Tenant, fleet)
+				writeProblem(w, req, p)
+				return
+			}
+			scope.Fleet = fleet
+		}
+
+		if tenants != nil && scope.Fleet != "" {
+			tenant, ok := tenants.fleetTenants[scope.Fleet]
+			if !ok {
+				p := newProblem(problemUnknownFleet, http.StatusNotFound, "Unknown fleet.")
+				p.Detail = fmt.Sprintf("Fleet '%s' belongs to no tenant.", scope.Fleet)
+				writeProblem(w, req, p)
+				return
+			}
+			if scope.Tenant != "" && scope.Tenant != tenant {
+				p := newProblem(problemForbidden, http.StatusForbidden, "Request is for another tenant.")
+				p.Detail = fmt.Sprintf("Fleet '%s' does not belong to tenant '%s'.", scope.Fleet, scope.Tenant)
+				writeProblem(w, req, p)
+				return
+			}
+			scope.Tenant = tenant
+		}
+
+		if tenants != nil && scope.Tenant != "" {
+			if !tenants.knows(scope.Tenant) {
+				p := newProblem(problemForbidden, http.StatusForbidden, "Unknown tenant.")
+				p.Detail = fmt.Sprintf("%s is of tenant '%s', which is not in the tenant directory.", sender, scope.Tenant)
+				writeProblem(w, req, p)
+				return
+			}
+			if ok, wait := tenants.allow(scope.Tenant); !ok {
+				p := newProblem(problemQuotaExceeded, http.StatusTooManyRequests, "Tenant quota exceeded.")
+				p.RetryAfter = int(math.Ceil(wait.Seconds()))
+				p.Detail = fmt.Sprintf("Tenant '%s' may send %d requests per minute.", scope.Tenant, tenants.tenants[scope.Tenant].RequestsPerMinute)
+				w.Header().Set("Retry-After", fmt.Sprint(p.RetryAfter))
+				writeProblem(w, req, p)
+				return
+			}
+		}
+
+		next(w, req.WithContext(context.WithValue(req.Context(), requestScopeKey, scope)))
+	}
+}
+
+// scopeOf returns the tenant and fleet a request acts for.
+func scopeOf(req *http.Request) requestScope {
+	if scope, ok := req.Context().Value(requestScopeKey).(requestScope); ok {
+		return scope
+	}
+	if op, ok := authenticatedOperator(req); ok {
+		return requestScope{Tenant: op.Tenant, Fleet: op.Fleet}
+	}
+	return requestScope{}
+}
+
+// fleetRoute returns the fleet-scoped variant of a command route.
+func fleetRoute(route string) string {
+	return fleetRoutePrefix + strings.TrimPrefix(route, "/api/cmds")
+}
+
+// tenantDispatcher isolates tenants by dispatching their events to queues
+// of their own, named <tenant>.<queue>. Events without a tenant go to the
+// shared queue. With a tenant directory, only its tenants get a queue;
+// without one, at most maxTenantDispatchers tenants do.
+type tenantDispatcher struct {
+	queueName string
+	shared    queueDispatcher
+	build     func(queueName string) queueDispatcher
+	directory *tenantDirectory
+
+	mutex   sync.Mutex
+	tenants map[string]queueDispatcher
+}
+
+func newTenantDispatcher(queueName string, shared queueDispatcher, directory *tenantDirectory, build func(queueName string) queueDispatcher) *tenantDispatcher {
+	return &tenantDispatcher{queueName: queueName, shared: shared, build: build, directory: directory, tenants: make(map[string]queueDispatcher)}
+}
+
+func (d *tenantDispatcher) DispatchMessage(message interface{}) error {
+	envelope, ok := message.(dronescommon.EventEnvelope)
+	if !ok || envelope.TenantID == "" {
+		return d.shared.DispatchMessage(message)
+	}
+	dispatcher, err := d.forTenant(envelope.TenantID)
+	if err != nil {
+		return err
+	}
+	return dispatcher.DispatchMessage(message)
+}
+
+func (d *tenantDispatcher) forTenant(tenant string) (queueDispatcher, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if dispatcher, ok := d.tenants[tenant]; ok {
+		return dispatcher, nil
+	}
+	if err := checkTenantName(tenant); err != nil {
+		return nil, err
+	}
+	if d.directory != nil && !d.directory.knows(tenant) {
+		return nil, fmt.Errorf("tenant '%s' is not in the tenant directory", tenant)
+	}
+	if len(d.tenants) >= maxTenantDispatchers {
+		return nil, fmt.Errorf("queue '%s' already has %d tenants", d.queueName, maxTenantDispatchers)
+	}
+	dispatcher := d.build(tenant + tenantQueueSeparator + d.queueName)
+	d.tenants[tenant] = dispatcher
+	return dispatcher, nil
+}
+
+// openOutboxes builds the dispatchers of the tenants with an outbox left in
+// dir, so the messages they kept are replayed without waiting for the
+// tenant to send again.
+func (d *tenantDispatcher) openOutboxes(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	suffix := tenantQueueSeparator + d.queueName + outboxExtension
+	for _, file := range files {
+		tenant := strings.TrimSuffix(file.Name(), suffix)
+		if file.IsDir() || tenant == file.Name() || tenant == "" || strings.Contains(tenant, tenantQueueSeparator) {
+			continue
+		}
+		if _, err := d.forTenant(tenant); err != nil {
+			fmt.Printf("Not recovering outbox '%s': %s\n", file.Name(), err)
+			continue
+		}
+		fmt.Printf("Recovering outbox of tenant '%s' for queue '%s'\n", tenant, d.queueName)
+	}
+	return nil
+}
+
+func resolveTenants() *tenantDirectory {
+	path := os.Getenv("TENANTS_FILE")
+	if path == "" {
+		return nil
+	}
+
+	tenants, err := loadTenants(path, systemClock{})
+	failOnError(err, "Failed to load tenants")
+	fmt.Printf("Using %d tenant(s) from '%s'\n", len(tenants.tenants), path)
+	return tenants
+}
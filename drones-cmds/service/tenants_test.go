@@ -0,0 +1,224 @@
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/maxsuelmarinho/golang-event-driven-example/drones-cmds/fakes"
+	dronescommon "github.com/maxsuelmarinho/golang-event-driven-example/drones-common"
+)
+
+func makeTenantServer(tenants *tenantDirectory, dispatcher queueDispatcher) *mux.Router {
+	dispatchers := make(map[string]queueDispatcher)
+	for _, queueName := range defaultCommands.queues() {
+		dispatchers[queueName] = dispatcher
+	}
+
+	mx := mux.NewRouter()
+	initRoutes(mx, formatter, NewLRUIdempotencyStore(100, time.Minute), newDefaultRulesEngine(), newTimestamper(systemClock{}), nil, tenants, defaultCommands, dispatchers)
+	return mx
+}
+
+func newTestTenants(t *testing.T, c clock) *tenantDirectory {
+	tenants, err := newTenantDirectory(map[string]tenantConfig{
+		"acme":    {Fleets: []string{"crop-sprayers"}, RequestsPerMinute: 2},
+		"initech": {Fleets: []string{"surveyors"}},
+	}, c)
+	if err != nil {
+		t.Fatalf("Failed to build tenants: %s", err)
+	}
+	return tenants
+}
+
+func TestFleetRouteScopesEvents(t *testing.T) {
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	server := makeTenantServer(newTestTenants(t, &fakes.FakeClock{Time: receivedAt}), dispatcher)
+
+	recorder := sendRequest(server, "POST", "/api/fleets/surveyors/cmds/telemetry", `{"drone_id": "drone1", "uptime": 10}`)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected fleet command to be accepted, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	envelope := dispatcher.Messages[0].(dronescommon.EventEnvelope)
+	if envelope.TenantID != "initech" || envelope.FleetID != "surveyors" {
+		t.Errorf("Expected event of tenant initech and fleet surveyors, got '%s' and '%s'", envelope.TenantID, envelope.FleetID)
+	}
+
+	if recorder := sendRequest(server, "POST", "/api/fleets/ghosts/cmds/telemetry", `{"drone_id": "drone1", "uptime": 10}`); recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected command of an unknown fleet to be rejected, got %d", recorder.Code)
+	}
+
+	body := `{"drone_id": "drone1", "latitude": 1, "longitude": 1, "fleet_id": "crop-sprayers"}`
+	if recorder := sendRequest(server, "POST", "/api/fleets/surveyors/cmds/positions", body); recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected position of another fleet to be forbidden, got %d", recorder.Code)
+	}
+	if recorder := sendRequest(server, "POST", "/api/cmds/telemetry", `{"drone_id": "drone1", "uptime": 10}`); recorder.Code != http.StatusCreated {
+		t.Errorf("Expected unscoped command to be accepted, got %d", recorder.Code)
+	}
+}
+
+func TestOperatorMayNotUseAnotherFleetRoute(t *testing.T) {
+	server := makeOperatorServer(t, fakes.NewFakeQueueDispatcher())
+	token := signJWT("rsa1", "RS256", operatorClaims("drone:write"))
+
+	if recorder := postAsOperator(server, token, "/api/fleets/surveyors/cmds/telemetry", `{"drone_id": "drone1", "uptime": 10}`); recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected operator to be kept out of another fleet, got %d", recorder.Code)
+	}
+	if recorder := postAsOperator(server, token, "/api/fleets/crop-sprayers/cmds/telemetry", `{"drone_id": "drone1", "uptime": 10}`); recorder.Code != http.StatusCreated {
+		t.Errorf("Expected operator to reach its own fleet, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestOperatorOfAnUnknownTenantIsRejected(t *testing.T) {
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	server := asOperator(makeTenantServer(newTestTenants(t, systemClock{}), dispatcher), &operator{Subject: "intruder", Tenant: "globex", permissions: map[string]bool{"drone:write": true}})
+
+	if recorder := sendRequest(server, "POST", "/api/cmds/telemetry", `{"drone_id": "drone1", "uptime": 10}`); recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected operator of a tenant missing from the directory to be rejected, got %d", recorder.Code)
+	}
+	if len(dispatcher.Messages) != 0 {
+		t.Errorf("Expected no event of an unknown tenant, got %d", len(dispatcher.Messages))
+	}
+}
+
+func TestSenderFleetIsCheckedAgainstTheRoute(t *testing.T) {
+	dispatcher := fakes.NewFakeQueueDispatcher()
+	server := makeOperatorServer(t, dispatcher)
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, signedRequest("drone1", "secret1", "/api/fleets/surveyors/cmds/telemetry", `{"drone_id": "drone1", "uptime": 10}`, "n1", signedAt))
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected drone to be kept out of another fleet, got %d", recorder.Code)
+	}
+
+	claims := operatorClaims("drone:write")
+	delete(claims, "fleet")
+	token := signJWT("rsa1", "RS256", claims)
+	for _, droneID := range []string{"drone1", "drone8", "drone9"} {
+		recorder := postAsOperator(server, token, "/api/fleets/delivery/cmds/telemetry", `{"drone_id": "`+droneID+`", "uptime": 10}`)
+		if recorder.Code != http.StatusForbidden {
+			t.Errorf("Expected operator of a tenant without a fleet claim to be kept out of fleet routes without a tenant directory, got %d", recorder.Code)
+		}
+	}
+	if recorder := postAsOperator(server, token, "/api/cmds/telemetry", `{"drone_id": "drone8", "uptime": 10}`); recorder.Code != http.StatusCreated {
+		t.Errorf("Expected operator of a tenant to keep the unscoped routes, got %d", recorder.Code)
+	}
+	if len(dispatcher.Messages) != 1 {
+		t.Errorf("Expected only the unscoped command to be dispatched, got %d event(s)", len(dispatcher.Messages))
+	}
+}
+
+func TestTenantQuota(t *testing.T) {
+	clock := &fakes.FakeClock{Time: receivedAt}
+	server := makeTenantServer(newTestTenants(t, clock), fakes.NewFakeQueueDispatcher())
+	send := func() int {
+		return sendRequest(server, "POST", "/api/fleets/crop-sprayers/cmds/telemetry", `{"drone_id": "drone1", "uptime": 10}`).Code
+	}
+
+	if send() != http.StatusCreated || send() != http.StatusCreated {
+		t.Fatalf("Expected requests within the quota to be accepted")
+	}
+	recorder := sendRequest(server, "POST", "/api/fleets/crop-sprayers/cmds/telemetry", `{"drone_id": "drone1", "uptime": 10}`)
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") != "30" {
+		t.Errorf("Expected request over the quota to be throttled for 30s, got %d after %s", recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+	if code := sendRequest(server, "POST", "/api/fleets/surveyors/cmds/telemetry", `{"drone_id": "drone1", "uptime": 10}`).Code; code != http.StatusCreated {
+		t.Errorf("Expected other tenants to keep their quota, got %d", code)
+	}
+
+	clock.Time = clock.Time.Add(30 * time.Second)
+	if send() != http.StatusCreated {
+		t.Errorf("Expected quota to refill over time")
+	}
+}
+
+func TestTenantDispatcherIsolatesTenants(t *testing.T) {
+	shared := fakes.NewFakeQueueDispatcher()
+	built := make(map[string]*fakes.FakeQueueDispatcher)
+	dispatcher := newTenantDispatcher("telemetry", shared, newTestTenants(t, systemClock{}), func(queueName string) queueDispatcher {
+		built[queueName] = fakes.NewFakeQueueDispatcher()
+		return built[queueName]
+	})
+
+	dispatcher.DispatchMessage(dronescommon.EventEnvelope{TenantID: "acme"})
+	dispatcher.DispatchMessage(dronescommon.EventEnvelope{TenantID: "acme"})
+	dispatcher.DispatchMessage(dronescommon.EventEnvelope{TenantID: "initech"})
+	dispatcher.DispatchMessage(dronescommon.EventEnvelope{})
+	if err := dispatcher.DispatchMessage(dronescommon.EventEnvelope{TenantID: "globex"}); err == nil {
+		t.Errorf("Expected tenants missing from the directory to get no queue")
+	}
+
+	if len(built) != 2 || len(built["acme.telemetry"].Messages) != 2 || len(built["initech.telemetry"].Messages) != 1 {
+		t.Errorf("Expected one queue per tenant, got %v", built)
+	}
+	if len(shared.Messages) != 1 {
+		t.Errorf("Expected events without tenant on the shared queue, got %d", len(shared.Messages))
+	}
+}
+
+func TestTenantOutboxesAreOpenedOnStartup(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "outbox")
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"acme.telemetry.wal", "initech.telemetry.wal", "telemetry.wal", "acme.alerts.wal", "acme.telemetry.wal.parked", "Acme.telemetry.wal"} {
+		ioutil.WriteFile(filepath.Join(dir, name), nil, 0600)
+	}
+
+	built := make(map[string]bool)
+	dispatcher := newTenantDispatcher("telemetry", fakes.NewFakeQueueDispatcher(), nil, func(queueName string) queueDispatcher {
+		built[queueName] = true
+		return fakes.NewFakeQueueDispatcher()
+	})
+	if err := dispatcher.openOutboxes(dir); err != nil {
+		t.Fatalf("Failed to open outboxes: %s", err)
+	}
+
+	if len(built) != 2 || !built["acme.telemetry"] || !built["initech.telemetry"] {
+		t.Errorf("Expected the outboxes of both tenants to be opened, got %v", built)
+	}
+}
+
+func TestTenantQueuesAreLimitedWithoutADirectory(t *testing.T) {
+	dispatcher := newTenantDispatcher("telemetry", fakes.NewFakeQueueDispatcher(), nil, func(queueName string) queueDispatcher {
+		return fakes.NewFakeQueueDispatcher()
+	})
+
+	for _, tenant := range []string{"..", "../etc", "acme.telemetry", "Acme", "acme/x"} {
+		if err := dispatcher.DispatchMessage(dronescommon.EventEnvelope{TenantID: tenant}); err == nil {
+			t.Errorf("Expected tenant %q to get no queue", tenant)
+		}
+	}
+	for i := 0; i < maxTenantDispatchers; i++ {
+		if err := dispatcher.DispatchMessage(dronescommon.EventEnvelope{TenantID: fmt.Sprintf("tenant-%d", i)}); err != nil {
+			t.Fatalf("Expected tenant %d to get a queue, got %s", i, err)
+		}
+	}
+	if err := dispatcher.DispatchMessage(dronescommon.EventEnvelope{TenantID: "one-too-many"}); err == nil {
+		t.Errorf("Expected at most %d tenant queues", maxTenantDispatchers)
+	}
+	if err := dispatcher.DispatchMessage(dronescommon.EventEnvelope{TenantID: "tenant-0"}); err != nil {
+		t.Errorf("Expected tenants with a queue to keep it, got %s", err)
+	}
+}
+
+func TestLoadTenants(t *testing.T) {
+	file, _ := ioutil.TempFile("", "tenants")
+	defer os.Remove(file.Name())
+	file.WriteString("tenants:\n  acme:\n    fleets: [crop-sprayers]\n  initech:\n    fleets: [crop-sprayers]\n")
+	file.Close()
+
+	if _, err := loadTenants(file.Name(), systemClock{}); err == nil {
+		t.Errorf("Expected fleets shared by tenants to be rejected")
+	}
+
+	for _, tenant := range []string{"acme.eu", "../acme", "Acme", ""} {
+		if _, err := newTenantDirectory(map[string]tenantConfig{tenant: {Fleets: []string{"crop-sprayers"}}}, systemClock{}); err == nil {
+			t.Errorf("Expected tenant %q to be rejected", tenant)
+		}
+	}
+}
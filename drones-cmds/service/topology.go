@@ -0,0 +1,557 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dronescommon "github.com/maxsuelmarinho/golang-event-driven-example/drones-common"
+	"github.com/streadway/amqp"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// routingKeyPlaceholder matches the {name} placeholders of routing keys.
+var routingKeyPlaceholder = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// emptyRoutingKeyWord stands in for placeholders the event has no value for,
+// so topic patterns keep the same number of words.
+const emptyRoutingKeyWord = "_"
+
+var exchangeTypes = map[string]bool{
+	amqp.ExchangeDirect:  true,
+	amqp.ExchangeFanout:  true,
+	amqp.ExchangeTopic:   true,
+	amqp.ExchangeHeaders: true,
+}
+
+type exchangeConfig struct {
+	Type       string `yaml:"type"`
+	Durable    bool   `yaml:"durable"`
+	AutoDelete bool   `yaml:"auto_delete"`
+}
+
+// publishRoute is where the dispatcher of a queue publishes. Without an
+// exchange, messages go straight to the queue through the default exchange.
+type publishRoute struct {
+	Exchange   string `yaml:"exchange"`
+	RoutingKey string `yaml:"routing_key"`
+}
+
+type bindingConfig struct {
+	Exchange   string                 `yaml:"exchange"`
+	RoutingKey string                 `yaml:"routing_key"`
+	Arguments  map[string]interface{} `yaml:"arguments"`
+}
+
+const (
+	classicQueueType = "classic"
+	quorumQueueType  = "quorum"
+
+	persistentDelivery = "persistent"
+	transientDelivery  = "transient"
+)
+
+// queueConfig holds the declaration arguments of a queue. Queues the
+// topology does not list are declared transient, as they always were.
+//
+// The broker refuses to redeclare a queue with other arguments (406
+// PRECONDITION_FAILED), so making an existing queue durable, a quorum queue,
+// dead-lettered or a priority queue takes deleting it first, once drained.
+// Arguments set through a policy (rabbitmqctl set_policy) apply to existing
+// queues instead, except for the queue type and the maximum priority.
+type queueConfig struct {
+	Durable              bool            `yaml:"durable"`
+	AutoDelete           bool            `yaml:"auto_delete"`
+	Type                 string          `yaml:"type"`
+	MaxLength            int64           `yaml:"max_length"`
+	MaxPriority          uint8           `yaml:"max_priority"`
+	MessageTTL           expiryDuration  `yaml:"message_ttl"`
+	DeadLetterExchange   string          `yaml:"dead_letter_exchange"`
+	DeadLetterRoutingKey string          `yaml:"dead_letter_routing_key"`
+	Bindings             []bindingConfig `yaml:"bindings"`
+}
+
+// arguments returns the x- arguments of the queue declaration.
+func (q queueConfig) arguments() amqp.Table {
+	args := amqp.Table{}
+	if q.Type != "" {
+		args["x-queue-type"] = q.Type
+	}
+	if q.MaxLength > 0 {
+		args["x-max-length"] = q.MaxLength
+	}
+	if q.MaxPriority > 0 {
+		args["x-max-priority"] = q.MaxPriority
+	}
+	if q.MessageTTL > 0 {
+		args["x-message-ttl"] = q.MessageTTL.milliseconds()
+	}
+	if q.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = q.DeadLetterExchange
+	}
+	if q.DeadLetterRoutingKey != "" {
+		args["x-dead-letter-routing-key"] = q.DeadLetterRoutingKey
+	}
+	return args
+}
+
+// deliveryConfig sets whether the messages of each event type survive a
+// broker restart. Event types not listed use the default, transient unless
+// set. Messages of the event types with an expiration are dropped, or
+// dead-lettered, once they sat that long in a queue.
+type deliveryConfig struct {
+	Default    string                    `yaml:"default"`
+	EventTypes map[string]string         `yaml:"event_types"`
+	Expiration map[string]expiryDuration `yaml:"expiration"`
+}
+
+// expiryDuration is a message TTL or expiration, written as a duration like
+// 30s, or as a bare number of milliseconds, the unit the broker counts in.
+type expiryDuration time.Duration
+
+func (d *expiryDuration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var millis int64
+	if unmarshal(&millis) == nil {
+		*d = expiryDuration(time.Duration(millis) * time.Millisecond)
+		return nil
+	}
+
+	var text string
+	err := unmarshal(&text)
+	if err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(text)
+	if err != nil {
+		return err
+	}
+	*d = expiryDuration(duration)
+	return nil
+}
+
+func (d expiryDuration) milliseconds() int64 {
+	return int64(time.Duration(d) / time.Millisecond)
+}
+
+// amqpTopology holds the exchanges, queues and bindings declared on the
+// broker, and the routes the dispatchers publish through. Routing keys may
+// use the {queue}, {event_type}, {tenant}, {fleet}, {drone_id} and
+// {severity} placeholders, e.g. telemetry.{fleet}.{drone_id}.
+type amqpTopology struct {
+	Exchanges map[string]exchangeConfig `yaml:"exchanges"`
+	Publish   map[string]publishRoute   `yaml:"publish"`
+	Queues    map[string]queueConfig    `yaml:"queues"`
+	Delivery  deliveryConfig            `yaml:"delivery"`
+}
+
+// loadTopology reads a YAML or JSON topology file.
+func loadTopology(path string) (*amqpTopology, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var topology amqpTopology
+	err = yaml.UnmarshalStrict(data, &topology)
+	if err != nil {
+		return nil, err
+	}
+	return &topology, topology.check()
+}
+
+func (t *amqpTopology) check() error {
+	for name, exchange := range t.Exchanges {
+		if !exchangeTypes[exchange.Type] {
+			return fmt.Errorf("unknown type '%s' of exchange '%s'", exchange.Type, name)
+		}
+	}
+	for queueName, route := range t.Publish {
+		if route.Exchange == "" {
+			continue
+		}
+		if !t.knowsExchange(route.Exchange) {
+			return fmt.Errorf("queue '%s' publishes to undeclared exchange '%s'", queueName, route.Exchange)
+		}
+		for _, match := range routingKeyPlaceholder.FindAllStringSubmatch(route.RoutingKey, -1) {
+			if !routingKeyFields[match[1]] {
+				return fmt.Errorf("unknown placeholder '%s' in routing key of queue '%s'", match[0], queueName)
+			}
+		}
+	}
+	for queueName, queue := range t.Queues {
+		if queue.Type != "" && queue.Type != classicQueueType && queue.Type != quorumQueueType {
+			return fmt.Errorf("unknown type '%s' of queue '%s'", queue.Type, queueName)
+		}
+		if queue.Type == quorumQueueType && (!queue.Durable || queue.AutoDelete) {
+			return fmt.Errorf("quorum queue '%s' must be durable and not auto-deleted", queueName)
+		}
+		if queue.MessageTTL != 0 && queue.MessageTTL.milliseconds() < 1 {
+			return fmt.Errorf("message TTL of queue '%s' is shorter than a millisecond", queueName)
+		}
+		if queue.DeadLetterExchange != "" && !t.knowsExchange(queue.DeadLetterExchange) {
+			return fmt.Errorf("queue '%s' dead-letters to undeclared exchange '%s'", queueName, queue.DeadLetterExchange)
+		}
+		for _, binding := range queue.Bindings {
+			if !t.knowsExchange(binding.Exchange) {
+				return fmt.Errorf("queue '%s' is bound to undeclared exchange '%s'", queueName, binding.Exchange)
+			}
+		}
+	}
+	for eventType, mode := range t.Delivery.EventTypes {
+		if mode != persistentDelivery && mode != transientDelivery {
+			return fmt.Errorf("unknown delivery mode '%s' of event type '%s'", mode, eventType)
+		}
+	}
+	if t.Delivery.Default != "" && t.Delivery.Default != persistentDelivery && t.Delivery.Default != transientDelivery {
+		return fmt.Errorf("unknown default delivery mode '%s'", t.Delivery.Default)
+	}
+	for eventType, expiration := range t.Delivery.Expiration {
+		if expiration.milliseconds() < 1 {
+			return fmt.Errorf("expiration of event type '%s' is shorter than a millisecond", eventType)
+		}
+	}
+	return nil
+}
+
+// knowsExchange tells whether an exchange is declared by the topology or
+// predeclared by the broker.
+func (t *amqpTopology) knowsExchange(name string) bool {
+	_, ok := t.Exchanges[name]
+	return ok || strings.HasPrefix(name, "amq.")
+}
+
+// route returns where the dispatcher of a queue publishes. Per-tenant queues
+// (<tenant>.<queue>) share the route of their queue.
+func (t *amqpTopology) route(queueName string) publishRoute {
+	if t == nil {
+		return publishRoute{}
+	}
+	if route, ok := t.Publish[queueName]; ok {
+		return route
+	}
+	if index := strings.Index(queueName, tenantQueueSeparator); index >= 0 {
+		return t.Publish[queueName[index+1:]]
+	}
+	return publishRoute{}
+}
+
+// checkTenantQueues rejects routing the queues through an exchange: the
+// per-tenant queues of the dispatchers would be neither declared nor bound,
+// and the events of every tenant would end up in the same queues.
+func (t *amqpTopology) checkTenantQueues(queueNames []string) error {
+	for _, queueName := range queueNames {
+		if route := t.route(queueName); route.Exchange != "" {
+			return fmt.Errorf("queue '%s' is published through exchange '%s', which per-tenant queues do not support", queueName, route.Exchange)
+		}
+	}
+	return nil
+}
+
+// withDeadLetters returns a copy of the topology where messages dying in the
+// queues are dead-lettered through an exchange <queue>.dlx. Those of the
+// dead-lettered queues go to a durable <queue>.dlq. Messages expiring in the
+// archived queues go to a durable <queue>.archive instead, routed by their
+// x-first-death-reason header. Headers exchanges only match x- headers under
+// x-match all-with-x, which needs RabbitMQ 3.10. Dead-letter exchanges set by
+// the topology are kept.
+func (t *amqpTopology) withDeadLetters(deadLettered []string, archived []string) *amqpTopology {
+	archives := make(map[string]bool)
+	for _, queueName := range archived {
+		archives[queueName] = true
+	}
+	letters := make(map[string]bool)
+	for _, queueName := range deadLettered {
+		letters[queueName] = true
+	}
+
+	topology := t.clone()
+	for _, queueName := range append(deadLettered, archived...) {
+		queue := topology.Queues[queueName]
+		if queue.DeadLetterExchange != "" {
+			continue
+		}
+		exchange := deadLetterExchange(queueName)
+		queue.DeadLetterExchange = exchange
+		topology.Queues[queueName] = queue
+
+		if !archives[queueName] {
+			topology.Exchanges[exchange] = exchangeConfig{Type: amqp.ExchangeFanout, Durable: true}
+			topology.Queues[deadLetterQueue(queueName)] = queueConfig{Durable: true, Bindings: []bindingConfig{{Exchange: exchange}}}
+			continue
+		}
+
+		topology.Exchanges[exchange] = exchangeConfig{Type: amqp.ExchangeHeaders, Durable: true}
+		topology.Queues[archiveQueue(queueName)] = queueConfig{Durable: true, Bindings: []bindingConfig{deathReasonBinding(exchange, "expired")}}
+		if letters[queueName] {
+			bindings := make([]bindingConfig, 0)
+			for _, reason := range []string{"rejected", "maxlen", "delivery_limit"} {
+				bindings = append(bindings, deathReasonBinding(exchange, reason))
+			}
+			topology.Queues[deadLetterQueue(queueName)] = queueConfig{Durable: true, Bindings: bindings}
+		}
+	}
+	return topology
+}
+
+func deathReasonBinding(exchange string, reason string) bindingConfig {
+	return bindingConfig{Exchange: exchange, Arguments: map[string]interface{}{"x-match": "all-with-x", "x-first-death-reason": reason}}
+}
+
+// withMaxPriority returns a copy of the topology where the queue is a
+// priority queue or, when it is published through an exchange, the queues
+// bound to that exchange are, unless the topology sets their maximum
+// priority.
+func (t *amqpTopology) withMaxPriority(queueName string, maxPriority uint8) *amqpTopology {
+	topology := t.clone()
+	queueNames := []string{queueName}
+	if exchange := topology.route(queueName).Exchange; exchange != "" {
+		queueNames = topology.boundTo(exchange)
+	}
+	for _, queueName := range queueNames {
+		queue := topology.Queues[queueName]
+		if queue.MaxPriority == 0 {
+			queue.MaxPriority = maxPriority
+			topology.Queues[queueName] = queue
+		}
+	}
+	return topology
+}
+
+// boundTo returns the queues bound to an exchange.
+func (t *amqpTopology) boundTo(exchange string) []string {
+	queueNames := make([]string, 0)
+	for queueName, queue := range t.Queues {
+		for _, binding := range queue.Bindings {
+			if binding.Exchange == exchange {
+				queueNames = append(queueNames, queueName)
+				break
+			}
+		}
+	}
+	sort.Strings(queueNames)
+	return queueNames
+}
+
+func (t *amqpTopology) clone() *amqpTopology {
+	topology := &amqpTopology{Exchanges: make(map[string]exchangeConfig), Publish: make(map[string]publishRoute), Queues: make(map[string]queueConfig)}
+	if t == nil {
+		return topology
+	}
+	topology.Delivery = t.Delivery
+	for name, exchange := range t.Exchanges {
+		topology.Exchanges[name] = exchange
+	}
+	for queueName, route := range t.Publish {
+		topology.Publish[queueName] = route
+	}
+	for queueName, queue := range t.Queues {
+		topology.Queues[queueName] = queue
+	}
+	return topology
+}
+
+func deadLetterExchange(queueName string) string {
+	return queueName + ".dlx"
+}
+
+func deadLetterQueue(queueName string) string {
+	return queueName + ".dlq"
+}
+
+func archiveQueue(queueName string) string {
+	return queueName + ".archive"
+}
+
+// declares tells whether the topology declares a queue.
+func (t *amqpTopology) declares(queueName string) bool {
+	if t == nil {
+		return false
+	}
+	_, ok := t.Queues[queueName]
+	return ok
+}
+
+// queue returns the declaration arguments of a queue the dispatchers publish
+// to directly. Per-tenant queues are declared like their queue, without its
+// bindings, and dead-letter to an exchange of their own when their queue
+// got one from withDeadLetters. Dead-letter exchanges set by the topology
+// stay shared by the tenants.
+func (t *amqpTopology) queue(queueName string) queueConfig {
+	if t == nil {
+		return queueConfig{}
+	}
+	queue, ok := t.Queues[queueName]
+	if index := strings.Index(queueName, tenantQueueSeparator); !ok && index >= 0 {
+		parent := queueName[index+1:]
+		queue = t.Queues[parent]
+		queue.Bindings = nil
+		if queue.DeadLetterExchange == deadLetterExchange(parent) {
+			queue.DeadLetterExchange = deadLetterExchange(queueName)
+		}
+	}
+	return queue
+}
+
+// tenantDeadLetters returns the dead-letter exchange, dead-letter queue and
+// archive of a per-tenant queue, built like those of its queue, so the dead
+// letters of the tenants are kept apart. It is nil for other queues.
+func (t *amqpTopology) tenantDeadLetters(queueName string) *amqpTopology {
+	index := strings.Index(queueName, tenantQueueSeparator)
+	if t == nil || index < 0 || t.declares(queueName) {
+		return nil
+	}
+	parent := queueName[index+1:]
+	if t.Queues[parent].DeadLetterExchange != deadLetterExchange(parent) {
+		return nil
+	}
+
+	exchange := deadLetterExchange(queueName)
+	topology := &amqpTopology{
+		Exchanges: map[string]exchangeConfig{exchange: t.Exchanges[deadLetterExchange(parent)]},
+		Queues:    make(map[string]queueConfig),
+	}
+	for _, name := range []func(string) string{deadLetterQueue, archiveQueue} {
+		queue, ok := t.Queues[name(parent)]
+		if !ok {
+			continue
+		}
+		bindings := make([]bindingConfig, 0, len(queue.Bindings))
+		for _, binding := range queue.Bindings {
+			binding.Exchange = exchange
+			bindings = append(bindings, binding)
+		}
+		queue.Bindings = bindings
+		topology.Queues[name(queueName)] = queue
+	}
+	return topology
+}
+
+// declare declares the exchanges, then the queues and their bindings.
+func (t *amqpTopology) declare(channel amqpChannel) error {
+	if t == nil {
+		return nil
+	}
+
+	exchangeNames := make([]string, 0, len(t.Exchanges))
+	for name := range t.Exchanges {
+		exchangeNames = append(exchangeNames, name)
+	}
+	sort.Strings(exchangeNames)
+	for _, name := range exchangeNames {
+		exchange := t.Exchanges[name]
+		err := channel.ExchangeDeclare(name, exchange.Type, exchange.Durable, exchange.AutoDelete, false, false, nil)
+		if err != nil {
+			return declarationError("exchange", name, err)
+		}
+	}
+
+	queueNames := make([]string, 0, len(t.Queues))
+	for queueName := range t.Queues {
+		queueNames = append(queueNames, queueName)
+	}
+	sort.Strings(queueNames)
+	for _, queueName := range queueNames {
+		queue := t.Queues[queueName]
+		_, err := channel.QueueDeclare(queueName, queue.Durable, queue.AutoDelete, false, false, queue.arguments())
+		if err != nil {
+			return declarationError("queue", queueName, err)
+		}
+		for _, binding := range queue.Bindings {
+			err = channel.QueueBind(queueName, binding.RoutingKey, binding.Exchange, false, amqp.Table(binding.Arguments))
+			if err != nil {
+				return fmt.Errorf("failed to bind queue '%s' to exchange '%s': %s", queueName, binding.Exchange, err)
+			}
+		}
+	}
+	return nil
+}
+
+// declarationError describes a failed declaration, telling how to get past
+// the broker refusing to change the arguments of an existing queue or
+// exchange, which no reconnection fixes.
+func declarationError(kind string, name string, err error) error {
+	if amqpErr, ok := err.(*amqp.Error); ok && amqpErr.Code == amqp.PreconditionFailed {
+		return fmt.Errorf("failed to declare %s '%s', which exists on the broker with other arguments: delete it or set them through a policy (%s)", kind, name, err)
+	}
+	return fmt.Errorf("failed to declare %s '%s': %s", kind, name, err)
+}
+
+// deliveryMode returns the AMQP delivery mode of the messages of an event
+// type.
+func (t *amqpTopology) deliveryMode(eventType string) uint8 {
+	if t == nil {
+		return amqp.Transient
+	}
+	mode, ok := t.Delivery.EventTypes[eventType]
+	if !ok {
+		mode = t.Delivery.Default
+	}
+	if mode == persistentDelivery {
+		return amqp.Persistent
+	}
+	return amqp.Transient
+}
+
+// expiration returns the AMQP expiration of the messages of an event type,
+// in milliseconds, or an empty string when they do not expire.
+func (t *amqpTopology) expiration(eventType string) string {
+	if t == nil || t.Delivery.Expiration[eventType] == 0 {
+		return ""
+	}
+	return strconv.FormatInt(t.Delivery.Expiration[eventType].milliseconds(), 10)
+}
+
+var routingKeyFields = map[string]bool{"queue": true, "event_type": true, "tenant": true, "fleet": true, "drone_id": true, "severity": true}
+
+// routingKey expands the placeholders of a routing key template with the
+// metadata of a message. Dots in values are replaced, so a value never
+// spans several topic words.
+func routingKey(template string, queueName string, message interface{}) string {
+	values := map[string]string{"queue": queueName}
+	if envelope, ok := message.(dronescommon.EventEnvelope); ok {
+		values["event_type"] = envelope.EventType
+		values["tenant"] = envelope.TenantID
+		values["fleet"] = envelope.FleetID
+		data := decodeEnvelopeData(envelope)
+		values["drone_id"] = data.DroneID
+		values["severity"] = data.Severity
+	}
+
+	return routingKeyPlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		value := values[strings.Trim(placeholder, "{}")]
+		if value == "" {
+			return emptyRoutingKeyWord
+		}
+		return strings.Replace(value, ".", "_", -1)
+	})
+}
+
+// envelopeData holds the event fields messages are routed by.
+type envelopeData struct {
+	DroneID  string `json:"drone_id"`
+	Severity string `json:"severity"`
+}
+
+func decodeEnvelopeData(envelope dronescommon.EventEnvelope) envelopeData {
+	var data envelopeData
+	json.Unmarshal(envelope.Data, &data)
+	return data
+}
+
+func resolveTopology() *amqpTopology {
+	path := os.Getenv("AMQP_TOPOLOGY_FILE")
+	if path == "" {
+		return nil
+	}
+
+	topology, err := loadTopology(path)
+	failOnError(err, "Failed to load AMQP topology")
+	fmt.Printf("Using AMQP topology from '%s' with %d exchange(s)\n", path, len(topology.Exchanges))
+	return topology
+}
@@ -0,0 +1,323 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	dronescommon "github.com/maxsuelmarinho/golang-event-driven-example/drones-common"
+	"github.com/streadway/amqp"
+)
+
+const testTopology = `
+exchanges:
+  drones.events: {type: topic, durable: true}
+  drones.headers: {type: headers}
+publish:
+  telemetry: {exchange: drones.events, routing_key: "telemetry.{fleet}.{drone_id}"}
+  alerts: {exchange: drones.headers}
+queues:
+  drone1-telemetry:
+    bindings:
+      - {exchange: drones.events, routing_key: "telemetry.*.drone1"}
+  acme-alerts:
+    bindings:
+      - {exchange: drones.headers, arguments: {x-match: all, tenant_id: acme}}
+`
+
+func writeTestTopology(t *testing.T, content string) string {
+	file, err := ioutil.TempFile("", "topology")
+	if err != nil {
+		t.Fatalf("Failed to create topology file: %s", err)
+	}
+	file.WriteString(content)
+	file.Close()
+	return file.Name()
+}
+
+func TestLoadTopology(t *testing.T) {
+	path := writeTestTopology(t, testTopology)
+	defer os.Remove(path)
+
+	topology, err := loadTopology(path)
+	if err != nil {
+		t.Fatalf("Failed to load topology: %s", err)
+	}
+	if route := topology.route("acme.telemetry"); route.Exchange != "drones.events" {
+		t.Errorf("Expected tenant queue to share the route of its queue, got %v", route)
+	}
+	if route := topology.route("positions"); route.Exchange != "" {
+		t.Errorf("Expected unrouted queue to publish directly, got %v", route)
+	}
+	if topology.checkTenantQueues([]string{"positions", "telemetry"}) == nil || topology.checkTenantQueues([]string{"positions"}) != nil {
+		t.Errorf("Expected only queues published through an exchange to be refused per-tenant queues")
+	}
+
+	for _, invalid := range []string{
+		"exchanges: {drones.events: {type: random}}",
+		"publish: {telemetry: {exchange: missing}}",
+		"exchanges: {drones.events: {type: topic}}\npublish: {telemetry: {exchange: drones.events, routing_key: '{altitude}'}}",
+		"queues: {telemetry: {bindings: [{exchange: missing}]}}",
+		"queues: {telemetry: {message_ttl: 500us}}",
+		"queues: {telemetry: {message_ttl: -1}}",
+		"queues: {telemetry: {message_ttl: soon}}",
+	} {
+		path := writeTestTopology(t, invalid)
+		if _, err := loadTopology(path); err == nil {
+			t.Errorf("Expected topology to be rejected: %s", invalid)
+		}
+		os.Remove(path)
+	}
+}
+
+func TestRoutingKeyExpandsEventMetadata(t *testing.T) {
+	envelope, _ := dronescommon.NewEventEnvelope(dronescommon.TelemetryUpdatedEventType, 1, eventSource, dronescommon.TelemetryUpdatedEvent{DroneID: "drone1"})
+	envelope.FleetID = "crop.sprayers"
+
+	if key := routingKey("telemetry.{fleet}.{drone_id}.{tenant}", "telemetry", envelope); key != "telemetry.crop_sprayers.drone1._" {
+		t.Errorf("Unexpected routing key '%s'", key)
+	}
+	if key := routingKey("{queue}.all", "telemetry", "not an envelope"); key != "telemetry.all" {
+		t.Errorf("Unexpected routing key '%s'", key)
+	}
+}
+
+func TestConnectionManagerDeclaresTopology(t *testing.T) {
+	path := writeTestTopology(t, testTopology)
+	defer os.Remove(path)
+	topology, _ := loadTopology(path)
+
+	dialer := &fakeDialer{}
+	manager := newTestConnectionManager(dialer)
+	manager.topology = topology
+	defer manager.Close()
+	telemetry := manager.Dispatcher("telemetry")
+	manager.Dispatcher("positions")
+	if err := manager.Start(); err != nil {
+		t.Fatalf("Expected connection to succeed, got %s", err)
+	}
+
+	channels := dialer.connections[0].channels
+	if len(channels[0].DeclaredExchanges) != 2 || len(channels[0].Bindings) != 2 || channels[0].Bindings[1] != "drone1-telemetry drones.events telemetry.*.drone1" {
+		t.Errorf("Expected exchanges and bindings to be declared, got %v and %v", channels[0].DeclaredExchanges, channels[0].Bindings)
+	}
+	if len(channels[0].Declared) != 2 || len(channels[1].Declared) != 0 || len(channels[2].Declared) != 1 || channels[2].Declared[0] != "positions" {
+		t.Errorf("Expected only the directly published queue to be declared besides the topology, got %v, %v and %v", channels[0].Declared, channels[1].Declared, channels[2].Declared)
+	}
+	if len(channels[1].DeclaredExchanges) != 0 || len(channels[2].DeclaredExchanges) != 0 {
+		t.Errorf("Expected the topology to be declared once per connection, got %v and %v", channels[1].DeclaredExchanges, channels[2].DeclaredExchanges)
+	}
+
+	envelope, _ := dronescommon.NewEventEnvelope(dronescommon.TelemetryUpdatedEventType, 1, eventSource, dronescommon.TelemetryUpdatedEvent{DroneID: "drone1"})
+	envelope.FleetID = "crop-sprayers"
+	if err := telemetry.DispatchMessage(envelope); err != nil {
+		t.Fatalf("Failed to dispatch: %s", err)
+	}
+	if channels[1].Exchanges[0] != "drones.events" || channels[1].RoutingKeys[0] != "telemetry.crop-sprayers.drone1" {
+		t.Errorf("Expected telemetry to be published to the topic exchange, got '%s' with key '%s'", channels[1].Exchanges[0], channels[1].RoutingKeys[0])
+	}
+	if channels[1].Published[0].Headers["drone_id"] != "drone1" {
+		t.Errorf("Expected drone_id header for headers exchanges, got %v", channels[1].Published[0].Headers)
+	}
+}
+
+func TestQueueDeclarationArguments(t *testing.T) {
+	path := writeTestTopology(t, `
+exchanges:
+  drones.dead: {type: fanout, durable: true}
+queues:
+  alerts:
+    durable: true
+    type: quorum
+    max_length: 10000
+    message_ttl: 1h
+    dead_letter_exchange: drones.dead
+delivery:
+  event_types:
+    drones.alert.signalled: persistent
+`)
+	defer os.Remove(path)
+	topology, err := loadTopology(path)
+	if err != nil {
+		t.Fatalf("Failed to load topology: %s", err)
+	}
+
+	dialer := &fakeDialer{}
+	manager := newTestConnectionManager(dialer)
+	manager.topology = topology
+	defer manager.Close()
+	alerts := manager.Dispatcher("acme.alerts")
+	telemetry := manager.Dispatcher("telemetry")
+	if err := manager.Start(); err != nil {
+		t.Fatalf("Expected connection to succeed, got %s", err)
+	}
+
+	channel := dialer.connections[0].channels[1]
+	if channel.Declared[0] != "acme.alerts" || !channel.DeclaredDurable[0] {
+		t.Fatalf("Expected tenant queue to be declared durable like its queue, got %v", channel.Declared)
+	}
+	args := channel.DeclaredArgs[0]
+	if args["x-queue-type"] != "quorum" || args["x-max-length"] != int64(10000) || args["x-message-ttl"] != int64(3600000) || args["x-dead-letter-exchange"] != "drones.dead" {
+		t.Errorf("Unexpected queue arguments %v", args)
+	}
+	if other := dialer.connections[0].channels[2]; other.DeclaredDurable[0] || len(other.DeclaredArgs[0]) != 0 {
+		t.Errorf("Expected unlisted queue to stay transient, got %v", other.DeclaredArgs[0])
+	}
+
+	alert, _ := dronescommon.NewEventEnvelope(dronescommon.AlertSignalledEventType, 1, eventSource, dronescommon.AlertSignalledEvent{DroneID: "drone1"})
+	alerts.DispatchMessage(alert)
+	telemetryEvent, _ := dronescommon.NewEventEnvelope(dronescommon.TelemetryUpdatedEventType, 1, eventSource, dronescommon.TelemetryUpdatedEvent{DroneID: "drone1"})
+	telemetry.DispatchMessage(telemetryEvent)
+	if mode := channel.Published[0].DeliveryMode; mode != amqp.Persistent {
+		t.Errorf("Expected alerts to be persistent, got delivery mode %d", mode)
+	}
+	if mode := dialer.connections[0].channels[2].Published[0].DeliveryMode; mode != amqp.Transient {
+		t.Errorf("Expected telemetry to be transient, got delivery mode %d", mode)
+	}
+}
+
+func TestRedeclarationWithOtherArgumentsIsExplained(t *testing.T) {
+	refused := &amqp.Error{Code: amqp.PreconditionFailed, Reason: "PRECONDITION_FAILED - inequivalent arg 'durable' for queue 'alerts'"}
+	if err := declarationError("queue", "alerts", refused); !strings.Contains(err.Error(), "delete it or set them through a policy") {
+		t.Errorf("Expected refused redeclaration to tell how to migrate the queue, got %s", err)
+	}
+	if err := declarationError("queue", "alerts", amqp.ErrClosed); strings.Contains(err.Error(), "policy") {
+		t.Errorf("Expected other failures to be reported as is, got %s", err)
+	}
+}
+
+func TestQuorumQueuesMustBeDurable(t *testing.T) {
+	path := writeTestTopology(t, "queues: {alerts: {type: quorum}}")
+	defer os.Remove(path)
+	if _, err := loadTopology(path); err == nil {
+		t.Errorf("Expected transient quorum queue to be rejected")
+	}
+}
+
+func TestBareTTLsAreMilliseconds(t *testing.T) {
+	path := writeTestTopology(t, `
+queues:
+  telemetry: {message_ttl: 60000}
+delivery:
+  expiration:
+    drones.telemetry.updated: 1500
+`)
+	defer os.Remove(path)
+	topology, err := loadTopology(path)
+	if err != nil {
+		t.Fatalf("Failed to load topology: %s", err)
+	}
+
+	if ttl := topology.Queues["telemetry"].arguments()["x-message-ttl"]; ttl != int64(60000) {
+		t.Errorf("Expected a bare message TTL to be read as milliseconds, got %v", ttl)
+	}
+	if expiration := topology.expiration(dronescommon.TelemetryUpdatedEventType); expiration != "1500" {
+		t.Errorf("Expected a bare expiration to be read as milliseconds, got '%s'", expiration)
+	}
+}
+
+func TestStaleEventsExpire(t *testing.T) {
+	path := writeTestTopology(t, `
+delivery:
+  expiration:
+    drones.telemetry.updated: 30s
+`)
+	defer os.Remove(path)
+	topology, err := loadTopology(path)
+	if err != nil {
+		t.Fatalf("Failed to load topology: %s", err)
+	}
+
+	dialer := &fakeDialer{}
+	manager := newTestConnectionManager(dialer)
+	manager.topology = topology
+	defer manager.Close()
+	telemetry := manager.Dispatcher("telemetry")
+	alerts := manager.Dispatcher("alerts")
+	if err := manager.Start(); err != nil {
+		t.Fatalf("Expected connection to succeed, got %s", err)
+	}
+
+	telemetryEvent, _ := dronescommon.NewEventEnvelope(dronescommon.TelemetryUpdatedEventType, 1, eventSource, dronescommon.TelemetryUpdatedEvent{DroneID: "drone1"})
+	telemetry.DispatchMessage(telemetryEvent)
+	alert, _ := dronescommon.NewEventEnvelope(dronescommon.AlertSignalledEventType, 1, eventSource, dronescommon.AlertSignalledEvent{DroneID: "drone1"})
+	alerts.DispatchMessage(alert)
+
+	if expiration := dialer.connections[0].channels[1].Published[0].Expiration; expiration != "30000" {
+		t.Errorf("Expected telemetry to expire after 30s, got '%s'", expiration)
+	}
+	if expiration := dialer.connections[0].channels[2].Published[0].Expiration; expiration != "" {
+		t.Errorf("Expected alerts not to expire, got '%s'", expiration)
+	}
+
+	invalid := writeTestTopology(t, "delivery: {expiration: {drones.telemetry.updated: -1s}}")
+	defer os.Remove(invalid)
+	if _, err := loadTopology(invalid); err == nil {
+		t.Errorf("Expected negative expiration to be rejected")
+	}
+}
+
+func TestExpiredMessagesAreArchived(t *testing.T) {
+	topology := (*amqpTopology)(nil).withDeadLetters([]string{"telemetry", "alerts"}, []string{"telemetry"})
+	if err := topology.check(); err != nil {
+		t.Fatalf("Expected valid topology, got %s", err)
+	}
+
+	if exchange := topology.Exchanges["telemetry.dlx"]; exchange.Type != amqp.ExchangeHeaders {
+		t.Errorf("Expected archived queue to dead-letter through a headers exchange, got %s", exchange.Type)
+	}
+	if !topology.Queues["telemetry.archive"].Durable {
+		t.Errorf("Expected archive to be durable")
+	}
+	for reason, queueName := range map[string]string{"expired": "telemetry.archive", "rejected": "telemetry.dlq", "maxlen": "telemetry.dlq", "delivery_limit": "telemetry.dlq"} {
+		headers := amqp.Table{"event_type": dronescommon.TelemetryUpdatedEventType, "x-first-death-reason": reason}
+		if routed := routeThroughHeaders(topology, "telemetry.dlx", headers); len(routed) != 1 || routed[0] != queueName {
+			t.Errorf("Expected %s messages to reach %s only, got %v", reason, queueName, routed)
+		}
+	}
+	if _, ok := topology.Queues["alerts.archive"]; ok || topology.Exchanges["alerts.dlx"].Type != amqp.ExchangeFanout {
+		t.Errorf("Expected alerts to be dead-lettered without archive")
+	}
+
+	archiveOnly := (*amqpTopology)(nil).withDeadLetters(nil, []string{"telemetry"})
+	if _, ok := archiveOnly.Queues["telemetry.dlq"]; ok {
+		t.Errorf("Expected rejected messages to be dropped without dead-letter queue")
+	}
+	if archiveOnly.queue("telemetry").DeadLetterExchange != "telemetry.dlx" {
+		t.Errorf("Expected telemetry to dead-letter to its exchange")
+	}
+}
+
+// routeThroughHeaders returns the queues a headers exchange of the topology
+// routes a message to, matching like RabbitMQ does: x- arguments and headers
+// are left out unless x-match is all-with-x or any-with-x.
+func routeThroughHeaders(topology *amqpTopology, exchange string, headers amqp.Table) []string {
+	routed := make([]string, 0)
+	for queueName, queue := range topology.Queues {
+		for _, binding := range queue.Bindings {
+			if binding.Exchange != exchange {
+				continue
+			}
+			match, _ := binding.Arguments["x-match"].(string)
+			withX := strings.HasSuffix(match, "-with-x")
+			anyOf := strings.HasPrefix(match, "any")
+			matched := !anyOf
+			for key, value := range binding.Arguments {
+				if key == "x-match" || (strings.HasPrefix(key, "x-") && !withX) {
+					continue
+				}
+				if equal := headers[key] == value; anyOf {
+					matched = matched || equal
+				} else {
+					matched = matched && equal
+				}
+			}
+			if matched {
+				routed = append(routed, queueName)
+				break
+			}
+		}
+	}
+	return routed
+}
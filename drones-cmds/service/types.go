@@ -1,60 +1,102 @@
 package service
 
+import (
+	"time"
+
+	dronescommon "github.com/maxsuelmarinho/golang-event-driven-example/drones-common"
+)
+
 type telemetryCommand struct {
+	CommandID        string `json:"command_id,omitempty"`
 	DroneID          string `json:"drone_id"`
 	RemainingBattery int    `json:"battery"`
 	Uptime           int    `json:"uptime"`
 	CoreTemp         int    `json:"core_temp"`
+	observation
 }
 
 type alertCommand struct {
+	CommandID   string `json:"command_id,omitempty"`
 	DroneID     string `json:"drone_id"`
 	FaultCode   int    `json:"fault_code"`
 	Description string `json:"description"`
+	observation
+
+	severity string
 }
 
 type positionCommand struct {
-	DroneID         string  `json:"drone_id"`
-	Latitude        float32 `json:"latitude"`
-	Longitude       float32 `json:"longitude"`
-	Altitude        float32 `json:"altitude"`
-	CurrentSpeed    float32 `json:"current_speed"`
-	HeadingCardinal int     `json:"heading_cardinal"`
+	CommandID         string  `json:"command_id,omitempty"`
+	FleetID           string  `json:"fleet_id,omitempty"`
+	DroneID           string  `json:"drone_id"`
+	Latitude          float32 `json:"latitude"`
+	Longitude         float32 `json:"longitude"`
+	Altitude          float32 `json:"altitude"`
+	AltitudeReference string  `json:"altitude_reference,omitempty"`
+	CurrentSpeed      float32 `json:"current_speed"`
+	HeadingCardinal   int     `json:"heading_cardinal"`
+	observation
+}
+
+// eventCommand is implemented by every command that maps onto a single event.
+type eventCommand interface {
+	droneID() string
+	observedAt() *time.Time
+	toEvent(timing dronescommon.Timing) interface{}
 }
 
 type queueDispatcher interface {
 	DispatchMessage(message interface{}) (err error)
 }
 
-func (telemetry telemetryCommand) isValid() (valid bool) {
-	valid = true
-	if len(telemetry.DroneID) == 0 {
-		valid = false
-	}
-	if telemetry.Uptime == 0 {
-		valid = false
-	}
-	return valid
+func (telemetry telemetryCommand) droneID() string {
+	return telemetry.DroneID
 }
 
-func (alert alertCommand) isValid() (valid bool) {
-	valid = true
-	if len(alert.DroneID) == 0 {
-		valid = false
-	}
-	if len(alert.Description) == 0 {
-		valid = false
+func (alert alertCommand) droneID() string {
+	return alert.DroneID
+}
+
+func (position positionCommand) droneID() string {
+	return position.DroneID
+}
+
+func (position positionCommand) fleetID() string {
+	return position.FleetID
+}
+
+func (telemetry telemetryCommand) toEvent(timing dronescommon.Timing) interface{} {
+	return dronescommon.TelemetryUpdatedEvent{
+		DroneID:          telemetry.DroneID,
+		RemainingBattery: telemetry.RemainingBattery,
+		Uptime:           telemetry.Uptime,
+		CoreTemp:         telemetry.CoreTemp,
+		ReceivedOn:       timing.ReceivedAt.Unix(),
+		Timing:           timing,
 	}
-	return valid
 }
 
-func (position positionCommand) isValid() (valid bool) {
-	valid = true
-	if len(position.DroneID) == 0 {
-		valid = false
+func (alert alertCommand) toEvent(timing dronescommon.Timing) interface{} {
+	return dronescommon.AlertSignalledEvent{
+		DroneID:     alert.DroneID,
+		FaultCode:   alert.FaultCode,
+		Description: alert.Description,
+		Severity:    alert.severity,
+		ReceivedOn:  timing.ReceivedAt.Unix(),
+		Timing:      timing,
 	}
-	if position.Longitude < 0 || position.Latitude < 0 || position.Altitude < 0 {
-		valid = false
+}
+
+func (position positionCommand) toEvent(timing dronescommon.Timing) interface{} {
+	return dronescommon.PositionChangedEvent{
+		DroneID:           position.DroneID,
+		Longitude:         position.Longitude,
+		Latitude:          position.Latitude,
+		Altitude:          position.Altitude,
+		AltitudeReference: position.AltitudeReference,
+		CurrentSpeed:      position.CurrentSpeed,
+		HeadingCardinal:   position.HeadingCardinal,
+		ReceivedOn:        timing.ReceivedAt.Unix(),
+		Timing:            timing,
 	}
-	return valid
 }
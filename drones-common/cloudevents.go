@@ -0,0 +1,321 @@
+package dronecommon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	CloudEventsSpecVersion = "1.0"
+	CloudEventsContentType = "application/cloudevents+json"
+
+	// CloudEventsAMQPPrefix prefixes the application properties carrying
+	// the event attributes in binary mode, per the CloudEvents AMQP binding.
+	CloudEventsAMQPPrefix = "cloudEvents:"
+
+	correlationIDExtension = "correlationid"
+	schemaVersionExtension = "schemaversion"
+	receivedOnExtension    = "receivedon"
+	tenantIDExtension      = "tenantid"
+	fleetIDExtension       = "fleetid"
+)
+
+var ErrNotCloudEvent = errors.New("message is not a CloudEvent")
+
+// CloudEvent is a CloudEvents 1.0 event. Extension attributes are kept in
+// Extensions and flattened next to the context attributes in JSON.
+type CloudEvent struct {
+	SpecVersion     string                 `json:"specversion"`
+	ID              string                 `json:"id"`
+	Source          string                 `json:"source"`
+	Type            string                 `json:"type"`
+	DataContentType string                 `json:"datacontenttype,omitempty"`
+	DataSchema      string                 `json:"dataschema,omitempty"`
+	Subject         string                 `json:"subject,omitempty"`
+	Time            *time.Time             `json:"time,omitempty"`
+	Data            json.RawMessage        `json:"data,omitempty"`
+	Extensions      map[string]interface{} `json:"-"`
+}
+
+type cloudEventAttributes CloudEvent
+
+var cloudEventContextAttributes = map[string]bool{
+	"specversion": true, "id": true, "source": true, "type": true, "datacontenttype": true,
+	"dataschema": true, "subject": true, "time": true, "data": true, "data_base64": true,
+}
+
+// CloudEventFromEnvelope maps an envelope onto a CloudEvent, carrying the
+// metadata without a CloudEvents counterpart as extensions.
+func CloudEventFromEnvelope(envelope EventEnvelope) CloudEvent {
+	occurredAt := envelope.OccurredAt
+	event := CloudEvent{
+		SpecVersion:     CloudEventsSpecVersion,
+		ID:              envelope.EventID,
+		Source:          envelope.Source,
+		Type:            envelope.EventType,
+		DataContentType: "application/json",
+		Time:            &occurredAt,
+		Data:            envelope.Data,
+		Extensions: map[string]interface{}{
+			schemaVersionExtension: envelope.SchemaVersion,
+			receivedOnExtension:    envelope.ReceivedOn,
+		},
+	}
+	if envelope.CorrelationID != "" {
+		event.Extensions[correlationIDExtension] = envelope.CorrelationID
+	}
+	if envelope.TenantID != "" {
+		event.Extensions[tenantIDExtension] = envelope.TenantID
+	}
+	if envelope.FleetID != "" {
+		event.Extensions[fleetIDExtension] = envelope.FleetID
+	}
+	return event
+}
+
+// Envelope maps the CloudEvent back onto an envelope.
+func (ce CloudEvent) Envelope() (envelope EventEnvelope, err error) {
+	err = ce.Validate()
+	if err != nil {
+		return
+	}
+
+	envelope = EventEnvelope{
+		EventID:       ce.ID,
+		EventType:     ce.Type,
+		SchemaVersion: 1,
+		Source:        ce.Source,
+		Data:          ce.Data,
+	}
+	if ce.Time != nil {
+		envelope.OccurredAt = *ce.Time
+	}
+	if version, ok := extensionInt(ce.Extensions[schemaVersionExtension]); ok {
+		envelope.SchemaVersion = int(version)
+	}
+	if receivedOn, ok := extensionInt(ce.Extensions[receivedOnExtension]); ok {
+		envelope.ReceivedOn = receivedOn
+	}
+	if correlationID, ok := ce.Extensions[correlationIDExtension].(string); ok {
+		envelope.CorrelationID = correlationID
+	}
+	envelope.TenantID, _ = ce.Extensions[tenantIDExtension].(string)
+	envelope.FleetID, _ = ce.Extensions[fleetIDExtension].(string)
+	return
+}
+
+// Validate checks the required context attributes are present.
+func (ce CloudEvent) Validate() error {
+	if ce.SpecVersion != CloudEventsSpecVersion {
+		return fmt.Errorf("unsupported CloudEvents specversion '%s'", ce.SpecVersion)
+	}
+	missing := make([]string, 0)
+	if ce.ID == "" {
+		missing = append(missing, "id")
+	}
+	if ce.Source == "" {
+		missing = append(missing, "source")
+	}
+	if ce.Type == "" {
+		missing = append(missing, "type")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("CloudEvent is missing required attribute(s): %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func (ce CloudEvent) MarshalJSON() ([]byte, error) {
+	attributes, err := json.Marshal(cloudEventAttributes(ce))
+	if err != nil || len(ce.Extensions) == 0 {
+		return attributes, err
+	}
+
+	flattened := make(map[string]interface{})
+	err = json.Unmarshal(attributes, &flattened)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range ce.Extensions {
+		if !cloudEventContextAttributes[name] {
+			flattened[name] = value
+		}
+	}
+	return json.Marshal(flattened)
+}
+
+func (ce *CloudEvent) UnmarshalJSON(data []byte) error {
+	var attributes cloudEventAttributes
+	err := json.Unmarshal(data, &attributes)
+	if err != nil {
+		return err
+	}
+
+	var flattened map[string]interface{}
+	err = json.Unmarshal(data, &flattened)
+	if err != nil {
+		return err
+	}
+
+	*ce = CloudEvent(attributes)
+	for name, value := range flattened {
+		if cloudEventContextAttributes[name] {
+			continue
+		}
+		if ce.Extensions == nil {
+			ce.Extensions = make(map[string]interface{})
+		}
+		ce.Extensions[name] = value
+	}
+	return nil
+}
+
+// MarshalStructured encodes the event in structured content mode.
+func MarshalStructured(ce CloudEvent) ([]byte, error) {
+	return json.Marshal(ce)
+}
+
+// UnmarshalStructured decodes an event in structured content mode.
+func UnmarshalStructured(body []byte) (ce CloudEvent, err error) {
+	err = json.Unmarshal(body, &ce)
+	if err != nil {
+		return
+	}
+	err = ce.Validate()
+	return
+}
+
+// ToAMQPStructured carries the whole event in the message body.
+func (ce CloudEvent) ToAMQPStructured() (amqp.Publishing, error) {
+	body, err := MarshalStructured(ce)
+	if err != nil {
+		return amqp.Publishing{}, err
+	}
+	return amqp.Publishing{ContentType: CloudEventsContentType, Body: body}, nil
+}
+
+// ToAMQPBinary carries the event data in the message body and the event
+// attributes in the application properties.
+func (ce CloudEvent) ToAMQPBinary() amqp.Publishing {
+	headers := amqp.Table{
+		CloudEventsAMQPPrefix + "specversion": ce.SpecVersion,
+		CloudEventsAMQPPrefix + "id":          ce.ID,
+		CloudEventsAMQPPrefix + "source":      ce.Source,
+		CloudEventsAMQPPrefix + "type":        ce.Type,
+	}
+	if ce.DataSchema != "" {
+		headers[CloudEventsAMQPPrefix+"dataschema"] = ce.DataSchema
+	}
+	if ce.Subject != "" {
+		headers[CloudEventsAMQPPrefix+"subject"] = ce.Subject
+	}
+	if ce.Time != nil {
+		headers[CloudEventsAMQPPrefix+"time"] = ce.Time.Format(time.RFC3339Nano)
+	}
+	for name, value := range ce.Extensions {
+		headers[CloudEventsAMQPPrefix+name] = amqpHeaderValue(value)
+	}
+
+	return amqp.Publishing{
+		ContentType: ce.DataContentType,
+		Headers:     headers,
+		Body:        ce.Data,
+	}
+}
+
+// CloudEventFromAMQP decodes a delivery in either content mode.
+func CloudEventFromAMQP(delivery amqp.Delivery) (ce CloudEvent, err error) {
+	if strings.HasPrefix(delivery.ContentType, CloudEventsContentType) {
+		return UnmarshalStructured(delivery.Body)
+	}
+
+	if _, ok := delivery.Headers[CloudEventsAMQPPrefix+"specversion"]; !ok {
+		err = ErrNotCloudEvent
+		return
+	}
+
+	ce = CloudEvent{DataContentType: delivery.ContentType, Data: delivery.Body}
+	for key, value := range delivery.Headers {
+		if !strings.HasPrefix(key, CloudEventsAMQPPrefix) {
+			continue
+		}
+		err = ce.SetAttribute(strings.TrimPrefix(key, CloudEventsAMQPPrefix), value)
+		if err != nil {
+			return
+		}
+	}
+	err = ce.Validate()
+	return
+}
+
+// SetAttribute sets a context or extension attribute by its CloudEvents
+// name, as found in binary mode headers.
+func (ce *CloudEvent) SetAttribute(name string, value interface{}) error {
+	text := fmt.Sprint(value)
+	switch name {
+	case "specversion":
+		ce.SpecVersion = text
+	case "id":
+		ce.ID = text
+	case "source":
+		ce.Source = text
+	case "type":
+		ce.Type = text
+	case "datacontenttype":
+		ce.DataContentType = text
+	case "dataschema":
+		ce.DataSchema = text
+	case "subject":
+		ce.Subject = text
+	case "time":
+		eventTime, err := time.Parse(time.RFC3339Nano, text)
+		if err != nil {
+			return fmt.Errorf("invalid CloudEvent time '%s': %s", text, err)
+		}
+		ce.Time = &eventTime
+	default:
+		if ce.Extensions == nil {
+			ce.Extensions = make(map[string]interface{})
+		}
+		ce.Extensions[name] = value
+	}
+	return nil
+}
+
+func amqpHeaderValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int:
+		return int64(v)
+	case float64:
+		return v
+	case string, bool, int32, int64:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func extensionInt(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case float64:
+		return int64(v), true
+	case string:
+		var parsed int64
+		_, err := fmt.Sscan(v, &parsed)
+		return parsed, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,65 @@
+package dronecommon
+
+import (
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestCloudEventStructuredRoundTrip(t *testing.T) {
+	envelope, _ := NewEventEnvelope(AlertSignalledEventType, AlertSignalledSchemaVersion, "drones-cmds", AlertSignalledEvent{DroneID: "drone1"})
+	envelope.CorrelationID = "flight-42"
+	envelope.ReceivedOn = 1554336000
+	envelope.TenantID = "acme"
+	envelope.FleetID = "crop-sprayers"
+
+	body, err := MarshalStructured(CloudEventFromEnvelope(envelope))
+	if err != nil {
+		t.Fatalf("Failed to marshal CloudEvent: %s", err)
+	}
+
+	cloudEvent, err := UnmarshalStructured(body)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal CloudEvent: %s", err)
+	}
+
+	decoded, err := cloudEvent.Envelope()
+	if err != nil {
+		t.Fatalf("Failed to map CloudEvent onto envelope: %s", err)
+	}
+
+	if decoded.EventID != envelope.EventID || decoded.CorrelationID != "flight-42" || decoded.ReceivedOn != 1554336000 ||
+		decoded.TenantID != "acme" || decoded.FleetID != "crop-sprayers" {
+		t.Errorf("Expected envelope %+v after round trip, got %+v", envelope, decoded)
+	}
+
+	if !decoded.OccurredAt.Equal(envelope.OccurredAt) {
+		t.Errorf("Expected occurred at %s, got %s", envelope.OccurredAt, decoded.OccurredAt)
+	}
+}
+
+func TestCloudEventBinaryRoundTrip(t *testing.T) {
+	envelope, _ := NewEventEnvelope(TelemetryUpdatedEventType, TelemetryUpdatedSchemaVersion, "drones-cmds", TelemetryUpdatedEvent{DroneID: "drone1"})
+	publishing := CloudEventFromEnvelope(envelope).ToAMQPBinary()
+
+	cloudEvent, err := CloudEventFromAMQP(amqp.Delivery{ContentType: publishing.ContentType, Headers: publishing.Headers, Body: publishing.Body})
+	if err != nil {
+		t.Fatalf("Failed to decode binary CloudEvent: %s", err)
+	}
+
+	decoded, _ := cloudEvent.Envelope()
+	if decoded.EventType != TelemetryUpdatedEventType || decoded.SchemaVersion != TelemetryUpdatedSchemaVersion {
+		t.Errorf("Expected type and schema version to survive the round trip, got %+v", decoded)
+	}
+
+	if string(decoded.Data) != string(envelope.Data) {
+		t.Errorf("Expected data %s, got %s", envelope.Data, decoded.Data)
+	}
+}
+
+func TestDeliveryWithoutCloudEventAttributesIsRejected(t *testing.T) {
+	_, err := CloudEventFromAMQP(amqp.Delivery{ContentType: "application/json", Body: []byte("{}")})
+	if err != ErrNotCloudEvent {
+		t.Errorf("Expected ErrNotCloudEvent, got %v", err)
+	}
+}
@@ -1,26 +1,62 @@
 package dronecommon
 
+import "time"
+
+// Timing carries the precise times of an event. ObservedAt comes from the
+// drone clock and may be skewed, ReceivedAt from the service clock;
+// ClockSkewMillis is how far ahead of the service the drone clock reported,
+// IngestDelayMillis how long ago it took a reading that was sent late.
+type Timing struct {
+	ObservedAt        *time.Time `json:"observed_at,omitempty"`
+	ReceivedAt        *time.Time `json:"received_at,omitempty"`
+	ClockSkewMillis   int64      `json:"clock_skew_ms,omitempty"`
+	ClockSkewed       bool       `json:"clock_skewed,omitempty"`
+	IngestDelayMillis int64      `json:"ingest_delay_ms,omitempty"`
+}
+
 type TelemetryUpdatedEvent struct {
 	DroneID          string `json:"drone_id"`
 	RemainingBattery int    `json:"battery"`
 	Uptime           int    `json:"uptime"`
 	CoreTemp         int    `json:"core_temp"`
 	ReceivedOn       int64  `json:"received_on"`
+
+	Timing
 }
 
 type AlertSignalledEvent struct {
 	DroneID     string `json:"drone_id"`
 	FaultCode   int    `json:"fault_code"`
 	Description string `json:"description"`
+	Severity    string `json:"severity,omitempty"`
 	ReceivedOn  int64  `json:"received_on"`
+
+	Timing
 }
 
 type PositionChangedEvent struct {
-	DroneID         string  `json:"drone_id"`
-	Latitude        float32 `json:"latitude"`
-	Longitude       float32 `json:"longitude"`
-	Altitude        float32 `json:"altitude"`
-	CurrentSpeed    float32 `json:"current_speed"`
-	HeadingCardinal int     `json:"heading_cardinal"`
-	ReceivedOn      int64   `json:"received_on"`
+	DroneID           string  `json:"drone_id"`
+	Latitude          float32 `json:"latitude"`
+	Longitude         float32 `json:"longitude"`
+	Altitude          float32 `json:"altitude"`
+	AltitudeReference string  `json:"altitude_reference,omitempty"`
+	CurrentSpeed      float32 `json:"current_speed"`
+	HeadingCardinal   int     `json:"heading_cardinal"`
+	ReceivedOn        int64   `json:"received_on"`
+
+	Timing
+}
+
+type DroneRegisteredEvent struct {
+	DroneID    string `json:"drone_id"`
+	Model      string `json:"model"`
+	Owner      string `json:"owner"`
+	FleetID    string `json:"fleet_id,omitempty"`
+	ReceivedOn int64  `json:"received_on"`
+}
+
+type DroneDecommissionedEvent struct {
+	DroneID    string `json:"drone_id"`
+	Reason     string `json:"reason,omitempty"`
+	ReceivedOn int64  `json:"received_on"`
 }
@@ -0,0 +1,110 @@
+package dronecommon
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/streadway/amqp"
+)
+
+var ErrMissingEventType = errors.New("message does not carry an event type")
+
+// Decoder turns queued messages back into concrete events using the types
+// known to its registry.
+type Decoder struct {
+	registry *EventRegistry
+}
+
+var DefaultDecoder = NewDecoder(DefaultRegistry)
+
+func NewDecoder(registry *EventRegistry) *Decoder {
+	return &Decoder{registry: registry}
+}
+
+// Register lets callers add their own event types to the decoder.
+func (d *Decoder) Register(eventType string, version int, factory func() interface{}) error {
+	return d.registry.Register(eventType, version, factory)
+}
+
+// Decode unmarshals body into the concrete event of eventType. A zero
+// schemaVersion means the current version of the type.
+func (d *Decoder) Decode(eventType string, schemaVersion int, body []byte) (interface{}, error) {
+	if eventType == "" {
+		return nil, ErrMissingEventType
+	}
+
+	if schemaVersion == 0 {
+		version, err := d.registry.SchemaVersion(eventType)
+		if err != nil {
+			return nil, err
+		}
+		schemaVersion = version
+	}
+	return d.registry.Decode(eventType, schemaVersion, body)
+}
+
+// DecodeDelivery returns the concrete event carried by an AMQP delivery,
+// whether it was published as a structured CloudEvent or with its metadata
+// in the message properties.
+func (d *Decoder) DecodeDelivery(delivery amqp.Delivery) (interface{}, error) {
+	envelope, err := EnvelopeFromDelivery(delivery)
+	if err != nil {
+		return nil, err
+	}
+	return d.Decode(envelope.EventType, envelope.SchemaVersion, envelope.Data)
+}
+
+// EnvelopeFromDelivery rebuilds the envelope of an AMQP delivery, leaving
+// the event data undecoded.
+func EnvelopeFromDelivery(delivery amqp.Delivery) (envelope EventEnvelope, err error) {
+	if strings.HasPrefix(delivery.ContentType, CloudEventsContentType) {
+		cloudEvent, err := UnmarshalStructured(delivery.Body)
+		if err != nil {
+			return envelope, err
+		}
+		return cloudEvent.Envelope()
+	}
+
+	envelope = EventEnvelope{
+		EventID:       delivery.MessageId,
+		EventType:     delivery.Type,
+		Source:        delivery.AppId,
+		OccurredAt:    delivery.Timestamp,
+		CorrelationID: delivery.CorrelationId,
+		Data:          delivery.Body,
+	}
+	if envelope.EventType == "" {
+		envelope.EventType = headerString(delivery.Headers, "event_type", CloudEventsAMQPPrefix+"type")
+	}
+	if envelope.EventType == "" {
+		err = ErrMissingEventType
+		return
+	}
+	if version, ok := headerInt(delivery.Headers, "schema_version", CloudEventsAMQPPrefix+schemaVersionExtension); ok {
+		envelope.SchemaVersion = int(version)
+	}
+	if receivedOn, ok := headerInt(delivery.Headers, "received_on", CloudEventsAMQPPrefix+receivedOnExtension); ok {
+		envelope.ReceivedOn = receivedOn
+	}
+	envelope.TenantID = headerString(delivery.Headers, "tenant_id", CloudEventsAMQPPrefix+tenantIDExtension)
+	envelope.FleetID = headerString(delivery.Headers, "fleet_id", CloudEventsAMQPPrefix+fleetIDExtension)
+	return
+}
+
+func headerString(headers amqp.Table, names ...string) string {
+	for _, name := range names {
+		if value, ok := headers[name].(string); ok && value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func headerInt(headers amqp.Table, names ...string) (int64, bool) {
+	for _, name := range names {
+		if value, ok := extensionInt(headers[name]); ok {
+			return value, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,82 @@
+package dronecommon
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestDecodeDeliveryReturnsConcreteEvent(t *testing.T) {
+	delivery := amqp.Delivery{
+		ContentType: "application/json",
+		MessageId:   "event-1",
+		Type:        PositionChangedEventType,
+		Timestamp:   time.Now(),
+		Headers:     amqp.Table{"schema_version": int32(PositionChangedSchemaVersion)},
+		Body:        []byte("{\"drone_id\":\"drone1\",\"latitude\":31.01,\"longitude\":72.5}"),
+	}
+
+	event, err := DefaultDecoder.DecodeDelivery(delivery)
+	if err != nil {
+		t.Fatalf("Failed to decode delivery: %s", err)
+	}
+
+	position, ok := event.(PositionChangedEvent)
+	if !ok {
+		t.Fatalf("Expected a PositionChangedEvent, got %T", event)
+	}
+
+	if position.DroneID != "drone1" || position.Longitude != 72.5 {
+		t.Errorf("Expected decoded position of drone1, got %+v", position)
+	}
+}
+
+func TestDecodeDeliveryOfStructuredCloudEvent(t *testing.T) {
+	envelope, _ := NewEventEnvelope(AlertSignalledEventType, AlertSignalledSchemaVersion, "drones-cmds", AlertSignalledEvent{DroneID: "drone1", FaultCode: 3})
+	publishing, _ := CloudEventFromEnvelope(envelope).ToAMQPStructured()
+
+	event, err := DefaultDecoder.DecodeDelivery(amqp.Delivery{ContentType: publishing.ContentType, Body: publishing.Body})
+	if err != nil {
+		t.Fatalf("Failed to decode delivery: %s", err)
+	}
+
+	if alert := event.(AlertSignalledEvent); alert.FaultCode != 3 {
+		t.Errorf("Expected fault code 3, got %d", alert.FaultCode)
+	}
+}
+
+func TestDecodeReportsUnknownEventTypes(t *testing.T) {
+	_, err := DefaultDecoder.Decode("drones.unknown", 0, []byte("{}"))
+	var unknown *UnknownEventTypeError
+	if !errors.As(err, &unknown) || unknown.EventType != "drones.unknown" {
+		t.Errorf("Expected an UnknownEventTypeError for 'drones.unknown', got %v", err)
+	}
+
+	_, err = DefaultDecoder.DecodeDelivery(amqp.Delivery{Body: []byte("{}")})
+	if err != ErrMissingEventType {
+		t.Errorf("Expected ErrMissingEventType, got %v", err)
+	}
+}
+
+func TestDecoderAcceptsCustomEventTypes(t *testing.T) {
+	type batteryReplacedEvent struct {
+		DroneID string `json:"drone_id"`
+	}
+
+	decoder := NewDecoder(NewEventRegistry())
+	err := decoder.Register("fleet.battery.replaced", 1, func() interface{} { return &batteryReplacedEvent{} })
+	if err != nil {
+		t.Fatalf("Failed to register custom event type: %s", err)
+	}
+
+	event, err := decoder.Decode("fleet.battery.replaced", 1, []byte("{\"drone_id\":\"drone1\"}"))
+	if err != nil {
+		t.Fatalf("Failed to decode custom event: %s", err)
+	}
+
+	if event.(batteryReplacedEvent).DroneID != "drone1" {
+		t.Errorf("Expected custom event of drone1, got %+v", event)
+	}
+}
@@ -0,0 +1,70 @@
+package dronecommon
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	TelemetryUpdatedEventType = "drones.telemetry.updated"
+	AlertSignalledEventType   = "drones.alert.signalled"
+	PositionChangedEventType  = "drones.position.changed"
+
+	// Registered events are also emitted when the metadata of a drone changes.
+	DroneRegisteredEventType     = "drones.drone.registered"
+	DroneDecommissionedEventType = "drones.drone.decommissioned"
+
+	TelemetryUpdatedSchemaVersion = 1
+	AlertSignalledSchemaVersion   = 1
+	PositionChangedSchemaVersion  = 1
+
+	DroneRegisteredSchemaVersion     = 1
+	DroneDecommissionedSchemaVersion = 1
+)
+
+// EventEnvelope carries an event together with the metadata consumers need
+// to identify, order and trace it without guessing from the queue name.
+type EventEnvelope struct {
+	EventID       string          `json:"event_id"`
+	EventType     string          `json:"event_type"`
+	SchemaVersion int             `json:"schema_version"`
+	Source        string          `json:"source"`
+	OccurredAt    time.Time       `json:"occurred_at"`
+	ReceivedOn    int64           `json:"received_on"`
+	CorrelationID string          `json:"correlation_id,omitempty"`
+	TenantID      string          `json:"tenant_id,omitempty"`
+	FleetID       string          `json:"fleet_id,omitempty"`
+	Data          json.RawMessage `json:"data"`
+}
+
+// NewEventEnvelope wraps event in an envelope with a fresh event ID.
+func NewEventEnvelope(eventType string, schemaVersion int, source string, event interface{}) (envelope EventEnvelope, err error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	envelope = EventEnvelope{
+		EventID:       NewEventID(),
+		EventType:     eventType,
+		SchemaVersion: schemaVersion,
+		Source:        source,
+		OccurredAt:    time.Now().UTC(),
+		Data:          data,
+	}
+	return
+}
+
+// NewEventID returns a random (version 4) UUID.
+func NewEventID() string {
+	var id [16]byte
+	_, err := rand.Read(id[:])
+	if err != nil {
+		panic(fmt.Sprintf("failed to read random bytes for event ID: %s", err))
+	}
+	id[6] = (id[6] & 0x0f) | 0x40
+	id[8] = (id[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
+}
@@ -0,0 +1,179 @@
+package dronecommon
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Upcaster transforms the payload of an event from one schema version into
+// the next one.
+type Upcaster func(data json.RawMessage) (json.RawMessage, error)
+
+// UnknownEventTypeError is returned for event types missing from a registry.
+type UnknownEventTypeError struct {
+	EventType string
+}
+
+// UnsupportedSchemaVersionError is returned when a payload can't be brought
+// up to the current schema version of its event type.
+type UnsupportedSchemaVersionError struct {
+	EventType      string
+	SchemaVersion  int
+	CurrentVersion int
+}
+
+type eventSchema struct {
+	version   int
+	factory   func() interface{}
+	upcasters map[int]Upcaster
+}
+
+// EventRegistry knows the current schema version of every event type, how to
+// build its struct and how to upcast older payloads into it.
+type EventRegistry struct {
+	mutex   sync.RWMutex
+	schemas map[string]*eventSchema
+}
+
+var DefaultRegistry = NewEventRegistry()
+
+func init() {
+	mustRegister(TelemetryUpdatedEventType, TelemetryUpdatedSchemaVersion, func() interface{} { return &TelemetryUpdatedEvent{} })
+	mustRegister(AlertSignalledEventType, AlertSignalledSchemaVersion, func() interface{} { return &AlertSignalledEvent{} })
+	mustRegister(PositionChangedEventType, PositionChangedSchemaVersion, func() interface{} { return &PositionChangedEvent{} })
+	mustRegister(DroneRegisteredEventType, DroneRegisteredSchemaVersion, func() interface{} { return &DroneRegisteredEvent{} })
+	mustRegister(DroneDecommissionedEventType, DroneDecommissionedSchemaVersion, func() interface{} { return &DroneDecommissionedEvent{} })
+}
+
+func (e *UnknownEventTypeError) Error() string {
+	return fmt.Sprintf("unknown event type '%s'", e.EventType)
+}
+
+func (e *UnsupportedSchemaVersionError) Error() string {
+	return fmt.Sprintf("unsupported schema version %d of event type '%s' (current version is %d)",
+		e.SchemaVersion, e.EventType, e.CurrentVersion)
+}
+
+func NewEventRegistry() *EventRegistry {
+	return &EventRegistry{schemas: make(map[string]*eventSchema)}
+}
+
+// Register declares the current schema version of an event type. factory
+// must return a pointer to a new, empty event struct.
+func (r *EventRegistry) Register(eventType string, version int, factory func() interface{}) error {
+	if version < 1 {
+		return fmt.Errorf("invalid schema version %d for event type '%s'", version, eventType)
+	}
+	if reflect.ValueOf(factory()).Kind() != reflect.Ptr {
+		return fmt.Errorf("factory of event type '%s' must return a pointer", eventType)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, exists := r.schemas[eventType]; exists {
+		return fmt.Errorf("event type '%s' is already registered", eventType)
+	}
+	r.schemas[eventType] = &eventSchema{version: version, factory: factory, upcasters: make(map[int]Upcaster)}
+	return nil
+}
+
+// RegisterUpcaster declares how to transform payloads of fromVersion into
+// fromVersion+1.
+func (r *EventRegistry) RegisterUpcaster(eventType string, fromVersion int, upcaster Upcaster) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	schema, ok := r.schemas[eventType]
+	if !ok {
+		return &UnknownEventTypeError{EventType: eventType}
+	}
+	if fromVersion < 1 || fromVersion >= schema.version {
+		return &UnsupportedSchemaVersionError{EventType: eventType, SchemaVersion: fromVersion, CurrentVersion: schema.version}
+	}
+	schema.upcasters[fromVersion] = upcaster
+	return nil
+}
+
+// SchemaVersion returns the current schema version of an event type.
+func (r *EventRegistry) SchemaVersion(eventType string) (int, error) {
+	schema, err := r.schema(eventType)
+	if err != nil {
+		return 0, err
+	}
+	return schema.version, nil
+}
+
+// Upcast brings a payload of the given schema version up to the current one.
+func (r *EventRegistry) Upcast(eventType string, version int, data []byte) (json.RawMessage, error) {
+	schema, err := r.schema(eventType)
+	if err != nil {
+		return nil, err
+	}
+
+	if version < 1 || version > schema.version {
+		return nil, &UnsupportedSchemaVersionError{EventType: eventType, SchemaVersion: version, CurrentVersion: schema.version}
+	}
+
+	upcasted := json.RawMessage(data)
+	for from := version; from < schema.version; from++ {
+		upcaster, ok := schema.upcasters[from]
+		if !ok {
+			return nil, &UnsupportedSchemaVersionError{EventType: eventType, SchemaVersion: version, CurrentVersion: schema.version}
+		}
+		upcasted, err = upcaster(upcasted)
+		if err != nil {
+			return nil, fmt.Errorf("failed to upcast event type '%s' from version %d: %s", eventType, from, err)
+		}
+	}
+	return upcasted, nil
+}
+
+// Decode upcasts the payload and unmarshals it into the current struct of
+// its event type, returning the struct by value.
+func (r *EventRegistry) Decode(eventType string, version int, data []byte) (interface{}, error) {
+	return r.decode(eventType, version, data, false)
+}
+
+// DecodeStrict works like Decode but rejects payloads with fields the current
+// struct does not know about.
+func (r *EventRegistry) DecodeStrict(eventType string, version int, data []byte) (interface{}, error) {
+	return r.decode(eventType, version, data, true)
+}
+
+func (r *EventRegistry) decode(eventType string, version int, data []byte, strict bool) (interface{}, error) {
+	upcasted, err := r.Upcast(eventType, version, data)
+	if err != nil {
+		return nil, err
+	}
+
+	schema, _ := r.schema(eventType)
+	event := schema.factory()
+	decoder := json.NewDecoder(bytes.NewReader(upcasted))
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+	err = decoder.Decode(event)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode event type '%s': %s", eventType, err)
+	}
+	return reflect.ValueOf(event).Elem().Interface(), nil
+}
+
+func (r *EventRegistry) schema(eventType string) (*eventSchema, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	schema, ok := r.schemas[eventType]
+	if !ok {
+		return nil, &UnknownEventTypeError{EventType: eventType}
+	}
+	return schema, nil
+}
+
+func mustRegister(eventType string, version int, factory func() interface{}) {
+	err := DefaultRegistry.Register(eventType, version, factory)
+	if err != nil {
+		panic(err)
+	}
+}
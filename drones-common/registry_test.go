@@ -0,0 +1,90 @@
+package dronecommon
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestSerializedFixturesStayCompatible decodes every fixture in testdata,
+// named <event type>.v<schema version>.json, into the current event structs.
+// Fixtures are never edited: a struct change that drops or renames a field
+// they carry needs a new schema version and an upcaster.
+func TestSerializedFixturesStayCompatible(t *testing.T) {
+	fixtures, _ := filepath.Glob(filepath.Join("testdata", "*.v*.json"))
+	if len(fixtures) == 0 {
+		t.Fatalf("Expected serialized event fixtures in testdata")
+	}
+
+	for _, fixture := range fixtures {
+		name := strings.TrimSuffix(filepath.Base(fixture), ".json")
+		separator := strings.LastIndex(name, ".v")
+		eventType := name[:separator]
+		version, err := strconv.Atoi(name[separator+2:])
+		if err != nil {
+			t.Errorf("Fixture %s is not named <event type>.v<version>.json", fixture)
+			continue
+		}
+
+		data, _ := ioutil.ReadFile(fixture)
+		upcasted, err := DefaultRegistry.Upcast(eventType, version, data)
+		if err != nil {
+			t.Errorf("Failed to upcast fixture %s: %s", fixture, err)
+			continue
+		}
+
+		event, err := DefaultRegistry.DecodeStrict(eventType, version, data)
+		if err != nil {
+			t.Errorf("Fixture %s no longer decodes: %s", fixture, err)
+			continue
+		}
+
+		var expected, actual map[string]interface{}
+		json.Unmarshal(upcasted, &expected)
+		encoded, _ := json.Marshal(event)
+		json.Unmarshal(encoded, &actual)
+		for field, value := range expected {
+			if !reflect.DeepEqual(actual[field], value) {
+				t.Errorf("Fixture %s lost field '%s': expected %v, got %v", fixture, field, value, actual[field])
+			}
+		}
+	}
+}
+
+func TestRegistryUpcastsOlderPayloads(t *testing.T) {
+	registry := NewEventRegistry()
+	registry.Register("drones.test.renamed", 2, func() interface{} { return &AlertSignalledEvent{} })
+	registry.RegisterUpcaster("drones.test.renamed", 1, func(data json.RawMessage) (json.RawMessage, error) {
+		var payload map[string]interface{}
+		json.Unmarshal(data, &payload)
+		payload["description"] = payload["message"]
+		delete(payload, "message")
+		return json.Marshal(payload)
+	})
+
+	event, err := registry.Decode("drones.test.renamed", 1, []byte("{\"drone_id\":\"drone1\",\"message\":\"overheating\"}"))
+	if err != nil {
+		t.Fatalf("Failed to decode version 1 payload: %s", err)
+	}
+
+	alert := event.(AlertSignalledEvent)
+	if alert.Description != "overheating" {
+		t.Errorf("Expected upcasted description 'overheating', got '%s'", alert.Description)
+	}
+}
+
+func TestRegistryRejectsVersionsWithoutUpcaster(t *testing.T) {
+	registry := NewEventRegistry()
+	registry.Register("drones.test.evolved", 3, func() interface{} { return &TelemetryUpdatedEvent{} })
+
+	_, err := registry.Decode("drones.test.evolved", 1, []byte("{}"))
+	var unsupported *UnsupportedSchemaVersionError
+	if !errors.As(err, &unsupported) {
+		t.Errorf("Expected an UnsupportedSchemaVersionError, got %v", err)
+	}
+}
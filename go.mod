@@ -0,0 +1,3 @@
+module github.com/maxsuelmarinho/golang-event-driven-example
+
+require github.com/streadway/amqp v0.0.0-20190402114354-16ed540749f6
@@ -1,3 +1,8 @@
 module github.com/maxsuelmarinho/golang-event-driven-example/rabbit-hello/receiver
 
-require github.com/streadway/amqp v0.0.0-20190404075320-75d898a42a94
+require (
+	github.com/maxsuelmarinho/golang-event-driven-example v0.0.0-00010101000000-000000000000
+	github.com/streadway/amqp v0.0.0-20190404075320-75d898a42a94
+)
+
+replace github.com/maxsuelmarinho/golang-event-driven-example => ../../
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 
+	dronescommon "github.com/maxsuelmarinho/golang-event-driven-example/drones-common"
 	"github.com/streadway/amqp"
 )
 
@@ -47,7 +49,15 @@ func main() {
 	forever := make(chan bool)
 	go func() {
 		for d := range msgs {
-			log.Printf("Received a message: %s\n", d.Body)
+			event, err := dronescommon.DefaultDecoder.DecodeDelivery(d)
+			switch {
+			case errors.Is(err, dronescommon.ErrMissingEventType):
+				log.Printf("Received a message: %s\n", d.Body)
+			case err != nil:
+				log.Printf("Failed to decode message %s: %s\n", d.MessageId, err)
+			default:
+				log.Printf("Received %T: %+v\n", event, event)
+			}
 		}
 	}()
 